@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"context"
+	"sync"
+)
+
+// Event is a chat message or event on its way to everyone connected to one
+// chat, whichever instance they are connected to.
+type Event struct {
+	ChatID string `bson:"chat_id"`
+	// Payload is the JSON sent to the WebSocket clients as is.
+	Payload []byte `bson:"payload"`
+	// Lossy events, such as typing indicators, are dropped for clients
+	// that cannot keep up instead of disconnecting them.
+	Lossy bool `bson:"lossy"`
+	// Close, when set, ends the chat instead: its connections are hung up
+	// with a normal closure giving Close as the reason.
+	Close string `bson:"close,omitempty"`
+}
+
+// Bus carries chat events between the instances serving the application.
+// Every event published on any instance is delivered to the subscribers of
+// every instance, including the publisher's own.
+type Bus interface {
+	Publish(ctx context.Context, e Event) error
+	// Subscribe calls deliver for each event until ctx is done. It returns
+	// once the subscription is in place, so events published afterwards
+	// are not missed. deliver must not block.
+	Subscribe(ctx context.Context, deliver func(context.Context, Event)) error
+	// Wait returns once every subscription has stopped delivering. Cancel
+	// their contexts first.
+	Wait()
+}
+
+// MemoryBus delivers events within the process. It is all a single
+// instance needs.
+type MemoryBus struct {
+	mu          sync.RWMutex
+	subscribers map[int]func(context.Context, Event)
+	next        int
+	running     sync.WaitGroup
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subscribers: make(map[int]func(context.Context, Event))}
+}
+
+// Publish delivers e to the subscribers before returning, in the
+// publisher's context.
+func (b *MemoryBus) Publish(ctx context.Context, e Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, deliver := range b.subscribers {
+		deliver(ctx, e)
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context, deliver func(context.Context, Event)) error {
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = deliver
+	b.mu.Unlock()
+	b.running.Add(1)
+	go func() {
+		defer b.running.Done()
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subscribers, id)
+		b.mu.Unlock()
+	}()
+	return nil
+}
+
+// Wait returns once the subscribers whose contexts are done have been
+// removed; taking the lock to remove one waits out a Publish delivering to
+// it.
+func (b *MemoryBus) Wait() {
+	b.running.Wait()
+}
@@ -0,0 +1,143 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryBus_DeliversToEverySubscriberUntilCancelled(t *testing.T) {
+	bus := NewMemoryBus()
+	first, second := make(chan Event, 1), make(chan Event, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := bus.Subscribe(ctx, func(_ context.Context, e Event) { first <- e }); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Subscribe(context.Background(), func(_ context.Context, e Event) { second <- e }); err != nil {
+		t.Fatal(err)
+	}
+
+	bus.Publish(context.Background(), Event{ChatID: "chat", Payload: []byte(`{"content":"hi"}`)})
+	for _, got := range []Event{<-first, <-second} {
+		if got.ChatID != "chat" || string(got.Payload) != `{"content":"hi"}` {
+			t.Errorf("Unexpected event %+v", got)
+		}
+	}
+
+	cancel()
+	waitFor(t, "the cancelled subscriber to be removed", func() bool {
+		bus.mu.RLock()
+		defer bus.mu.RUnlock()
+		return len(bus.subscribers) == 1
+	})
+	bus.Publish(context.Background(), Event{ChatID: "chat"})
+	select {
+	case e := <-first:
+		t.Errorf("Expected nothing after cancelling, got %+v", e)
+	case <-second:
+	}
+}
+
+func TestMemoryBus_WaitReturnsOnceSubscriptionsEnd(t *testing.T) {
+	bus := NewMemoryBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := bus.Subscribe(ctx, func(context.Context, Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		bus.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Wait to return after the subscription was cancelled")
+	}
+	if len(bus.subscribers) != 0 {
+		t.Errorf("Expected no subscribers after Wait, got %d", len(bus.subscribers))
+	}
+}
+func TestHub_DeliversBusEventsToItsConnections(t *testing.T) {
+	bus := NewMemoryBus()
+	hub := NewHub(testOptions())
+	conn := newFakeConn(false)
+	hub.Register("chat", conn)
+	hub.Register("other", newFakeConn(false))
+	bus.Subscribe(context.Background(), func(_ context.Context, e Event) { hub.Deliver(e) })
+
+	bus.Publish(context.Background(), Event{ChatID: "chat", Payload: []byte(`{}`)})
+	waitFor(t, "the event to be written", func() bool { return conn.written() == 1 })
+}
+
+// liveCollection returns a collection in a scratch database on the server
+// named by MOVIEVERSE_TEST_MONGO_URI, dropped when the test ends, and a
+// second handle to it through a separate client, standing in for another
+// instance.
+func liveCollection(t *testing.T) (*mongo.Collection, *mongo.Collection) {
+	t.Helper()
+	uri := os.Getenv("MOVIEVERSE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MOVIEVERSE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	name := fmt.Sprintf("movieverse_chat_%d", time.Now().UnixNano())
+	var collections []*mongo.Collection
+	for i := 0; i < 2; i++ {
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Disconnect(ctx) })
+		collections = append(collections, client.Database(name).Collection("chat_events"))
+	}
+	t.Cleanup(func() { collections[0].Database().Drop(ctx) })
+	return collections[0], collections[1]
+}
+
+func TestMongoBus_LiveRelaysBetweenInstances(t *testing.T) {
+	a, b := liveCollection(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan Event, 3)
+	err := NewMongoBus(b).Subscribe(ctx, func(_ context.Context, e Event) { received <- e })
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 40573 {
+		t.Skip("change streams need a replica set")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := NewMongoBus(a)
+	if err := publisher.Publish(ctx, Event{ChatID: "chat", Payload: []byte(`{"content":"hi"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(ctx, Event{ChatID: "chat", Payload: []byte(`{"type":"typing"}`), Lossy: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(ctx, Event{ChatID: "chat", Close: "chat closed"}); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []Event{
+		{ChatID: "chat", Payload: []byte(`{"content":"hi"}`)},
+		{ChatID: "chat", Payload: []byte(`{"type":"typing"}`), Lossy: true},
+		{ChatID: "chat", Close: "chat closed"},
+	} {
+		select {
+		case got := <-received:
+			if got.ChatID != want.ChatID || string(got.Payload) != string(want.Payload) || got.Lossy != want.Lossy || got.Close != want.Close {
+				t.Errorf("Event %d: expected %+v, got %+v", i, want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %d never arrived on the other instance", i)
+		}
+	}
+}
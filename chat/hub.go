@@ -0,0 +1,288 @@
+// Package chat fans chat messages out to WebSocket connections. Every
+// connection has its own send queue and writer goroutine, so a slow client
+// only ever holds up itself.
+package chat
+
+import (
+	"MovieVerse/metrics"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"sync"
+	"time"
+)
+
+// Conn is the part of *websocket.Conn the hub writes to; tests and
+// benchmarks substitute their own.
+type Conn interface {
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+type Options struct {
+	// SendQueue is how many messages may wait for a connection before it
+	// counts as a slow consumer.
+	SendQueue int
+	// WriteTimeout bounds every write to a connection.
+	WriteTimeout time.Duration
+	// PongTimeout is how long a connection may go without answering a ping
+	// before it is considered dead. Pings go out at PingInterval, which
+	// must be shorter.
+	PongTimeout  time.Duration
+	PingInterval time.Duration
+	// MaxMessageSize limits what a client may send in one message.
+	MaxMessageSize int64
+}
+
+func DefaultOptions() Options {
+	return Options{
+		SendQueue:      64,
+		WriteTimeout:   10 * time.Second,
+		PongTimeout:    60 * time.Second,
+		PingInterval:   54 * time.Second,
+		MaxMessageSize: 32 << 10,
+	}
+}
+
+// Hub tracks the connections of every chat.
+type Hub struct {
+	opts  Options
+	mu    sync.RWMutex
+	chats map[string]map[*Client]struct{}
+}
+
+func NewHub(opts Options) *Hub {
+	return &Hub{opts: opts, chats: make(map[string]map[*Client]struct{})}
+}
+
+// Client is one connection registered with the hub.
+type Client struct {
+	hub    *Hub
+	conn   Conn
+	chatID string
+	send   chan []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Attach registers a WebSocket connection with chatID and arms its
+// keepalive: reads fail once the client stops answering pings, which ends
+// the caller's read loop. The caller must Unregister the client when its
+// read loop ends.
+func (h *Hub) Attach(chatID string, ws *websocket.Conn) *Client {
+	ws.SetReadLimit(h.opts.MaxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(h.opts.PongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(h.opts.PongTimeout))
+	})
+	return h.Register(chatID, ws)
+}
+
+// Register adds conn to chatID and starts its writer.
+func (h *Hub) Register(chatID string, conn Conn) *Client {
+	c := &Client{
+		hub:    h,
+		conn:   conn,
+		chatID: chatID,
+		send:   make(chan []byte, h.opts.SendQueue),
+		done:   make(chan struct{}),
+	}
+	h.mu.Lock()
+	if h.chats[chatID] == nil {
+		h.chats[chatID] = make(map[*Client]struct{})
+	}
+	h.chats[chatID][c] = struct{}{}
+	h.mu.Unlock()
+	go c.writeLoop()
+	return c
+}
+
+// Unregister removes the client and closes its connection. It is safe to
+// call more than once.
+func (h *Hub) Unregister(c *Client) {
+	h.remove(c)
+	c.close(nil)
+}
+
+func (h *Hub) remove(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if clients, ok := h.chats[c.chatID]; ok {
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(h.chats, c.chatID)
+		}
+	}
+}
+
+// Deliver queues an event, as it arrives from a Bus, for every connection
+// in its chat and returns how many accepted it. A connection whose queue is
+// full cannot keep up: lossy events are dropped for it, while anything else
+// disconnects it rather than let it hold up the others. A closing event
+// hangs up on the chat's connections, as CloseChat does, and returns 0.
+func (h *Hub) Deliver(e Event) int {
+	if e.Close != "" {
+		h.CloseChat(e.ChatID, e.Close)
+		return 0
+	}
+	var clients []*Client
+	h.mu.RLock()
+	for c := range h.chats[e.ChatID] {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+	delivered := 0
+	for _, c := range clients {
+		if c.enqueue(e.Payload, e.Lossy) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// Send queues v, encoded as JSON, for this connection alone, with the same
+// slow-consumer handling as Deliver. It reports whether v was queued.
+func (c *Client) Send(v interface{}) (bool, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	return c.enqueue(payload, false), nil
+}
+
+// SendWait is Send for bursts, such as replaying history on connect: it
+// waits for room in the queue instead of treating a full one as a slow
+// consumer, and gives up after the write timeout.
+func (c *Client) SendWait(v interface{}) (bool, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	timer := time.NewTimer(c.hub.opts.WriteTimeout)
+	defer timer.Stop()
+	select {
+	case c.send <- payload:
+		return true, nil
+	case <-c.done:
+		return false, nil
+	case <-timer.C:
+		return false, nil
+	}
+}
+
+func (c *Client) enqueue(payload []byte, lossy bool) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- payload:
+		return true
+	default:
+	}
+	if lossy {
+		metrics.ChatSlowConsumers.WithLabelValues(metrics.SlowConsumerDropped).Inc()
+		return false
+	}
+	metrics.ChatSlowConsumers.WithLabelValues(metrics.SlowConsumerDisconnected).Inc()
+	c.hub.remove(c)
+	c.close(websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow to keep up"))
+	return false
+}
+
+// CloseChat disconnects everyone in chatID with a normal close frame.
+func (h *Hub) CloseChat(chatID string, reason string) {
+	h.mu.Lock()
+	clients := h.chats[chatID]
+	delete(h.chats, chatID)
+	h.mu.Unlock()
+	for c := range clients {
+		c.close(websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+	}
+}
+
+// Shutdown sends every connection a going-away close frame and hangs up.
+// Unlike the other ways of closing, it writes the frames before returning,
+// since the process is about to exit.
+func (h *Hub) Shutdown(reason string) {
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	deadline := time.Now().Add(time.Second)
+	h.mu.Lock()
+	chats := h.chats
+	h.chats = make(map[string]map[*Client]struct{})
+	h.mu.Unlock()
+	for _, clients := range chats {
+		for c := range clients {
+			c.conn.WriteControl(websocket.CloseMessage, message, deadline)
+			c.closeOnce.Do(func() {
+				close(c.done)
+				c.conn.Close()
+			})
+		}
+	}
+}
+
+// Connections counts the open connections per chat.
+func (h *Hub) Connections() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	conns := make(map[string]int, len(h.chats))
+	for id, clients := range h.chats {
+		conns[id] = len(clients)
+	}
+	return conns
+}
+
+// QueueDepth counts the messages waiting in every connection's send queue.
+func (h *Hub) QueueDepth() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	queued := 0
+	for _, clients := range h.chats {
+		for c := range clients {
+			queued += len(c.send)
+		}
+	}
+	return queued
+}
+
+// close stops the writer and hangs up, sending frame first if it is not
+// nil. It does not wait for the writer, which may be stuck in a write to a
+// client that stopped reading; closing the connection unblocks it.
+func (c *Client) close(frame []byte) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		go func() {
+			if frame != nil {
+				c.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(c.hub.opts.WriteTimeout))
+			}
+			c.conn.Close()
+		}()
+	})
+}
+
+func (c *Client) writeLoop() {
+	opts := c.hub.opts
+	ping := time.NewTicker(opts.PingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case frame := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(opts.WriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				c.hub.Unregister(c)
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(opts.WriteTimeout)); err != nil {
+				c.hub.Unregister(c)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package chat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn records what the hub writes. When block is set, message writes
+// wait until it is closed, like a client that stopped reading.
+type fakeConn struct {
+	mu       sync.Mutex
+	messages int
+	controls []int
+	closing  int
+	closed   chan struct{}
+	once     sync.Once
+	block    chan struct{}
+}
+
+func newFakeConn(blocked bool) *fakeConn {
+	c := &fakeConn{closed: make(chan struct{})}
+	if blocked {
+		c.block = make(chan struct{})
+	}
+	return c
+}
+
+func (c *fakeConn) WriteMessage(int, []byte) error {
+	if c.block != nil {
+		select {
+		case <-c.block:
+		case <-c.closed:
+			return websocket.ErrCloseSent
+		}
+	}
+	c.mu.Lock()
+	c.messages++
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *fakeConn) WriteControl(messageType int, data []byte, _ time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.controls = append(c.controls, messageType)
+	if messageType == websocket.CloseMessage && len(data) >= 2 {
+		c.closing = int(binary.BigEndian.Uint16(data))
+	}
+	return nil
+}
+
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) written() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.messages
+}
+
+func (c *fakeConn) closeCode() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.SendQueue = 4
+	return opts
+}
+
+func event(chatID string, lossy bool) Event {
+	return Event{ChatID: chatID, Payload: []byte(`{"type":"message"}`), Lossy: lossy}
+}
+
+func TestDeliver_SlowConsumerDoesNotHoldUpOthers(t *testing.T) {
+	hub := NewHub(testOptions())
+	fast, slow := newFakeConn(false), newFakeConn(true)
+	hub.Register("chat", fast)
+	hub.Register("chat", slow)
+
+	// The fast client keeps up with every message while the slow one's
+	// queue fills.
+	for i := 1; i <= 20; i++ {
+		hub.Deliver(event("chat", false))
+		waitFor(t, "the fast client to keep up", func() bool { return fast.written() == i })
+	}
+	waitFor(t, "the slow client to be hung up on", func() bool {
+		select {
+		case <-slow.closed:
+			return true
+		default:
+			return false
+		}
+	})
+	if code := slow.closeCode(); code != websocket.CloseTryAgainLater {
+		t.Errorf("Expected the slow client to be told to try again later, got close code %d", code)
+	}
+	if conns := hub.Connections()["chat"]; conns != 1 {
+		t.Errorf("Expected only the fast client to stay, got %d connections", conns)
+	}
+}
+
+func TestDeliver_LossyEventsKeepSlowConsumer(t *testing.T) {
+	hub := NewHub(testOptions())
+	slow := newFakeConn(true)
+	hub.Register("chat", slow)
+
+	delivered := 0
+	for i := 0; i < 20; i++ {
+		delivered += hub.Deliver(event("chat", true))
+	}
+	if delivered == 20 {
+		t.Error("Expected events to be dropped once the queue was full")
+	}
+	if conns := hub.Connections()["chat"]; conns != 1 {
+		t.Errorf("Expected the slow client to stay connected, got %d connections", conns)
+	}
+	close(slow.block)
+	waitFor(t, "the queued events to be written", func() bool { return slow.written() == delivered })
+}
+
+func TestCloseChat_SendsNormalClosure(t *testing.T) {
+	hub := NewHub(testOptions())
+	conn := newFakeConn(false)
+	hub.Register("chat", conn)
+	hub.Register("other", newFakeConn(false))
+
+	hub.CloseChat("chat", "chat closed")
+	<-conn.closed
+	if code := conn.closeCode(); code != websocket.CloseNormalClosure {
+		t.Errorf("Expected a normal closure, got close code %d", code)
+	}
+	if conns := hub.Connections(); conns["chat"] != 0 || conns["other"] != 1 {
+		t.Errorf("Expected only the closed chat to be dropped, got %v", conns)
+	}
+}
+
+func TestDeliver_CloseEventHangsUpOnChat(t *testing.T) {
+	hub := NewHub(testOptions())
+	conn := newFakeConn(false)
+	hub.Register("chat", conn)
+	hub.Register("other", newFakeConn(false))
+
+	if delivered := hub.Deliver(Event{ChatID: "chat", Close: "chat closed"}); delivered != 0 {
+		t.Errorf("Expected nothing to be queued, got %d", delivered)
+	}
+	<-conn.closed
+	if code := conn.closeCode(); code != websocket.CloseNormalClosure {
+		t.Errorf("Expected a normal closure, got close code %d", code)
+	}
+	if conns := hub.Connections(); conns["chat"] != 0 || conns["other"] != 1 {
+		t.Errorf("Expected only the closed chat to be dropped, got %v", conns)
+	}
+}
+
+func TestAttach_DropsClientThatStopsAnsweringPings(t *testing.T) {
+	opts := testOptions()
+	opts.PingInterval = 20 * time.Millisecond
+	opts.PongTimeout = 100 * time.Millisecond
+	hub := NewHub(opts)
+
+	readErr := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := hub.Attach("chat", ws)
+		defer hub.Unregister(client)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	// The dialled connection is never read from, so pings go unanswered.
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case err := <-readErr:
+		if !strings.Contains(err.Error(), "timeout") {
+			t.Errorf("Expected the read deadline to expire, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the unresponsive client to be dropped")
+	}
+	waitFor(t, "the client to be unregistered", func() bool { return len(hub.Connections()) == 0 })
+}
+
+func TestAttach_KeepsClientThatAnswersPings(t *testing.T) {
+	opts := testOptions()
+	opts.PingInterval = 20 * time.Millisecond
+	opts.PongTimeout = 100 * time.Millisecond
+	hub := NewHub(opts)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := hub.Attach("chat", ws)
+		defer hub.Unregister(client)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	// Reading is what answers pings on the client side.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(5 * opts.PongTimeout)
+	if conns := hub.Connections()["chat"]; conns != 1 {
+		t.Errorf("Expected the responsive client to stay connected, got %d connections", conns)
+	}
+}
+
+func TestSendWait_WaitsForRoomInsteadOfDisconnecting(t *testing.T) {
+	hub := NewHub(testOptions())
+	conn := newFakeConn(true)
+	client := hub.Register("chat", conn)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(conn.block)
+	}()
+	for i := 0; i < 10; i++ {
+		if ok, err := client.SendWait(i); !ok || err != nil {
+			t.Fatalf("Expected message %d to be queued, got %v, %v", i, ok, err)
+		}
+	}
+	waitFor(t, "every message to be written", func() bool { return conn.written() == 10 })
+	if conns := hub.Connections()["chat"]; conns != 1 {
+		t.Errorf("Expected the client to stay connected, got %d connections", conns)
+	}
+}
+
+// BenchmarkDeliver fans messages out to many simulated clients spread
+// over chats of ten, some of which never drain their queue.
+func BenchmarkDeliver(b *testing.B) {
+	for _, clients := range []int{1000, 5000} {
+		for _, slowEvery := range []int{0, 100} {
+			slow := 0
+			if slowEvery > 0 {
+				slow = clients / slowEvery
+			}
+			b.Run(fmt.Sprintf("clients=%d/slow=%d", clients, slow), func(b *testing.B) {
+				hub := NewHub(DefaultOptions())
+				chats := clients / 10
+				var conns []*fakeConn
+				for i := 0; i < clients; i++ {
+					conn := newFakeConn(slowEvery > 0 && i%slowEvery == 0)
+					conns = append(conns, conn)
+					hub.Register(fmt.Sprintf("chat-%d", i%chats), conn)
+				}
+				b.Cleanup(func() {
+					hub.Shutdown("benchmark over")
+					for _, conn := range conns {
+						conn.Close()
+					}
+				})
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					hub.Deliver(event(fmt.Sprintf("chat-%d", i%chats), false))
+				}
+			})
+		}
+	}
+}
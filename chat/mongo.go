@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"MovieVerse/logging"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+	"time"
+)
+
+// MongoBus shares events between instances through a MongoDB collection:
+// publishing inserts a document and every instance watches the collection
+// with a change stream. Change streams need a replica set or sharded
+// cluster; a single-node replica set is enough.
+type MongoBus struct {
+	collection *mongo.Collection
+	running    sync.WaitGroup
+}
+
+func NewMongoBus(collection *mongo.Collection) *MongoBus {
+	return &MongoBus{collection: collection}
+}
+
+// eventTTL is how long published events stay in the collection. Subscribers
+// get them from the change stream, so this only bounds its size.
+const eventTTL = time.Minute
+
+type eventDocument struct {
+	Event    `bson:",inline"`
+	ExpireAt time.Time `bson:"expire_at"`
+}
+
+func (b *MongoBus) Publish(ctx context.Context, e Event) error {
+	_, err := b.collection.InsertOne(ctx, eventDocument{Event: e, ExpireAt: time.Now().Add(eventTTL)})
+	return err
+}
+
+// Subscribe opens the change stream before returning, so it fails straight
+// away on a server without change streams. Afterwards it keeps resuming
+// the stream where it left off until ctx is done.
+func (b *MongoBus) Subscribe(ctx context.Context, deliver func(context.Context, Event)) error {
+	stream, err := b.watch(ctx, nil)
+	if err != nil {
+		return err
+	}
+	b.running.Add(1)
+	go func() {
+		defer b.running.Done()
+		b.run(ctx, stream, deliver)
+	}()
+	return nil
+}
+
+func (b *MongoBus) Wait() {
+	b.running.Wait()
+}
+
+func (b *MongoBus) watch(ctx context.Context, resumeAfter bson.Raw) (*mongo.ChangeStream, error) {
+	opts := options.ChangeStream()
+	if resumeAfter != nil {
+		opts.SetResumeAfter(resumeAfter)
+	}
+	return b.collection.Watch(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": "insert"}}},
+	}, opts)
+}
+
+const (
+	initialRetryDelay = 500 * time.Millisecond
+	maxRetryDelay     = 10 * time.Second
+
+	// Server errors meaning a resume token can no longer be used.
+	changeStreamFatal       = 280
+	changeStreamHistoryLost = 286
+)
+
+func (b *MongoBus) run(ctx context.Context, stream *mongo.ChangeStream, deliver func(context.Context, Event)) {
+	logger := logging.Subsystem("chat")
+	delay := initialRetryDelay
+	for {
+		for stream.Next(ctx) {
+			delay = initialRetryDelay
+			var change struct {
+				Event Event `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				logger.Warnln("Skipping undecodable chat event:", err)
+				continue
+			}
+			deliver(ctx, change.Event)
+		}
+		err := stream.Err()
+		resumeAfter := stream.ResumeToken()
+		stream.Close(context.Background())
+
+		// The driver already retries once on resumable errors, so this
+		// is a longer outage; keep trying with backoff.
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Warnf("Chat bus change stream interrupted, resuming in %v", delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			stream, err = b.watch(ctx, resumeAfter)
+			if err == nil {
+				break
+			}
+			var cmdErr mongo.CommandError
+			if errors.As(err, &cmdErr) && (cmdErr.Code == changeStreamFatal || cmdErr.Code == changeStreamHistoryLost) {
+				logger.WithError(err).Errorln("Chat bus cannot resume where it left off; events published meanwhile are lost")
+				resumeAfter = nil
+			}
+		}
+	}
+}
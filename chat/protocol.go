@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"MovieVerse/models"
+	"encoding/json"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Envelope types. Clients send message, typing and read_receipt; the server
+// sends those on to the other participants and adds ack, system and error.
+const (
+	TypeMessage     = "message"
+	TypeTyping      = "typing"
+	TypeReadReceipt = "read_receipt"
+	TypeAck         = "ack"
+	TypeSystem      = "system"
+	TypeError       = "error"
+)
+
+// System events, carried in Envelope.Event.
+const (
+	// EventPresence has Status "online" or "offline".
+	EventPresence = "presence"
+	// EventAssignment has Status "assigned" or "transferred".
+	EventAssignment = "assignment"
+	// EventReplay follows the messages replayed on connecting, with Status
+	// "complete", or "truncated" when there were more than fit.
+	EventReplay = "replay"
+)
+
+// Error codes, carried in Envelope.Code.
+const (
+	ErrCodeInvalid  = "invalid_message"
+	ErrCodeInternal = "internal_error"
+	ErrCodeClosed   = "chat_closed"
+)
+
+// MaxContentLength caps a message's content, in characters.
+const MaxContentLength = 4000
+
+// Envelope is every frame exchanged over a chat WebSocket.
+type Envelope struct {
+	Type   string `json:"type"`
+	ChatID string `json:"chat_id,omitempty"`
+	// ID is the server's ID of a stored message. Replays start after one
+	// and read receipts name the last one read.
+	ID string `json:"id,omitempty"`
+	// ClientMsgID is chosen by the client for each message it sends and
+	// echoed in the ack or error, so it can match them up. Resending a
+	// message with the same ClientMsgID does not store it twice.
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// Sender is set by the server from the authenticated user; whatever a
+	// client puts here is ignored.
+	Sender    *Sender   `json:"sender,omitempty"`
+	Content   string    `json:"content,omitempty"`
+	Event     string    `json:"event,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	Code      string    `json:"code,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Sender is who a message or event comes from. Role is "client" for the
+// customer who opened the chat and "agent" for support staff.
+type Sender struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name,omitempty"`
+	Role   string `json:"role"`
+}
+
+// ParseClient decodes a frame sent by a client and checks it is one a
+// client may send. The returned envelope keeps whatever ClientMsgID could
+// be read, so an error can be matched to the message that caused it.
+func ParseClient(data []byte) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Envelope{}, errors.New("message is not valid JSON")
+	}
+	e.Sender = nil
+	switch e.Type {
+	case TypeMessage:
+		if strings.TrimSpace(e.Content) == "" {
+			return e, errors.New("content must not be empty")
+		}
+		if utf8.RuneCountInString(e.Content) > MaxContentLength {
+			return e, errors.New("content is too long")
+		}
+		if len(e.ClientMsgID) > 64 {
+			return e, errors.New("client_msg_id is too long")
+		}
+	case TypeTyping:
+	case TypeReadReceipt:
+		if !primitive.IsValidObjectID(e.ID) {
+			return e, errors.New("read_receipt needs the id of the last message read")
+		}
+	default:
+		return e, errors.New("unknown message type")
+	}
+	return e, nil
+}
+
+// FromMessage is the envelope for a stored message.
+func FromMessage(m models.ChatMessage) Envelope {
+	e := Envelope{
+		Type:        TypeMessage,
+		ChatID:      m.ChatSessionID.Hex(),
+		ID:          m.ID.Hex(),
+		ClientMsgID: m.ClientMsgID,
+		Content:     m.Content,
+		Timestamp:   m.Timestamp,
+		Sender:      &Sender{Name: m.Sender, Role: m.SenderRole},
+	}
+	if !m.SenderID.IsZero() {
+		e.Sender.UserID = m.SenderID.Hex()
+	}
+	return e
+}
+
+// Error is the envelope telling a client what was wrong with what it sent.
+func Error(code string, cause error, clientMsgID string) Envelope {
+	return Envelope{Type: TypeError, Code: code, Content: cause.Error(), ClientMsgID: clientMsgID, Timestamp: time.Now()}
+}
@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"MovieVerse/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClient(t *testing.T) {
+	cases := []struct {
+		name  string
+		frame string
+		ok    bool
+	}{
+		{"message", `{"type":"message","client_msg_id":"m1","content":"hi"}`, true},
+		{"typing", `{"type":"typing"}`, true},
+		{"read receipt", `{"type":"read_receipt","id":"` + primitive.NewObjectID().Hex() + `"}`, true},
+		{"not JSON", `hello`, false},
+		{"legacy message without a type", `{"chat_id":"1","username":"Admin","content":"hi"}`, false},
+		{"server-only type", `{"type":"ack","client_msg_id":"m1"}`, false},
+		{"blank content", `{"type":"message","content":"  "}`, false},
+		{"content too long", `{"type":"message","content":"` + strings.Repeat("a", MaxContentLength+1) + `"}`, false},
+		{"read receipt without id", `{"type":"read_receipt"}`, false},
+	}
+	for _, tc := range cases {
+		_, err := ParseClient([]byte(tc.frame))
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok=%v, got %v", tc.name, tc.ok, err)
+		}
+	}
+}
+
+func TestParseClient_IgnoresClaimedSender(t *testing.T) {
+	e, err := ParseClient([]byte(`{"type":"message","content":"hi","sender":{"user_id":"someone","role":"agent"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Sender != nil {
+		t.Errorf("Expected the client's sender to be dropped, got %+v", e.Sender)
+	}
+}
+
+func TestParseClient_KeepsClientMsgIDOnError(t *testing.T) {
+	e, err := ParseClient([]byte(`{"type":"message","client_msg_id":"m7","content":""}`))
+	if err == nil || e.ClientMsgID != "m7" {
+		t.Errorf("Expected an error tied to m7, got %q, %v", e.ClientMsgID, err)
+	}
+}
+
+func TestFromMessage(t *testing.T) {
+	m := models.ChatMessage{
+		ID:            primitive.NewObjectID(),
+		ChatSessionID: primitive.NewObjectID(),
+		Sender:        "alice",
+		SenderID:      primitive.NewObjectID(),
+		SenderRole:    "client",
+		ClientMsgID:   "m1",
+		Content:       "hi",
+		Timestamp:     time.Now(),
+	}
+	e := FromMessage(m)
+	if e.Type != TypeMessage || e.ID != m.ID.Hex() || e.ChatID != m.ChatSessionID.Hex() || e.ClientMsgID != "m1" {
+		t.Errorf("Unexpected envelope %+v", e)
+	}
+	if e.Sender == nil || e.Sender.UserID != m.SenderID.Hex() || e.Sender.Name != "alice" || e.Sender.Role != "client" {
+		t.Errorf("Unexpected sender %+v", e.Sender)
+	}
+
+	// Messages from before senders were recorded only have a name.
+	legacy := FromMessage(models.ChatMessage{ID: primitive.NewObjectID(), Sender: "Admin", Content: "hi"})
+	if legacy.Sender.UserID != "" || legacy.Sender.Name != "Admin" {
+		t.Errorf("Unexpected legacy sender %+v", legacy.Sender)
+	}
+}
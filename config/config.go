@@ -0,0 +1,673 @@
+// Package config loads the application settings. Values come from the
+// defaults below, an optional YAML file, environment variables and
+// command-line flags, each overriding the previous one.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Mongo     Mongo     `yaml:"mongo"`
+	SMTP      SMTP      `yaml:"smtp"`
+	Auth      Auth      `yaml:"auth"`
+	Retention Retention `yaml:"retention"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+	Metrics   Metrics   `yaml:"metrics"`
+	Support   Support   `yaml:"support"`
+	Chat      Chat      `yaml:"chat"`
+	Password  Password  `yaml:"password"`
+	Lockout   Lockout   `yaml:"lockout"`
+	OIDC      OIDC      `yaml:"oidc"`
+	Logging   Logging   `yaml:"logging"`
+	Tracing   Tracing   `yaml:"tracing"`
+}
+
+type Server struct {
+	Addr string `yaml:"addr"`
+	// PublicURL is where users reach the site; links in emails point here.
+	PublicURL       string        `yaml:"public_url"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type Mongo struct {
+	URI                    string        `yaml:"uri"`
+	Database               string        `yaml:"database"`
+	MaxPoolSize            uint64        `yaml:"max_pool_size"`
+	MinPoolSize            uint64        `yaml:"min_pool_size"`
+	MaxConnIdleTime        time.Duration `yaml:"max_conn_idle_time"`
+	ConnectTimeout         time.Duration `yaml:"connect_timeout"`
+	ServerSelectionTimeout time.Duration `yaml:"server_selection_timeout"`
+	// StartupTimeout is how long startup keeps retrying an unreachable
+	// database before giving up.
+	StartupTimeout time.Duration `yaml:"startup_timeout"`
+	// AutoMigrate applies pending migrations when the server starts;
+	// otherwise they are left to "movieverse migrate up".
+	AutoMigrate bool `yaml:"auto_migrate"`
+	// MigrationWait is how long startup waits for migrations another
+	// instance is applying before giving up.
+	MigrationWait time.Duration `yaml:"migration_wait"`
+}
+
+type SMTP struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+type Auth struct {
+	JWTSecret string `yaml:"jwt_secret"`
+	// AuditKey keys the audit log's hash chain. Keeping it out of MongoDB
+	// is what stops someone with database access from rewriting the log.
+	AuditKey        string `yaml:"audit_key"`
+	RequireAdmin2FA bool   `yaml:"require_admin_2fa"`
+}
+
+type Retention struct {
+	// AccountDeletionGrace is how long a deletion request can be cancelled.
+	AccountDeletionGrace time.Duration `yaml:"account_deletion_grace"`
+	// Activity is how long activity_logs entries are kept before MongoDB's
+	// TTL monitor removes them. Each entry's expiry is fixed when it is
+	// logged, so a change applies to entries logged afterwards.
+	Activity time.Duration `yaml:"activity"`
+}
+
+type RateLimit struct {
+	// Store is "memory" for per-process budgets or "mongo" to share them
+	// between instances.
+	Store string `yaml:"store"`
+	// Budgets per route group. Anonymous endpoints are keyed by IP, the
+	// others by the signed-in user.
+	Login    Budget `yaml:"login"`
+	Signup   Budget `yaml:"signup"`
+	Password Budget `yaml:"password"`
+	Checkout Budget `yaml:"checkout"`
+	API      Budget `yaml:"api"`
+}
+
+// Budget allows Limit requests per Window.
+type Budget struct {
+	Limit  int           `yaml:"limit"`
+	Window time.Duration `yaml:"window"`
+}
+
+type Metrics struct {
+	// Token, when set, must be sent as a bearer token to scrape /metrics.
+	Token string `yaml:"token"`
+}
+
+type Support struct {
+	// Assignment is how waiting chats reach agents: manual, round_robin
+	// or least_busy.
+	Assignment string `yaml:"assignment"`
+	// MaxChatsPerAgent caps automatic assignment; 0 means no cap.
+	MaxChatsPerAgent int `yaml:"max_chats_per_agent"`
+}
+
+type Chat struct {
+	// Bus is "memory" when a single instance serves chat or "mongo" to
+	// relay messages between instances through change streams, which
+	// need MongoDB to run as a replica set.
+	Bus string `yaml:"bus"`
+}
+
+type Password struct {
+	MinLength  int `yaml:"min_length"`
+	MaxLength  int `yaml:"max_length"`
+	BcryptCost int `yaml:"bcrypt_cost"`
+	// BreachedList is a file with one known-breached password per line,
+	// rejected in addition to the built-in list.
+	BreachedList string `yaml:"breached_list"`
+}
+
+// Lockout controls how failed logins are slowed down and when an account
+// is locked until its owner follows the emailed unlock link.
+type Lockout struct {
+	FreeAttempts    int           `yaml:"free_attempts"`
+	BaseDelay       time.Duration `yaml:"backoff_base"`
+	MaxDelay        time.Duration `yaml:"backoff_max"`
+	MaxFailures     int           `yaml:"max_failures"`
+	LockDuration    time.Duration `yaml:"lock_duration"`
+	IPMaxFailures   int           `yaml:"ip_max_failures"`
+	IPBlockDuration time.Duration `yaml:"ip_block_duration"`
+	// ResetAfter is how long after the last failure the count starts over.
+	ResetAfter time.Duration `yaml:"reset_after"`
+}
+
+type OIDC struct {
+	Providers []OIDCProvider `yaml:"providers"`
+}
+
+type OIDCProvider struct {
+	Name         string `yaml:"name"`
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"`
+}
+
+type Logging struct {
+	// Outputs lists the sinks: stdout, stderr, file and syslog.
+	Outputs []string  `yaml:"outputs"`
+	File    LogFile   `yaml:"file"`
+	Syslog  LogSyslog `yaml:"syslog"`
+	// Level applies to every subsystem without an entry in Levels.
+	Level  string            `yaml:"level"`
+	Levels map[string]string `yaml:"levels"`
+}
+
+type LogFile struct {
+	Path        string        `yaml:"path"`
+	MaxSizeMB   int           `yaml:"max_size_mb"`
+	RotateEvery time.Duration `yaml:"rotate_every"`
+	MaxAge      time.Duration `yaml:"max_age"`
+	MaxBackups  int           `yaml:"max_backups"`
+	Compress    bool          `yaml:"compress"`
+}
+
+// LogSyslog points at a syslog daemon; empty Network and Address use the
+// local one.
+type LogSyslog struct {
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	Tag     string `yaml:"tag"`
+}
+
+// Tracing selects where spans go. The OTLP endpoint, headers and sampler
+// are left to the standard OTEL_EXPORTER_OTLP_* and OTEL_TRACES_SAMPLER
+// variables, which the SDK reads itself.
+type Tracing struct {
+	// Exporter is none, stdout or otlp.
+	Exporter    string `yaml:"exporter"`
+	ServiceName string `yaml:"service_name"`
+}
+
+func Default() Config {
+	return Config{
+		Server: Server{
+			Addr:            ":8080",
+			PublicURL:       "http://localhost:8080",
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Mongo: Mongo{
+			URI:                    "mongodb://127.0.0.1:27017",
+			Database:               "movieverse",
+			MaxPoolSize:            100,
+			MaxConnIdleTime:        5 * time.Minute,
+			ConnectTimeout:         10 * time.Second,
+			ServerSelectionTimeout: 10 * time.Second,
+			StartupTimeout:         time.Minute,
+			AutoMigrate:            true,
+			MigrationWait:          5 * time.Minute,
+		},
+		// SMTP credentials, the JWT secret and the audit key have no
+		// defaults; they must come from the file or the environment.
+		SMTP: SMTP{Port: 587},
+		Retention: Retention{
+			AccountDeletionGrace: 30 * 24 * time.Hour,
+			Activity:             90 * 24 * time.Hour,
+		},
+		RateLimit: RateLimit{
+			Store:    "memory",
+			Login:    Budget{Limit: 10, Window: time.Minute},
+			Signup:   Budget{Limit: 5, Window: time.Hour},
+			Password: Budget{Limit: 5, Window: 15 * time.Minute},
+			Checkout: Budget{Limit: 10, Window: time.Minute},
+			API:      Budget{Limit: 60, Window: time.Minute},
+		},
+		Support:  Support{Assignment: "least_busy", MaxChatsPerAgent: 5},
+		Chat:     Chat{Bus: "memory"},
+		Password: Password{MinLength: 8, MaxLength: 72, BcryptCost: bcrypt.DefaultCost},
+		Lockout: Lockout{
+			FreeAttempts:    3,
+			BaseDelay:       time.Second,
+			MaxDelay:        5 * time.Minute,
+			MaxFailures:     10,
+			LockDuration:    time.Hour,
+			IPMaxFailures:   50,
+			IPBlockDuration: 15 * time.Minute,
+			ResetAfter:      time.Hour,
+		},
+		Logging: Logging{
+			Outputs: []string{"stdout", "file"},
+			File: LogFile{
+				Path:        "user_actions.log",
+				MaxSizeMB:   100,
+				RotateEvery: 24 * time.Hour,
+				MaxAge:      30 * 24 * time.Hour,
+				MaxBackups:  10,
+				Compress:    true,
+			},
+			Syslog: LogSyslog{Tag: "movieverse"},
+			Level:  "info",
+			Levels: map[string]string{},
+		},
+		Tracing: Tracing{Exporter: "none", ServiceName: "movieverse"},
+	}
+}
+
+// Invocation describes how the binary was started, apart from the settings.
+type Invocation struct {
+	// File is the YAML file the settings were read from, if any.
+	File        string
+	PrintConfig bool
+	// Args are the arguments left after the flags, e.g. a subcommand.
+	Args []string
+}
+
+// Load builds the configuration from args (without the program name). The
+// YAML file is taken from -config or CONFIG_FILE. A .env file in the working
+// directory is loaded into the environment first if there is one. The result
+// is not validated: the server checks it with Validate, while subcommands
+// only check the settings they use.
+func Load(args []string) (Config, Invocation, error) {
+	cfg := Default()
+	var inv Invocation
+
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return cfg, inv, fmt.Errorf(".env: %w", err)
+	}
+
+	flags := flag.NewFlagSet("movieverse", flag.ContinueOnError)
+	flags.StringVar(&inv.File, "config", os.Getenv("CONFIG_FILE"), "path to a YAML configuration file")
+	flags.BoolVar(&inv.PrintConfig, "print-config", false, "print the effective configuration and exit")
+	addr := flags.String("addr", "", "listen address, e.g. :8080")
+	publicURL := flags.String("public-url", "", "base URL used in links sent to users")
+	mongoURI := flags.String("mongo-uri", "", "MongoDB connection string")
+	mongoDatabase := flags.String("mongo-database", "", "MongoDB database name")
+	if err := flags.Parse(args); err != nil {
+		return cfg, inv, err
+	}
+	inv.Args = flags.Args()
+
+	if inv.File != "" {
+		if err := cfg.loadFile(inv.File); err != nil {
+			return cfg, inv, err
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return cfg, inv, err
+	}
+	for _, f := range []struct {
+		value  string
+		target *string
+	}{
+		{*addr, &cfg.Server.Addr},
+		{*publicURL, &cfg.Server.PublicURL},
+		{*mongoURI, &cfg.Mongo.URI},
+		{*mongoDatabase, &cfg.Mongo.Database},
+	} {
+		if f.value != "" {
+			*f.target = f.value
+		}
+	}
+	cfg.Server.PublicURL = strings.TrimSuffix(cfg.Server.PublicURL, "/")
+	if cfg.Tracing.Exporter == "console" {
+		// OTEL_TRACES_EXPORTER calls the stdout exporter "console".
+		cfg.Tracing.Exporter = "stdout"
+	}
+	return cfg, inv, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	strs := map[string]*string{
+		"HTTP_ADDR":              &c.Server.Addr,
+		"PUBLIC_URL":             &c.Server.PublicURL,
+		"MONGODB_URI":            &c.Mongo.URI,
+		"MONGODB_DATABASE":       &c.Mongo.Database,
+		"SMTP_HOST":              &c.SMTP.Host,
+		"SMTP_USERNAME":          &c.SMTP.Username,
+		"SMTP_PASSWORD":          &c.SMTP.Password,
+		"SMTP_FROM":              &c.SMTP.From,
+		"JWT_SECRET":             &c.Auth.JWTSecret,
+		"AUDIT_KEY":              &c.Auth.AuditKey,
+		"RATE_LIMIT_STORE":       &c.RateLimit.Store,
+		"METRICS_TOKEN":          &c.Metrics.Token,
+		"SUPPORT_ASSIGNMENT":     &c.Support.Assignment,
+		"CHAT_BUS":               &c.Chat.Bus,
+		"PASSWORD_BREACHED_LIST": &c.Password.BreachedList,
+		"LOG_FILE":               &c.Logging.File.Path,
+		"LOG_SYSLOG_NETWORK":     &c.Logging.Syslog.Network,
+		"LOG_SYSLOG_ADDRESS":     &c.Logging.Syslog.Address,
+		"LOG_SYSLOG_TAG":         &c.Logging.Syslog.Tag,
+		"LOG_LEVEL":              &c.Logging.Level,
+		"OTEL_TRACES_EXPORTER":   &c.Tracing.Exporter,
+		"OTEL_SERVICE_NAME":      &c.Tracing.ServiceName,
+	}
+	for name, target := range strs {
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			*target = value
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"SHUTDOWN_TIMEOUT":                 &c.Server.ShutdownTimeout,
+		"MONGODB_MAX_CONN_IDLE_TIME":       &c.Mongo.MaxConnIdleTime,
+		"MONGODB_CONNECT_TIMEOUT":          &c.Mongo.ConnectTimeout,
+		"MONGODB_SERVER_SELECTION_TIMEOUT": &c.Mongo.ServerSelectionTimeout,
+		"MONGODB_STARTUP_TIMEOUT":          &c.Mongo.StartupTimeout,
+		"MONGODB_MIGRATION_WAIT":           &c.Mongo.MigrationWait,
+		"ACCOUNT_DELETION_GRACE":           &c.Retention.AccountDeletionGrace,
+		"ACTIVITY_RETENTION":               &c.Retention.Activity,
+		"LOGIN_BACKOFF_BASE":               &c.Lockout.BaseDelay,
+		"LOGIN_BACKOFF_MAX":                &c.Lockout.MaxDelay,
+		"LOGIN_LOCK_DURATION":              &c.Lockout.LockDuration,
+		"LOGIN_IP_BLOCK_DURATION":          &c.Lockout.IPBlockDuration,
+		"LOGIN_RESET_AFTER":                &c.Lockout.ResetAfter,
+		"LOG_FILE_ROTATE_EVERY":            &c.Logging.File.RotateEvery,
+		"LOG_FILE_MAX_AGE":                 &c.Logging.File.MaxAge,
+		"RATE_LIMIT_LOGIN_WINDOW":          &c.RateLimit.Login.Window,
+		"RATE_LIMIT_SIGNUP_WINDOW":         &c.RateLimit.Signup.Window,
+		"RATE_LIMIT_PASSWORD_WINDOW":       &c.RateLimit.Password.Window,
+		"RATE_LIMIT_CHECKOUT_WINDOW":       &c.RateLimit.Checkout.Window,
+		"RATE_LIMIT_API_WINDOW":            &c.RateLimit.API.Window,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*target = d
+		}
+	}
+
+	sizes := map[string]*uint64{
+		"MONGODB_MAX_POOL_SIZE": &c.Mongo.MaxPoolSize,
+		"MONGODB_MIN_POOL_SIZE": &c.Mongo.MinPoolSize,
+	}
+	for name, target := range sizes {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*target = n
+		}
+	}
+
+	ints := map[string]*int{
+		"SMTP_PORT":                   &c.SMTP.Port,
+		"SUPPORT_MAX_CHATS_PER_AGENT": &c.Support.MaxChatsPerAgent,
+		"PASSWORD_MIN_LENGTH":         &c.Password.MinLength,
+		"PASSWORD_MAX_LENGTH":         &c.Password.MaxLength,
+		"PASSWORD_BCRYPT_COST":        &c.Password.BcryptCost,
+		"LOGIN_FREE_ATTEMPTS":         &c.Lockout.FreeAttempts,
+		"LOGIN_MAX_FAILURES":          &c.Lockout.MaxFailures,
+		"LOGIN_IP_MAX_FAILURES":       &c.Lockout.IPMaxFailures,
+		"LOG_FILE_MAX_SIZE_MB":        &c.Logging.File.MaxSizeMB,
+		"LOG_FILE_MAX_BACKUPS":        &c.Logging.File.MaxBackups,
+		"RATE_LIMIT_LOGIN_LIMIT":      &c.RateLimit.Login.Limit,
+		"RATE_LIMIT_SIGNUP_LIMIT":     &c.RateLimit.Signup.Limit,
+		"RATE_LIMIT_PASSWORD_LIMIT":   &c.RateLimit.Password.Limit,
+		"RATE_LIMIT_CHECKOUT_LIMIT":   &c.RateLimit.Checkout.Limit,
+		"RATE_LIMIT_API_LIMIT":        &c.RateLimit.API.Limit,
+	}
+	for name, target := range ints {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*target = n
+		}
+	}
+	bools := map[string]*bool{
+		"REQUIRE_ADMIN_2FA":    &c.Auth.RequireAdmin2FA,
+		"MONGODB_AUTO_MIGRATE": &c.Mongo.AutoMigrate,
+		"LOG_FILE_COMPRESS":    &c.Logging.File.Compress,
+	}
+	for name, target := range bools {
+		if value := os.Getenv(name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*target = b
+		}
+	}
+
+	if value := os.Getenv("LOG_OUTPUTS"); value != "" {
+		c.Logging.Outputs = splitList(value)
+	}
+	for _, pair := range os.Environ() {
+		name, value, _ := strings.Cut(pair, "=")
+		if subsystem, ok := strings.CutPrefix(name, "LOG_LEVEL_"); ok && subsystem != "" && value != "" {
+			if c.Logging.Levels == nil {
+				c.Logging.Levels = map[string]string{}
+			}
+			c.Logging.Levels[strings.ToLower(subsystem)] = value
+		}
+	}
+
+	// OIDC_PROVIDERS names the providers, each configured by
+	// OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and _REDIRECT_URL. It
+	// replaces any providers from the file.
+	if value := os.Getenv("OIDC_PROVIDERS"); value != "" {
+		c.OIDC.Providers = nil
+		for _, name := range splitList(value) {
+			prefix := "OIDC_" + strings.ToUpper(name) + "_"
+			c.OIDC.Providers = append(c.OIDC.Providers, OIDCProvider{
+				Name:         name,
+				Issuer:       os.Getenv(prefix + "ISSUER"),
+				ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+				ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+				RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			})
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma-separated value, dropping blank items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ValidateMongo reports invalid database settings, which are all the
+// migrate command needs.
+func (c Config) ValidateMongo() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(strings.HasPrefix(c.Mongo.URI, "mongodb://") || strings.HasPrefix(c.Mongo.URI, "mongodb+srv://"),
+		"mongo.uri must start with mongodb:// or mongodb+srv://")
+	if u, err := url.Parse(c.Mongo.URI); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		check(password != redacted, "mongo.uri password is %s; fill in the real value", redacted)
+	}
+	check(c.Mongo.Database != "" && !strings.ContainsAny(c.Mongo.Database, `/\. "$`),
+		"mongo.database %q is not a valid database name", c.Mongo.Database)
+	check(c.Mongo.MaxPoolSize > 0, "mongo.max_pool_size must be positive")
+	check(c.Mongo.MinPoolSize <= c.Mongo.MaxPoolSize, "mongo.min_pool_size %d exceeds mongo.max_pool_size %d", c.Mongo.MinPoolSize, c.Mongo.MaxPoolSize)
+	check(c.Mongo.StartupTimeout > 0, "mongo.startup_timeout must be positive")
+	check(c.Mongo.MigrationWait > 0, "mongo.migration_wait must be positive")
+	return errors.Join(errs...)
+}
+
+// ValidateAuditKey reports a missing audit key, which verify-audit needs on
+// top of the database settings.
+func (c Config) ValidateAuditKey() error {
+	switch c.Auth.AuditKey {
+	case "":
+		return errors.New("auth.audit_key must be set")
+	case redacted:
+		return fmt.Errorf("auth.audit_key is %s; fill in the real value", redacted)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	errs := []error{c.ValidateMongo(), c.ValidateAuditKey()}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr must be set")
+	if u, err := url.Parse(c.Server.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("server.public_url %q must be an absolute http or https URL", c.Server.PublicURL))
+	}
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.SMTP.Host != "", "smtp.host must be set")
+	check(c.SMTP.Port > 0 && c.SMTP.Port <= 65535, "smtp.port %d is out of range", c.SMTP.Port)
+	check(c.SMTP.Username != "", "smtp.username must be set")
+	check(c.SMTP.Password != "", "smtp.password must be set")
+	check(c.SMTP.From != "", "smtp.from must be set")
+	check(c.Auth.JWTSecret != "", "auth.jwt_secret must be set")
+	// A printed configuration loaded as is, or the placeholder key the
+	// code used to ship with, would sign tokens anyone can forge.
+	check(c.Auth.JWTSecret != "your_secret_key", "auth.jwt_secret must not be the placeholder your_secret_key")
+	check(c.Auth.AuditKey == "" || c.Auth.AuditKey != c.Auth.JWTSecret, "auth.audit_key must differ from auth.jwt_secret")
+	for _, secret := range []struct {
+		name, value string
+	}{
+		{"smtp.password", c.SMTP.Password},
+		{"auth.jwt_secret", c.Auth.JWTSecret},
+		{"metrics.token", c.Metrics.Token},
+	} {
+		check(secret.value != redacted, "%s is %s; fill in the real value", secret.name, redacted)
+	}
+	check(c.Retention.AccountDeletionGrace > 0, "retention.account_deletion_grace must be positive")
+	check(c.Retention.Activity > 0, "retention.activity must be positive")
+	check(c.RateLimit.Store == "memory" || c.RateLimit.Store == "mongo",
+		"rate_limit.store %q must be memory or mongo", c.RateLimit.Store)
+	check(c.Support.Assignment == "manual" || c.Support.Assignment == "round_robin" || c.Support.Assignment == "least_busy",
+		"support.assignment %q must be manual, round_robin or least_busy", c.Support.Assignment)
+	check(c.Support.MaxChatsPerAgent >= 0, "support.max_chats_per_agent must not be negative")
+	check(c.Chat.Bus == "memory" || c.Chat.Bus == "mongo", "chat.bus %q must be memory or mongo", c.Chat.Bus)
+	for _, budget := range []struct {
+		name string
+		Budget
+	}{
+		{"login", c.RateLimit.Login},
+		{"signup", c.RateLimit.Signup},
+		{"password", c.RateLimit.Password},
+		{"checkout", c.RateLimit.Checkout},
+		{"api", c.RateLimit.API},
+	} {
+		check(budget.Limit > 0 && budget.Window > 0, "rate_limit.%s needs a positive limit and window", budget.name)
+	}
+
+	check(c.Password.MinLength >= 1, "password.min_length must be at least 1")
+	check(c.Password.MaxLength >= c.Password.MinLength && c.Password.MaxLength <= 72,
+		"password.max_length %d must be between password.min_length and 72", c.Password.MaxLength)
+	check(c.Password.BcryptCost >= bcrypt.MinCost && c.Password.BcryptCost <= bcrypt.MaxCost,
+		"password.bcrypt_cost %d must be between %d and %d", c.Password.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+
+	check(c.Lockout.FreeAttempts >= 0, "lockout.free_attempts must not be negative")
+	check(c.Lockout.BaseDelay > 0 && c.Lockout.MaxDelay >= c.Lockout.BaseDelay,
+		"lockout.backoff_base must be positive and at most lockout.backoff_max")
+	check(c.Lockout.MaxFailures >= 1 && c.Lockout.IPMaxFailures >= 1,
+		"lockout.max_failures and lockout.ip_max_failures must be at least 1")
+	check(c.Lockout.LockDuration > 0 && c.Lockout.IPBlockDuration > 0,
+		"lockout.lock_duration and lockout.ip_block_duration must be positive")
+	check(c.Lockout.ResetAfter > 0, "lockout.reset_after must be positive")
+
+	names := map[string]bool{}
+	for i, p := range c.OIDC.Providers {
+		check(p.Name != "" && !names[p.Name], "oidc.providers[%d] needs a unique name", i)
+		names[p.Name] = true
+		check(p.Issuer != "" && p.ClientID != "" && p.RedirectURL != "",
+			"oidc.providers %q needs an issuer, client_id and redirect_url", p.Name)
+		check(p.ClientSecret != redacted, "oidc.providers %q client_secret is %s; fill in the real value", p.Name, redacted)
+	}
+
+	check(len(c.Logging.Outputs) > 0, "logging.outputs must list at least one output")
+	for _, output := range c.Logging.Outputs {
+		check(output == "stdout" || output == "stderr" || output == "file" || output == "syslog",
+			"logging.outputs: unknown output %q, expected stdout, stderr, file or syslog", output)
+	}
+	_, err := logrus.ParseLevel(c.Logging.Level)
+	check(err == nil, "logging.level %q is not a log level", c.Logging.Level)
+	for subsystem, level := range c.Logging.Levels {
+		_, err := logrus.ParseLevel(level)
+		check(err == nil, "logging.levels.%s %q is not a log level", subsystem, level)
+	}
+	check(c.Logging.File.MaxSizeMB >= 0 && c.Logging.File.MaxBackups >= 0,
+		"logging.file.max_size_mb and logging.file.max_backups must not be negative")
+
+	check(c.Tracing.Exporter == "none" || c.Tracing.Exporter == "stdout" || c.Tracing.Exporter == "otlp",
+		"tracing.exporter %q must be none, stdout or otlp", c.Tracing.Exporter)
+	return errors.Join(errs...)
+}
+
+const redacted = "REDACTED"
+
+// Redacted returns a copy with secrets masked, safe to print or log.
+func (c Config) Redacted() Config {
+	mask := func(s *string) {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	mask(&c.SMTP.Password)
+	mask(&c.Auth.JWTSecret)
+	mask(&c.Auth.AuditKey)
+	mask(&c.Metrics.Token)
+	// The slice is shared with the original, so mask a copy.
+	c.OIDC.Providers = append([]OIDCProvider(nil), c.OIDC.Providers...)
+	for i := range c.OIDC.Providers {
+		mask(&c.OIDC.Providers[i].ClientSecret)
+	}
+	if u, err := url.Parse(c.Mongo.URI); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			c.Mongo.URI = u.String()
+		}
+	}
+	return c
+}
+
+// Write prints the configuration as YAML with secrets redacted, in a form
+// that can be loaded again with -config.
+func (c Config) Write(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "movieverse.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setSecrets supplies the settings that have no defaults.
+func setSecrets(t *testing.T) {
+	t.Helper()
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_USERNAME", "mailer@example.com")
+	t.Setenv("SMTP_PASSWORD", "smtp-password")
+	t.Setenv("SMTP_FROM", "mailer@example.com")
+	t.Setenv("JWT_SECRET", "jwt-secret")
+	t.Setenv("AUDIT_KEY", "audit-key")
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeFile(t, `
+server:
+  addr: ":9000"
+  public_url: https://movies.example.com/
+mongo:
+  uri: mongodb://file:27017
+  database: from_file
+retention:
+  activity: 48h
+`)
+	setSecrets(t)
+	t.Setenv("MONGODB_URI", "mongodb://env:27017")
+	t.Setenv("SMTP_PORT", "2525")
+	t.Setenv("MONGODB_AUTO_MIGRATE", "false")
+
+	cfg, inv, err := Load([]string{"-config", path, "-mongo-database", "from_flag", "verify-audit"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Server.Addr != ":9000" || cfg.Server.PublicURL != "https://movies.example.com" {
+		t.Errorf("Expected server settings from the file, got %+v", cfg.Server)
+	}
+	if cfg.Mongo.URI != "mongodb://env:27017" || cfg.Mongo.Database != "from_flag" {
+		t.Errorf("Expected env to override the file and flags to override env, got %+v", cfg.Mongo)
+	}
+	if cfg.SMTP.Port != 2525 || cfg.Retention.Activity != 48*time.Hour {
+		t.Errorf("Unexpected SMTP port %d or activity retention %v", cfg.SMTP.Port, cfg.Retention.Activity)
+	}
+	if cfg.Mongo.AutoMigrate {
+		t.Error("Expected MONGODB_AUTO_MIGRATE to turn off auto-migration")
+	}
+	if cfg.Server.ShutdownTimeout != Default().Server.ShutdownTimeout {
+		t.Errorf("Expected unset values to keep their defaults, got shutdown timeout %v", cfg.Server.ShutdownTimeout)
+	}
+	if len(inv.Args) != 1 || inv.Args[0] != "verify-audit" {
+		t.Errorf("Expected the subcommand to be left over, got %v", inv.Args)
+	}
+}
+
+func TestLoad_RejectsUnknownFileKeys(t *testing.T) {
+	setSecrets(t)
+	path := writeFile(t, "mongo:\n  url: mongodb://typo:27017\n")
+	if _, _, err := Load([]string{"-config", path}); err == nil {
+		t.Error("Expected a misspelled key to be rejected")
+	}
+}
+
+func TestValidate_ReportsEveryProblem(t *testing.T) {
+	cfg := Default()
+	cfg.Mongo.URI = "127.0.0.1:27017"
+	cfg.Server.PublicURL = "localhost"
+	cfg.RateLimit.Store = "redis"
+	cfg.Support.Assignment = "random"
+	cfg.Chat.Bus = "redis"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected validation to fail")
+	}
+	for _, field := range []string{"mongo.uri", "server.public_url", "rate_limit.store", "support.assignment", "chat.bus"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected the error to mention %s, got: %v", field, err)
+		}
+	}
+}
+
+func TestValidate_RequiresSecrets(t *testing.T) {
+	err := Default().Validate()
+	if err == nil {
+		t.Fatal("Expected the defaults alone to be rejected")
+	}
+	for _, field := range []string{"smtp.username", "smtp.password", "auth.jwt_secret", "auth.audit_key"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected the error to mention %s, got: %v", field, err)
+		}
+	}
+
+	cfg := Default()
+	cfg.SMTP = SMTP{Host: "smtp.example.com", Port: 587, Username: "mailer", Password: "secret", From: "mailer@example.com"}
+	cfg.Auth.JWTSecret = "your_secret_key"
+	cfg.Auth.AuditKey = "audit-key"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "placeholder") {
+		t.Errorf("Expected the old placeholder secret to be rejected, got %v", err)
+	}
+}
+
+func TestValidateMongo_IgnoresServerSettings(t *testing.T) {
+	cfg := Default()
+	if err := cfg.ValidateMongo(); err != nil {
+		t.Errorf("Expected the migrate command to run without SMTP or auth settings, got %v", err)
+	}
+	if err := cfg.ValidateAuditKey(); err == nil || !strings.Contains(err.Error(), "auth.audit_key") {
+		t.Errorf("Expected verify-audit to require the audit key, got %v", err)
+	}
+
+	cfg.Mongo.URI = "mongodb://app:" + redacted + "@db:27017"
+	cfg.Mongo.MigrationWait = 0
+	err := cfg.ValidateMongo()
+	for _, field := range []string{"mongo.uri", "mongo.migration_wait"} {
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected the error to mention %s, got: %v", field, err)
+		}
+	}
+}
+
+func TestWrite_RedactsSecretsAndRoundTrips(t *testing.T) {
+	cfg := Default()
+	cfg.Mongo.URI = "mongodb://app:hunter2@db:27017/?authSource=admin"
+	cfg.SMTP = SMTP{Host: "smtp.example.com", Port: 587, Username: "mailer", Password: "smtp-password", From: "mailer@example.com"}
+	cfg.Auth.JWTSecret = "jwt-secret"
+	cfg.Auth.AuditKey = "audit-key"
+	cfg.Metrics.Token = "scrape-token"
+
+	var buf bytes.Buffer
+	if err := cfg.Write(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := buf.String()
+	for _, secret := range []string{"hunter2", "scrape-token", "smtp-password", "jwt-secret", "audit-key"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Printed config leaks %q", secret)
+		}
+	}
+
+	// Loaded as is, the redacted secrets must not be mistaken for real ones.
+	path := writeFile(t, out)
+	printed, _, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = printed.Validate()
+	if err == nil {
+		t.Fatal("Expected the redacted config to be rejected until its secrets are filled in")
+	}
+	for _, field := range []string{"smtp.password", "auth.jwt_secret", "auth.audit_key", "metrics.token", "mongo.uri"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected the error to mention %s, got: %v", field, err)
+		}
+	}
+
+	t.Setenv("SMTP_PASSWORD", "smtp-password")
+	t.Setenv("JWT_SECRET", "jwt-secret")
+	t.Setenv("AUDIT_KEY", "audit-key")
+	t.Setenv("METRICS_TOKEN", "scrape-token")
+	t.Setenv("MONGODB_URI", cfg.Mongo.URI)
+	loaded, _, err := Load([]string{"-config", path})
+	if err == nil {
+		err = loaded.Validate()
+	}
+	if err != nil {
+		t.Fatalf("Printed config does not load with the secrets from the environment: %v", err)
+	}
+	if loaded.Retention != cfg.Retention || loaded.Server != cfg.Server || loaded.SMTP != cfg.SMTP {
+		t.Errorf("Round trip changed settings: %+v", loaded)
+	}
+}
+
+func TestLoad_ReadsSubsystemSettingsFromEnv(t *testing.T) {
+	setSecrets(t)
+	t.Setenv("PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("LOGIN_RESET_AFTER", "30m")
+	t.Setenv("RATE_LIMIT_LOGIN_LIMIT", "3")
+	t.Setenv("RATE_LIMIT_LOGIN_WINDOW", "5m")
+	t.Setenv("LOG_OUTPUTS", "stdout, syslog")
+	t.Setenv("LOG_FILE_ROTATE_EVERY", "1h")
+	t.Setenv("LOG_LEVEL_CHAT", "debug")
+	t.Setenv("OTEL_TRACES_EXPORTER", "console")
+	t.Setenv("OIDC_PROVIDERS", "google")
+	t.Setenv("OIDC_GOOGLE_ISSUER", "https://accounts.google.com")
+	t.Setenv("OIDC_GOOGLE_CLIENT_ID", "client-id")
+	t.Setenv("OIDC_GOOGLE_CLIENT_SECRET", "client-secret")
+	t.Setenv("OIDC_GOOGLE_REDIRECT_URL", "https://movies.example.com/auth/oidc/google/callback")
+
+	cfg, _, err := Load(nil)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Password.MinLength != 12 || cfg.Lockout.ResetAfter != 30*time.Minute {
+		t.Errorf("Expected password and lockout settings from env, got %+v and %+v", cfg.Password, cfg.Lockout)
+	}
+	if cfg.RateLimit.Login != (Budget{Limit: 3, Window: 5 * time.Minute}) || cfg.RateLimit.API != Default().RateLimit.API {
+		t.Errorf("Expected only the login budget to change, got %+v", cfg.RateLimit)
+	}
+	if strings.Join(cfg.Logging.Outputs, ",") != "stdout,syslog" || cfg.Logging.File.RotateEvery != time.Hour {
+		t.Errorf("Expected logging outputs and rotation from env, got %+v", cfg.Logging)
+	}
+	if cfg.Logging.Levels["chat"] != "debug" {
+		t.Errorf("Expected a per-subsystem level for chat, got %v", cfg.Logging.Levels)
+	}
+	if cfg.Tracing.Exporter != "stdout" {
+		t.Errorf("Expected the console exporter to mean stdout, got %q", cfg.Tracing.Exporter)
+	}
+	if len(cfg.OIDC.Providers) != 1 || cfg.OIDC.Providers[0].Name != "google" || cfg.OIDC.Providers[0].ClientSecret != "client-secret" {
+		t.Errorf("Expected the google provider from env, got %+v", cfg.OIDC.Providers)
+	}
+}
+
+func TestValidate_RejectsBadSubsystemSettings(t *testing.T) {
+	cfg := Default()
+	cfg.RateLimit.Signup.Limit = 0
+	cfg.Password.BcryptCost = 2
+	cfg.Lockout.MaxFailures = 0
+	cfg.Logging.Outputs = []string{"stdout", "kafka"}
+	cfg.Logging.Levels = map[string]string{"chat": "loud"}
+	cfg.Tracing.Exporter = "jaeger"
+	cfg.OIDC.Providers = []OIDCProvider{{Name: "google"}}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected validation to fail")
+	}
+	for _, field := range []string{"rate_limit.signup", "password.bcrypt_cost", "lockout.max_failures", "logging.outputs", "logging.levels", "tracing.exporter", "oidc.providers"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected the error to mention %s, got: %v", field, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	ActivityLogin     = "login"
+	ActivityLogout    = "logout"
+	ActivitySearch    = "search"
+	ActivityViewMovie = "view_movie"
+	ActivityCheckout  = "checkout"
+)
+
+var activityRetention = 90 * 24 * time.Hour
+
+// SetActivityRetention sets how long new activity entries are kept before
+// MongoDB's TTL monitor removes them.
+func SetActivityRetention(retention time.Duration) {
+	activityRetention = retention
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// TrackActivity records action for the authenticated user once the wrapped
+// handler has succeeded. It works both behind ValidateJWT and on public
+// routes, where a valid bearer token is optional and anonymous requests are
+// not recorded.
+func TrackActivity(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			if recorder.status >= http.StatusBadRequest {
+				return
+			}
+			claims, ok := r.Context().Value("user").(*Claims)
+			if !ok {
+				// A token that was revoked since it was signed must not be
+				// attributed any more than one behind ValidateJWT would be.
+				if claims, ok = parseSessionToken(bearerToken(r)); !ok || !sessionStillValid(r.Context(), claims) {
+					return
+				}
+			}
+			LogUserActivity(r.Context(), claims.UserID, action, activityDetail(r))
+		})
+	}
+}
+
+// activityDetail keeps the query string of the request, minus credentials,
+// so searches and viewed ids end up in the log.
+func activityDetail(r *http.Request) string {
+	query := r.URL.Query()
+	query.Del("token")
+	return query.Encode()
+}
+
+// activityFilter builds the activity_logs query from the user_id, action,
+// from and to parameters. Times are RFC 3339.
+func activityFilter(query url.Values) (bson.M, error) {
+	filter := bson.M{}
+	if id := query.Get("user_id"); id != "" {
+		userID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, errors.New("invalid user_id")
+		}
+		filter["user_id"] = userID
+	}
+	if action := query.Get("action"); action != "" {
+		filter["action"] = action
+	}
+	timeRange := bson.M{}
+	for param, operator := range map[string]string{"from": "$gte", "to": "$lt"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New("invalid " + param + ", expected RFC 3339")
+		}
+		timeRange[operator] = t
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+	return filter, nil
+}
+
+func GetActivityLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := activityFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, limit := pagination(query)
+
+	collection := database().Collection("activity_logs")
+	total, err := collection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Failed to count activity", http.StatusInternalServerError)
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetSkip(int64((page - 1) * limit)).SetLimit(int64(limit))
+	cursor, err := collection.Find(r.Context(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch activity", http.StatusInternalServerError)
+		return
+	}
+	entries := []ActivityLog{}
+	if err = cursor.All(r.Context(), &entries); err != nil {
+		http.Error(w, "Failed to decode activity", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"activity":    entries,
+		"page":        page,
+		"limit":       limit,
+		"total":       total,
+		"total_pages": int(math.Ceil(float64(total) / float64(limit))),
+	})
+}
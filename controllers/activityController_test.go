@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestActivityFilter(t *testing.T) {
+	userID := primitive.NewObjectID()
+	query := url.Values{
+		"user_id": {userID.Hex()},
+		"action":  {ActivitySearch},
+		"from":    {"2024-01-01T00:00:00Z"},
+		"to":      {"2024-02-01T00:00:00Z"},
+	}
+	filter, err := activityFilter(query)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if filter["user_id"] != userID || filter["action"] != ActivitySearch {
+		t.Errorf("Unexpected filter: %v", filter)
+	}
+	timeRange, ok := filter["timestamp"].(bson.M)
+	if !ok {
+		t.Fatalf("Expected a timestamp range, got %v", filter["timestamp"])
+	}
+	if from := timeRange["$gte"].(time.Time); !from.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected lower bound %v", from)
+	}
+	if _, ok := timeRange["$lt"]; !ok {
+		t.Error("Expected an upper bound")
+	}
+
+	for _, bad := range []url.Values{{"user_id": {"nope"}}, {"from": {"yesterday"}}} {
+		if _, err := activityFilter(bad); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+	if filter, _ := activityFilter(url.Values{}); len(filter) != 0 {
+		t.Errorf("Empty query should match everything, got %v", filter)
+	}
+}
+
+func TestActivityDetail_DropsToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/search?title=alien&token=secret", nil)
+	if got := activityDetail(r); got != "title=alien" {
+		t.Errorf("Expected the token to be stripped, got %q", got)
+	}
+}
+
+func TestTrackActivity_SkipsFailedAndAnonymousRequests(t *testing.T) {
+	// Neither request may reach LogUserActivity; the nil client would panic.
+	failing := TrackActivity(ActivityCheckout)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/checkout", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "user", &Claims{UserID: primitive.NewObjectID()}))
+	rec := httptest.NewRecorder()
+	failing.ServeHTTP(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the handler status to pass through, got %d", rec.Code)
+	}
+
+	anonymous := TrackActivity(ActivitySearch)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec = httptest.NewRecorder()
+	anonymous.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/search?title=alien", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"MovieVerse/logging"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	AuditMovieUpdate  = "movie.update"
+	AuditMovieDelete  = "movie.delete"
+	AuditChatClose    = "chat.close"
+	AuditChatTransfer = "chat.transfer"
+)
+
+const auditAppendAttempts = 5
+
+// auditKey keys the chain's hashes. It is kept out of the database, so
+// someone who can rewrite the audit_log collection still cannot produce
+// hashes that verify.
+var auditKey []byte
+
+// SetAuditKey sets the key audit entries are hashed with. Entries written
+// under a different key no longer verify.
+func SetAuditKey(key string) {
+	auditKey = []byte(key)
+}
+
+// AuditEntry is one link of the audit chain. Hash is an HMAC over every
+// other field plus the previous entry's hash, so editing or removing an
+// entry breaks verification of everything after it. Entries are only ever
+// inserted.
+type AuditEntry struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Seq        int64              `bson:"seq" json:"seq"`
+	Actor      primitive.ObjectID `bson:"actor" json:"actor"`
+	Action     string             `bson:"action" json:"action"`
+	TargetType string             `bson:"target_type" json:"target_type"`
+	TargetID   string             `bson:"target_id" json:"target_id"`
+	Changes    []AuditChange      `bson:"changes" json:"changes"`
+	RequestID  string             `bson:"request_id" json:"request_id"`
+	Timestamp  time.Time          `bson:"timestamp" json:"timestamp"`
+	PrevHash   string             `bson:"prev_hash" json:"prev_hash"`
+	Hash       string             `bson:"hash" json:"hash"`
+}
+
+// AuditChange holds the JSON encoding of a field before and after the
+// action; "null" means the field did not exist.
+type AuditChange struct {
+	Field  string `bson:"field" json:"field"`
+	Before string `bson:"before" json:"before"`
+	After  string `bson:"after" json:"after"`
+}
+
+func (e AuditEntry) computeHash() string {
+	changes := e.Changes
+	if len(changes) == 0 {
+		// An empty array and a missing one must hash the same after a
+		// round trip through the database.
+		changes = nil
+	}
+	payload, _ := json.Marshal(struct {
+		Seq        int64
+		PrevHash   string
+		Actor      string
+		Action     string
+		TargetType string
+		TargetID   string
+		RequestID  string
+		Timestamp  int64
+		Changes    []AuditChange
+	}{e.Seq, e.PrevHash, e.Actor.Hex(), e.Action, e.TargetType, e.TargetID, e.RequestID, e.Timestamp.UnixMilli(), changes})
+	mac := hmac.New(sha256.New, auditKey)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// diffDocuments lists the top-level fields whose JSON encoding differs
+// between before and after, sorted by field name.
+func diffDocuments(before, after bson.M) []AuditChange {
+	fields := map[string]bool{}
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	changes := []AuditChange{}
+	for _, field := range names {
+		b, _ := json.Marshal(before[field])
+		a, _ := json.Marshal(after[field])
+		if string(b) != string(a) {
+			changes = append(changes, AuditChange{Field: field, Before: string(b), After: string(a)})
+		}
+	}
+	return changes
+}
+
+// requestID returns the ID assigned by the logging middleware. Outside of
+// it, the caller-supplied X-Request-ID is used, or one is generated and
+// echoed back so the entry can be matched to the response.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	if id := logging.RequestID(r.Context()); id != "" {
+		return id
+	}
+	if id := r.Header.Get(logging.RequestIDHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	w.Header().Set(logging.RequestIDHeader, id)
+	return id
+}
+
+// RecordAudit appends an entry for an admin action performed by the
+// authenticated user. Failures are logged rather than returned because the
+// action itself has already been applied.
+func RecordAudit(w http.ResponseWriter, r *http.Request, action, targetType, targetID string, before, after bson.M) {
+	entry := AuditEntry{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Changes:    diffDocuments(before, after),
+		RequestID:  requestID(w, r),
+	}
+	if claims, ok := r.Context().Value("user").(*Claims); ok {
+		entry.Actor = claims.UserID
+	}
+	if err := appendAudit(context.WithoutCancel(r.Context()), &entry); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to write audit entry for %s %s: %v", action, targetID, err)
+	}
+}
+
+var auditMu sync.Mutex
+
+// appendAudit links entry to the current head of the chain. The unique
+// index on seq makes concurrent writers from other instances collide
+// instead of forking the chain; the loser re-reads the head and retries.
+func appendAudit(ctx context.Context, entry *AuditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	collection := database().Collection("audit_log")
+	entry.Timestamp = time.Now().UTC().Truncate(time.Millisecond)
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		var head AuditEntry
+		err := collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}})).Decode(&head)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+		entry.Seq = head.Seq + 1
+		entry.PrevHash = head.Hash
+		entry.Hash = entry.computeHash()
+		_, err = collection.InsertOne(ctx, entry)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		return err
+	}
+	return errors.New("audit chain is under contention")
+}
+
+// AuditChainError points at the first entry that fails verification.
+type AuditChainError struct {
+	Seq    int64
+	Reason string
+}
+
+func (e *AuditChainError) Error() string {
+	return fmt.Sprintf("audit chain broken at seq %d: %s", e.Seq, e.Reason)
+}
+
+type auditVerifier struct {
+	checked  int
+	nextSeq  int64
+	prevHash string
+}
+
+func (v *auditVerifier) check(entry AuditEntry) error {
+	if v.nextSeq == 0 {
+		v.nextSeq = 1
+	}
+	switch {
+	case entry.Seq != v.nextSeq:
+		return &AuditChainError{Seq: v.nextSeq, Reason: fmt.Sprintf("entry missing, found seq %d instead", entry.Seq)}
+	case entry.PrevHash != v.prevHash:
+		return &AuditChainError{Seq: entry.Seq, Reason: "previous hash does not match"}
+	case !hmac.Equal([]byte(entry.computeHash()), []byte(entry.Hash)):
+		return &AuditChainError{Seq: entry.Seq, Reason: "entry contents were modified"}
+	}
+	v.checked++
+	v.nextSeq++
+	v.prevHash = entry.Hash
+	return nil
+}
+
+// VerifyAuditChain walks the whole chain and returns the number of entries
+// and the head hash. The chain cannot show that entries were cut off its
+// end, so keep a copy of the head hash somewhere else to compare against.
+func VerifyAuditChain(ctx context.Context) (int, string, error) {
+	collection := database().Collection("audit_log")
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return 0, "", err
+	}
+	defer cursor.Close(ctx)
+	var verifier auditVerifier
+	for cursor.Next(ctx) {
+		var entry AuditEntry
+		if err := cursor.Decode(&entry); err != nil {
+			return verifier.checked, verifier.prevHash, err
+		}
+		if err := verifier.check(entry); err != nil {
+			return verifier.checked, verifier.prevHash, err
+		}
+	}
+	return verifier.checked, verifier.prevHash, cursor.Err()
+}
+
+func GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := bson.M{}
+	if id := query.Get("actor"); id != "" {
+		actor, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			http.Error(w, "Invalid actor", http.StatusBadRequest)
+			return
+		}
+		filter["actor"] = actor
+	}
+	for _, param := range []string{"action", "target_type", "target_id", "request_id"} {
+		if value := query.Get(param); value != "" {
+			filter[param] = value
+		}
+	}
+	page, limit := pagination(query)
+
+	collection := database().Collection("audit_log")
+	total, err := collection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Failed to count audit entries", http.StatusInternalServerError)
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "seq", Value: -1}}).SetSkip(int64((page - 1) * limit)).SetLimit(int64(limit))
+	cursor, err := collection.Find(r.Context(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch audit entries", http.StatusInternalServerError)
+		return
+	}
+	entries := []AuditEntry{}
+	if err = cursor.All(r.Context(), &entries); err != nil {
+		http.Error(w, "Failed to decode audit entries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries":     entries,
+		"page":        page,
+		"limit":       limit,
+		"total":       total,
+		"total_pages": int(math.Ceil(float64(total) / float64(limit))),
+	})
+}
+
+func VerifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	entries, head, err := VerifyAuditChain(r.Context())
+	var chainErr *AuditChainError
+	if err != nil && !errors.As(err, &chainErr) {
+		logging.FromContext(r.Context()).Errorf("Failed to verify audit chain: %v", err)
+		http.Error(w, "Failed to verify audit chain", http.StatusInternalServerError)
+		return
+	}
+	response := map[string]interface{}{"valid": err == nil, "entries": entries, "head": head}
+	if chainErr != nil {
+		response["broken_at"] = chainErr.Seq
+		response["reason"] = chainErr.Reason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
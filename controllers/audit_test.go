@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func buildAuditChain(n int) []AuditEntry {
+	entries := make([]AuditEntry, n)
+	prev := ""
+	for i := range entries {
+		entries[i] = AuditEntry{
+			Seq:        int64(i + 1),
+			Actor:      primitive.NewObjectID(),
+			Action:     AuditMovieUpdate,
+			TargetType: "movie",
+			TargetID:   primitive.NewObjectID().Hex(),
+			Changes:    []AuditChange{{Field: "price", Before: "9.99", After: "12.99"}},
+			RequestID:  "req",
+			Timestamp:  time.Now().UTC().Truncate(time.Millisecond),
+			PrevHash:   prev,
+		}
+		entries[i].Hash = entries[i].computeHash()
+		prev = entries[i].Hash
+	}
+	return entries
+}
+
+func verifyEntries(entries []AuditEntry) error {
+	var verifier auditVerifier
+	for _, entry := range entries {
+		if err := verifier.check(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAuditChain_DetectsTampering(t *testing.T) {
+	if err := verifyEntries(buildAuditChain(5)); err != nil {
+		t.Fatalf("Intact chain failed verification: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func([]AuditEntry) []AuditEntry
+		seq    int64
+	}{
+		{"edited change", func(e []AuditEntry) []AuditEntry { e[2].Changes[0].After = "0.01"; return e }, 3},
+		{"edited actor", func(e []AuditEntry) []AuditEntry { e[1].Actor = primitive.NewObjectID(); return e }, 2},
+		{"rehashed entry", func(e []AuditEntry) []AuditEntry {
+			e[2].Action = AuditMovieDelete
+			e[2].Hash = e[2].computeHash()
+			return e
+		}, 4},
+		{"removed entry", func(e []AuditEntry) []AuditEntry { return append(e[:1], e[2:]...) }, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyEntries(tt.tamper(buildAuditChain(5)))
+			var chainErr *AuditChainError
+			if !errors.As(err, &chainErr) {
+				t.Fatalf("Expected a chain error, got %v", err)
+			}
+			if chainErr.Seq != tt.seq {
+				t.Errorf("Expected break at seq %d, got %d (%s)", tt.seq, chainErr.Seq, chainErr.Reason)
+			}
+		})
+	}
+}
+
+func TestAuditChain_RewriteWithoutKeyFailsVerification(t *testing.T) {
+	previous := auditKey
+	t.Cleanup(func() { auditKey = previous })
+
+	// Someone with write access to the collection but not the key rebuilds
+	// a consistent-looking chain.
+	SetAuditKey("guessed-key")
+	forged := buildAuditChain(3)
+	SetAuditKey("audit-key")
+
+	var chainErr *AuditChainError
+	if err := verifyEntries(forged); !errors.As(err, &chainErr) || chainErr.Seq != 1 {
+		t.Errorf("Expected the forged chain to break at seq 1, got %v", err)
+	}
+	if err := verifyEntries(buildAuditChain(3)); err != nil {
+		t.Errorf("Expected a chain written with the key to verify, got %v", err)
+	}
+}
+
+func TestAuditEntry_HashSurvivesEmptyChanges(t *testing.T) {
+	entry := AuditEntry{Seq: 1, Action: AuditChatClose, Changes: []AuditChange{}}
+	stored := entry
+	stored.Changes = nil
+	if entry.computeHash() != stored.computeHash() {
+		t.Error("Empty and missing changes should hash the same")
+	}
+}
+
+func TestDiffDocuments(t *testing.T) {
+	before := bson.M{"title": "Alien", "price": 9.99, "release_year": int32(1979)}
+	after := bson.M{"title": "Alien", "price": 12.99, "release_year": float64(1979), "image_link": "alien.jpg"}
+	changes := diffDocuments(before, after)
+	want := []AuditChange{
+		{Field: "image_link", Before: "null", After: `"alien.jpg"`},
+		{Field: "price", Before: "9.99", After: "12.99"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("Change %d: expected %v, got %v", i, want[i], changes[i])
+		}
+	}
+}
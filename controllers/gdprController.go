@@ -0,0 +1,342 @@
+package controllers
+
+import (
+	"MovieVerse/logging"
+	"MovieVerse/models"
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var accountDeletionGrace = 30 * 24 * time.Hour
+
+// SetAccountDeletionGrace sets how long a deletion request can be cancelled
+// before the account is purged.
+func SetAccountDeletionGrace(grace time.Duration) {
+	accountDeletionGrace = grace
+}
+
+// ExportMyData streams a ZIP with every piece of personal data stored for
+// the authenticated user, one JSON file per collection. Reviews are not
+// among them: models.Review belongs to the unrouted SQL review handlers and
+// nothing in this application stores reviews in MongoDB.
+func ExportMyData(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	ctx := r.Context()
+	sessionIDs, err := chatSessionIDs(ctx, user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to load chat sessions for export: %v", err)
+		http.Error(w, "Failed to export data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="movieverse-export-%s.zip"`, time.Now().Format("20060102")))
+	zw := zip.NewWriter(w)
+
+	profile := struct {
+		models.UserProfile
+		LinkedProviders []string `json:"linked_providers,omitempty"`
+	}{UserProfile: toProfile(user)}
+	for _, identity := range user.Identities {
+		profile.LinkedProviders = append(profile.LinkedProviders, identity.Provider)
+	}
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to export profile: %v", err)
+		return
+	}
+
+	exports := []struct {
+		file       string
+		collection string
+		filter     bson.M
+	}{
+		{"orders.json", "orders", bson.M{"user_id": user.ID}},
+		{"chat_sessions.json", "chat_sessions", bson.M{"client_id": user.ID}},
+		// Their own chats, and what they wrote in other people's chats
+		// as a support agent.
+		{"chat_messages.json", "chat_messages", bson.M{"$or": bson.A{
+			bson.M{"chat_session_id": bson.M{"$in": sessionIDs}},
+			bson.M{"sender_id": user.ID},
+		}}},
+		{"support_agent.json", "support_agents", bson.M{"_id": user.ID}},
+		{"activity.json", "activity_logs", bson.M{"user_id": user.ID}},
+	}
+	for _, export := range exports {
+		if err := exportCollection(ctx, zw, export.file, export.collection, export.filter); err != nil {
+			// Headers are already sent, so the truncated archive is the only
+			// signal the client gets.
+			logging.FromContext(r.Context()).Errorf("Failed to export %s: %v", export.collection, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to finish export: %v", err)
+		return
+	}
+	LogUserActivity(r.Context(), user.ID, "data_exported", "")
+}
+
+func writeZipJSON(zw *zip.Writer, name string, value interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// exportCollection writes the matching documents as a JSON array in relaxed
+// Extended JSON, so every field is kept whatever shape the document has.
+func exportCollection(ctx context.Context, zw *zip.Writer, name, collection string, filter bson.M) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	cursor, err := database().Collection(collection).Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	if _, err := io.WriteString(f, "["); err != nil {
+		return err
+	}
+	first := true
+	for cursor.Next(ctx) {
+		doc, err := bson.MarshalExtJSON(cursor.Current, false, false)
+		if err != nil {
+			return err
+		}
+		separator := ",\n  "
+		if first {
+			separator = "\n  "
+			first = false
+		}
+		if _, err := io.WriteString(f, separator+string(doc)); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, "\n]\n")
+	return err
+}
+
+// chatSessionIDs returns the session ids that chat_messages refer to for the
+// given client.
+func chatSessionIDs(ctx context.Context, userID primitive.ObjectID) (bson.A, error) {
+	cursor, err := database().Collection("chat_sessions").Find(ctx, bson.M{"client_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	ids := bson.A{}
+	for cursor.Next(ctx) {
+		if id, err := cursor.Current.LookupErr("_id"); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, cursor.Err()
+}
+
+func RequestAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+		Confirm  string `json:"confirm"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.Password != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+	} else if req.Confirm != "DELETE" {
+		http.Error(w, `Send "confirm": "DELETE" to delete an account without a password`, http.StatusBadRequest)
+		return
+	}
+
+	scheduledFor := time.Now().Add(accountDeletionGrace)
+	collection := database().Collection("users")
+	update := bson.M{"$set": bson.M{"deletion_requested_at": time.Now(), "deletion_scheduled_for": scheduledFor}}
+	if _, err := collection.UpdateOne(r.Context(), bson.M{"_id": user.ID}, update); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to schedule account deletion: %v", err)
+		http.Error(w, "Failed to schedule account deletion", http.StatusInternalServerError)
+		return
+	}
+	LogUserActivity(r.Context(), user.ID, "account_deletion_requested", scheduledFor.Format(time.RFC3339))
+	// The request context is cancelled once the response is written.
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		body := "Your MovieVerse account and all associated data will be permanently deleted on " +
+			scheduledFor.Format("2 January 2006") + ".\n\n" +
+			"If you change your mind, log in and cancel the deletion before then."
+		if err := sendEmail(ctx, user.Email, "MovieVerse - Account Deletion Scheduled", body); err != nil {
+			logging.FromContext(ctx).Errorf("Failed to send deletion notice: %v", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Account scheduled for deletion",
+		"scheduled_for": scheduledFor,
+	})
+}
+
+func CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	collection := database().Collection("users")
+	result, err := collection.UpdateOne(r.Context(),
+		bson.M{"_id": claims.UserID, "deletion_scheduled_for": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"deletion_requested_at": "", "deletion_scheduled_for": ""}})
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to cancel account deletion: %v", err)
+		http.Error(w, "Failed to cancel account deletion", http.StatusInternalServerError)
+		return
+	}
+	if result.ModifiedCount == 0 {
+		http.Error(w, "No account deletion is scheduled", http.StatusBadRequest)
+		return
+	}
+	LogUserActivity(r.Context(), claims.UserID, "account_deletion_cancelled", "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account deletion cancelled"})
+}
+
+// deletedSender replaces the name on chat messages whose sender has been
+// deleted.
+const deletedSender = "Deleted user"
+
+// deleteUserData removes a user and everything tied to them. Orders are
+// kept for bookkeeping but detached from the account, and chats they took
+// part in as a support agent are kept for the client with the agent's name
+// and ID removed. The audit log is append-only and hash-chained, so its
+// entries keep the bare user ID. Like the export, it has no reviews to
+// remove.
+func deleteUserData(ctx context.Context, userID primitive.ObjectID) error {
+	db := database()
+	sessionIDs, err := chatSessionIDs(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("loading chat sessions: %w", err)
+	}
+	messages := db.Collection("chat_messages")
+	if _, err := messages.DeleteMany(ctx, bson.M{"chat_session_id": bson.M{"$in": sessionIDs}}); err != nil {
+		return fmt.Errorf("deleting chat messages: %w", err)
+	}
+	// client_msg_id goes too: it is only unique per sender, so it could
+	// clash with another deleted sender's in the same session.
+	if _, err := messages.UpdateMany(ctx, bson.M{"sender_id": userID}, bson.M{
+		"$set":   bson.M{"sender": deletedSender},
+		"$unset": bson.M{"sender_id": "", "client_msg_id": ""},
+	}); err != nil {
+		return fmt.Errorf("anonymizing chat messages: %w", err)
+	}
+	sessions := db.Collection("chat_sessions")
+	if _, err := sessions.DeleteMany(ctx, bson.M{"client_id": userID}); err != nil {
+		return fmt.Errorf("deleting chat sessions: %w", err)
+	}
+	// Chats the agent still had open go back to the queue.
+	if _, err := sessions.UpdateMany(ctx,
+		bson.M{"agent_id": userID, "status": models.ChatStatusActive},
+		bson.M{"$set": bson.M{"status": models.ChatStatusWaiting}, "$unset": bson.M{"agent_id": "", "assigned_at": ""}},
+	); err != nil {
+		return fmt.Errorf("requeueing chat sessions: %w", err)
+	}
+	if _, err := sessions.UpdateMany(ctx, bson.M{"agent_id": userID}, bson.M{"$unset": bson.M{"agent_id": ""}}); err != nil {
+		return fmt.Errorf("anonymizing chat sessions: %w", err)
+	}
+	for _, field := range []string{"from", "to"} {
+		_, err := sessions.UpdateMany(ctx,
+			bson.M{"transfers." + field: userID},
+			bson.M{"$set": bson.M{"transfers.$[t]." + field: primitive.NilObjectID}},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"t." + field: userID}}}),
+		)
+		if err != nil {
+			return fmt.Errorf("anonymizing chat transfers: %w", err)
+		}
+	}
+	if _, err := db.Collection("support_agents").DeleteOne(ctx, bson.M{"_id": userID}); err != nil {
+		return fmt.Errorf("deleting support agent: %w", err)
+	}
+	if _, err := db.Collection("activity_logs").DeleteMany(ctx, bson.M{"user_id": userID}); err != nil {
+		return fmt.Errorf("deleting activity logs: %w", err)
+	}
+	if _, err := db.Collection("orders").UpdateMany(ctx, bson.M{"user_id": userID},
+		bson.M{"$set": bson.M{"user_id": primitive.NilObjectID, "anonymized": true}}); err != nil {
+		return fmt.Errorf("anonymizing orders: %w", err)
+	}
+	for _, ext := range avatarExtensions {
+		os.Remove(filepath.Join(avatarDir, userID.Hex()+ext))
+	}
+	if _, err := db.Collection("users").DeleteOne(ctx, bson.M{"_id": userID}); err != nil {
+		return fmt.Errorf("deleting user: %w", err)
+	}
+	return nil
+}
+
+// PurgeDueAccounts deletes every account whose grace period has ended.
+func PurgeDueAccounts(ctx context.Context) (int, error) {
+	collection := database().Collection("users")
+	cursor, err := collection.Find(ctx, bson.M{"deletion_scheduled_for": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, user := range users {
+		if err := deleteUserData(ctx, user.ID); err != nil {
+			return purged, fmt.Errorf("purging %s: %w", user.ID.Hex(), err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func RunAccountPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := PurgeDueAccounts(ctx)
+		if err != nil && ctx.Err() == nil {
+			logging.FromContext(ctx).Errorf("Account purge failed: %v", err)
+		} else if purged > 0 {
+			logging.FromContext(ctx).Infof("Purged %d accounts after their deletion grace period", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"MovieVerse/models"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+	"time"
+)
+
+func TestWriteZipJSON_ProducesReadableArchive(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	user := models.User{ID: primitive.NewObjectID(), Email: "fan@example.com", Password: "$2a$10$secrethash"}
+	if err := writeZipJSON(zw, "profile.json", toProfile(user)); err != nil {
+		t.Fatalf("writeZipJSON failed: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close archive: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Archive is not readable: %v", err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "profile.json" {
+		t.Fatalf("Unexpected archive contents: %+v", zr.File)
+	}
+	f, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatalf("Failed to open profile.json: %v", err)
+	}
+	defer f.Close()
+	var profile map[string]interface{}
+	if err := json.NewDecoder(f).Decode(&profile); err != nil {
+		t.Fatalf("profile.json is not valid JSON: %v", err)
+	}
+	if profile["email"] != "fan@example.com" {
+		t.Errorf("Unexpected profile: %v", profile)
+	}
+	if _, ok := profile["password"]; ok {
+		t.Errorf("Export leaks the password hash: %v", profile)
+	}
+}
+
+func TestToProfile_ShowsScheduledDeletion(t *testing.T) {
+	user := models.User{ID: primitive.NewObjectID()}
+	if toProfile(user).DeletionScheduled != nil {
+		t.Error("Profile without a deletion request should not carry a schedule")
+	}
+	user.DeletionScheduled = time.Now().Add(accountDeletionGrace)
+	if got := toProfile(user).DeletionScheduled; got == nil || !got.Equal(user.DeletionScheduled) {
+		t.Errorf("Expected deletion schedule %v, got %v", user.DeletionScheduled, got)
+	}
+}
+
+func TestDeleteUserData_LiveAnonymizesSupportAgent(t *testing.T) {
+	db := liveDatabase(t)
+	ctx := context.Background()
+	agent := insertUser(t, db, models.User{Email: "agent@example.com"}, "Correct-Horse-42", bcrypt.MinCost)
+	other := primitive.NewObjectID()
+	closedAt := time.Now()
+	closedChat := models.ChatSession{ID: primitive.NewObjectID(), ClientID: primitive.NewObjectID(), AgentID: agent.ID, Status: models.ChatStatusClosed, ClosedAt: &closedAt,
+		Transfers: []models.ChatTransfer{{From: other, To: agent.ID, At: closedAt}}}
+	openChat := models.ChatSession{ID: primitive.NewObjectID(), ClientID: primitive.NewObjectID(), AgentID: agent.ID, Status: models.ChatStatusActive}
+	if _, err := db.Collection("chat_sessions").InsertMany(ctx, []interface{}{closedChat, openChat}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("chat_messages").InsertOne(ctx, models.ChatMessage{ChatSessionID: closedChat.ID, Sender: "Agent Smith", SenderID: agent.ID, SenderRole: "agent", ClientMsgID: "m1", Content: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("support_agents").InsertOne(ctx, bson.M{"_id": agent.ID, "available": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteUserData(ctx, agent.ID); err != nil {
+		t.Fatalf("deleteUserData failed: %v", err)
+	}
+
+	var message models.ChatMessage
+	if err := db.Collection("chat_messages").FindOne(ctx, bson.M{"chat_session_id": closedChat.ID}).Decode(&message); err != nil {
+		t.Fatalf("Expected the client's chat to keep the agent's message: %v", err)
+	}
+	if message.Sender != deletedSender || !message.SenderID.IsZero() || message.ClientMsgID != "" {
+		t.Errorf("Expected the message to lose the agent's name and ID, got %+v", message)
+	}
+	var closed, open models.ChatSession
+	db.Collection("chat_sessions").FindOne(ctx, bson.M{"_id": closedChat.ID}).Decode(&closed)
+	if !closed.AgentID.IsZero() || len(closed.Transfers) != 1 || closed.Transfers[0].To != primitive.NilObjectID || closed.Transfers[0].From != other {
+		t.Errorf("Expected the agent to be removed from the closed chat, got %+v", closed)
+	}
+	db.Collection("chat_sessions").FindOne(ctx, bson.M{"_id": openChat.ID}).Decode(&open)
+	if open.Status != models.ChatStatusWaiting || !open.AgentID.IsZero() {
+		t.Errorf("Expected the open chat to go back to the queue, got %+v", open)
+	}
+	if n, _ := db.Collection("support_agents").CountDocuments(ctx, bson.M{"_id": agent.ID}); n != 0 {
+		t.Error("Expected the support agent record to be deleted")
+	}
+}
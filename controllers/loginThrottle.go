@@ -0,0 +1,309 @@
+package controllers
+
+import (
+	"MovieVerse/logging"
+	"MovieVerse/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LockoutPolicy controls how failed logins are slowed down and when an
+// account is locked until its owner follows the emailed unlock link.
+type LockoutPolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	MaxFailures     int
+	LockDuration    time.Duration
+	IPMaxFailures   int
+	IPBlockDuration time.Duration
+	ResetAfter      time.Duration
+}
+
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		MaxFailures:     10,
+		LockDuration:    time.Hour,
+		IPMaxFailures:   50,
+		IPBlockDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+	}
+}
+
+var (
+	lockoutPolicy = DefaultLockoutPolicy()
+	ipFailures    = newFailureTracker(lockoutPolicy)
+)
+
+func SetLockoutPolicy(policy LockoutPolicy) {
+	lockoutPolicy = policy
+	ipFailures = newFailureTracker(policy)
+}
+
+// backoffDelay is how long to wait after the given number of consecutive
+// failures before another attempt is evaluated.
+func (p LockoutPolicy) backoffDelay(failures int) time.Duration {
+	if failures < p.FreeAttempts {
+		return 0
+	}
+	exponent := failures - p.FreeAttempts
+	if exponent > 30 {
+		return p.MaxDelay
+	}
+	delay := time.Duration(float64(p.BaseDelay) * math.Pow(2, float64(exponent)))
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+type failureEntry struct {
+	count        int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// failureTracker counts failed logins per client IP in memory.
+type failureTracker struct {
+	mu      sync.Mutex
+	policy  LockoutPolicy
+	entries map[string]*failureEntry
+	now     func() time.Time
+}
+
+func newFailureTracker(policy LockoutPolicy) *failureTracker {
+	return &failureTracker{
+		policy:  policy,
+		entries: make(map[string]*failureEntry),
+		now:     time.Now,
+	}
+}
+
+// retryAfter returns how long key must wait before its next attempt.
+func (t *failureTracker) retryAfter(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[key]
+	if !ok {
+		return 0
+	}
+	now := t.now()
+	if now.Sub(entry.lastFailure) > t.policy.ResetAfter && now.After(entry.blockedUntil) {
+		delete(t.entries, key)
+		return 0
+	}
+	until := entry.lastFailure.Add(t.policy.backoffDelay(entry.count))
+	if entry.blockedUntil.After(until) {
+		until = entry.blockedUntil
+	}
+	if wait := until.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// recordFailure registers a failed attempt and reports whether key is now
+// blocked outright.
+func (t *failureTracker) recordFailure(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	entry, ok := t.entries[key]
+	if !ok || now.Sub(entry.lastFailure) > t.policy.ResetAfter {
+		entry = &failureEntry{}
+		t.entries[key] = entry
+	}
+	entry.count++
+	entry.lastFailure = now
+	if entry.count >= t.policy.IPMaxFailures {
+		entry.blockedUntil = now.Add(t.policy.IPBlockDuration)
+		entry.count = 0
+		return true
+	}
+	t.evictLocked(now)
+	return false
+}
+
+func (t *failureTracker) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+func (t *failureTracker) evictLocked(now time.Time) {
+	if len(t.entries) < 10000 {
+		return
+	}
+	for key, entry := range t.entries {
+		if now.Sub(entry.lastFailure) > t.policy.ResetAfter && now.After(entry.blockedUntil) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many failed login attempts. Please try again later.", http.StatusTooManyRequests)
+}
+
+// unlockTokenTTL is how long the link in an unlock email works.
+const unlockTokenTTL = 24 * time.Hour
+
+// failuresExpired reports whether the account's failure counter no longer
+// counts: its last failure is older than ResetAfter, or the lock those
+// failures led to has run out. Without the latter, a lock shorter than
+// ResetAfter would be followed by another lock on the next mistake.
+func failuresExpired(user models.User, now time.Time) bool {
+	return now.Sub(user.LastFailedLogin) > lockoutPolicy.ResetAfter ||
+		(!user.LockedUntil.IsZero() && !user.LockedUntil.After(now))
+}
+
+// accountRetryAfter applies the same backoff to the persisted per-account
+// failure counter, so it holds across instances and restarts.
+func accountRetryAfter(user models.User, now time.Time) time.Duration {
+	if user.FailedLogins == 0 || failuresExpired(user, now) {
+		return 0
+	}
+	wait := user.LastFailedLogin.Add(lockoutPolicy.backoffDelay(user.FailedLogins)).Sub(now)
+	if wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func recordAccountFailure(ctx context.Context, user models.User, ip string) {
+	collection := database().Collection("users")
+	now := time.Now()
+	update := bson.M{"$inc": bson.M{"failed_logins": 1}, "$set": bson.M{"last_failed_login": now}}
+	if failuresExpired(user, now) {
+		update = bson.M{
+			"$set":   bson.M{"failed_logins": 1, "last_failed_login": now},
+			"$unset": bson.M{"locked_until": "", "unlock_token_hash": "", "unlock_token_expires": ""},
+		}
+	}
+	var updated models.User
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": user.ID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	if err != nil {
+		logging.Logger().Errorf("Failed to record login failure: %v", err)
+		return
+	}
+	if updated.FailedLogins >= lockoutPolicy.MaxFailures {
+		lockAccount(ctx, updated, ip)
+	}
+}
+
+func lockAccount(ctx context.Context, user models.User, ip string) {
+	token, err := generateVerificationToken()
+	if err != nil {
+		logging.Logger().Errorf("Failed to generate unlock token: %v", err)
+		return
+	}
+	collection := database().Collection("users")
+	now := time.Now()
+	update := bson.M{"$set": bson.M{
+		"locked_until":         now.Add(lockoutPolicy.LockDuration),
+		"unlock_token_hash":    hashToken(token),
+		"unlock_token_expires": now.Add(unlockTokenTTL),
+	}}
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, update); err != nil {
+		logging.Logger().Errorf("Failed to lock account: %v", err)
+		return
+	}
+	LogUserActivity(ctx, user.ID, "account_locked", fmt.Sprintf("locked after %d failed logins, last from %s", user.FailedLogins, ip))
+	// ctx is usually the login request's, which ends with the response.
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := sendUnlockEmail(ctx, user.Email, token); err != nil {
+			logging.Logger().Errorf("Failed to send unlock email: %v", err)
+		}
+	}()
+}
+
+func resetAccountFailures(ctx context.Context, user models.User) {
+	if user.FailedLogins == 0 && user.LockedUntil.IsZero() {
+		return
+	}
+	collection := database().Collection("users")
+	update := bson.M{
+		"$set":   bson.M{"failed_logins": 0},
+		"$unset": bson.M{"last_failed_login": "", "locked_until": "", "unlock_token_hash": "", "unlock_token_expires": ""},
+	}
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, update); err != nil {
+		logging.Logger().Errorf("Failed to reset login failures: %v", err)
+	}
+}
+
+// UnlockAccount lifts a lock with the token from an unlock email. The email
+// links to a page that posts the token, so link scanners that follow it do
+// not unlock the account on their own.
+func UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		http.Error(w, "Unlock token is required", http.StatusBadRequest)
+		return
+	}
+	collection := database().Collection("users")
+	var user models.User
+	err := collection.FindOneAndUpdate(r.Context(),
+		bson.M{"unlock_token_hash": hashToken(req.Token), "unlock_token_expires": bson.M{"$gt": time.Now()}},
+		bson.M{
+			"$set":   bson.M{"failed_logins": 0},
+			"$unset": bson.M{"locked_until": "", "unlock_token_hash": "", "unlock_token_expires": "", "last_failed_login": ""},
+		}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to unlock account: %v", err)
+		http.Error(w, "Failed to unlock account", http.StatusInternalServerError)
+		return
+	}
+	LogUserActivity(r.Context(), user.ID, "account_unlocked", "unlocked via email link from "+clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account unlocked. You can now log in."})
+}
+
+func sendUnlockEmail(ctx context.Context, email, token string) error {
+	unlockURL := publicURL + "/unlock-account.html?token=" + token
+	body := "Your MovieVerse account was locked after too many failed login attempts.\n\n" +
+		"If this was you, unlock your account using this link: " + unlockURL + "\n\n" +
+		"If it was not, consider resetting your password."
+	if err := sendEmail(ctx, email, "MovieVerse - Account Locked", body); err != nil {
+		return err
+	}
+	logging.Logger().Infof("Unlock email sent to %s", email)
+	return nil
+}
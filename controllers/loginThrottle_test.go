@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"MovieVerse/models"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicy_BackoffDelay(t *testing.T) {
+	policy := DefaultLockoutPolicy()
+	policy.FreeAttempts = 2
+	policy.BaseDelay = time.Second
+	policy.MaxDelay = 10 * time.Second
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{2, time.Second},
+		{3, 2 * time.Second},
+		{4, 4 * time.Second},
+		{5, 8 * time.Second},
+		{6, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := policy.backoffDelay(tt.failures); got != tt.want {
+			t.Errorf("backoffDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestFailureTracker_BacksOffAndBlocks(t *testing.T) {
+	policy := DefaultLockoutPolicy()
+	policy.FreeAttempts = 1
+	policy.BaseDelay = time.Second
+	policy.IPMaxFailures = 4
+	policy.IPBlockDuration = time.Minute
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newFailureTracker(policy)
+	tracker.now = func() time.Time { return now }
+
+	if wait := tracker.retryAfter("10.0.0.1"); wait != 0 {
+		t.Fatalf("Expected no wait for unknown client, got %v", wait)
+	}
+	tracker.recordFailure("10.0.0.1")
+	if wait := tracker.retryAfter("10.0.0.1"); wait != time.Second {
+		t.Errorf("Expected 1s wait after first failure, got %v", wait)
+	}
+	tracker.recordFailure("10.0.0.1")
+	if wait := tracker.retryAfter("10.0.0.1"); wait != 2*time.Second {
+		t.Errorf("Expected 2s wait after second failure, got %v", wait)
+	}
+	if wait := tracker.retryAfter("10.0.0.2"); wait != 0 {
+		t.Errorf("Expected other clients to be unaffected, got %v", wait)
+	}
+
+	tracker.recordFailure("10.0.0.1")
+	if blocked := tracker.recordFailure("10.0.0.1"); !blocked {
+		t.Fatal("Expected client to be blocked after reaching the failure limit")
+	}
+	now = now.Add(30 * time.Second)
+	if wait := tracker.retryAfter("10.0.0.1"); wait != 30*time.Second {
+		t.Errorf("Expected remaining block of 30s, got %v", wait)
+	}
+
+	tracker.reset("10.0.0.1")
+	if wait := tracker.retryAfter("10.0.0.1"); wait != 0 {
+		t.Errorf("Expected no wait after reset, got %v", wait)
+	}
+}
+
+func TestAccountRetryAfter(t *testing.T) {
+	SetLockoutPolicy(DefaultLockoutPolicy())
+	now := time.Now()
+
+	user := models.User{FailedLogins: 2, LastFailedLogin: now}
+	if wait := accountRetryAfter(user, now); wait != 0 {
+		t.Errorf("Expected free attempts to have no delay, got %v", wait)
+	}
+
+	user.FailedLogins = lockoutPolicy.FreeAttempts + 1
+	if wait := accountRetryAfter(user, now); wait != 2*lockoutPolicy.BaseDelay {
+		t.Errorf("Expected %v delay, got %v", 2*lockoutPolicy.BaseDelay, wait)
+	}
+
+	user.LastFailedLogin = now.Add(-2 * lockoutPolicy.ResetAfter)
+	if wait := accountRetryAfter(user, now); wait != 0 {
+		t.Errorf("Expected stale failures to be ignored, got %v", wait)
+	}
+}
+
+func TestAccountRetryAfter_ForgetsFailuresOnceLockExpires(t *testing.T) {
+	policy := DefaultLockoutPolicy()
+	policy.LockDuration = time.Minute
+	SetLockoutPolicy(policy)
+	t.Cleanup(func() { SetLockoutPolicy(DefaultLockoutPolicy()) })
+	now := time.Now()
+
+	user := models.User{FailedLogins: policy.MaxFailures, LastFailedLogin: now.Add(-2 * time.Minute), LockedUntil: now.Add(-time.Minute)}
+	if !failuresExpired(user, now) {
+		t.Error("Expected failures to stop counting once the lock ran out")
+	}
+	if wait := accountRetryAfter(user, now); wait != 0 {
+		t.Errorf("Expected no backoff after the lock, got %v", wait)
+	}
+
+	user.LockedUntil = now.Add(time.Minute)
+	if failuresExpired(user, now) {
+		t.Error("Expected failures to keep counting while locked")
+	}
+}
+
+func TestUnlockAccount_LiveRejectsExpiredToken(t *testing.T) {
+	db := liveDatabase(t)
+	now := time.Now()
+	user := models.User{Email: "locked@example.com", FailedLogins: 10, LockedUntil: now.Add(time.Hour)}
+	for _, u := range []struct {
+		token   string
+		expires time.Time
+	}{
+		{"expired-token", now.Add(-time.Minute)},
+		{"fresh-token", now.Add(time.Hour)},
+	} {
+		user.UnlockTokenHash, user.UnlockExpires = hashToken(u.token), u.expires
+		if _, err := db.Collection("users").InsertOne(context.Background(), user); err != nil {
+			t.Fatal(err)
+		}
+		user.Email = "other-" + user.Email
+	}
+
+	unlock := func(token string) int {
+		rec := httptest.NewRecorder()
+		UnlockAccount(rec, httptest.NewRequest(http.MethodPost, "/unlock-account", strings.NewReader(`{"token":"`+token+`"}`)))
+		return rec.Code
+	}
+	if code := unlock("expired-token"); code != http.StatusBadRequest {
+		t.Errorf("Expected the expired token to be rejected, got %d", code)
+	}
+	if code := unlock("fresh-token"); code != http.StatusOK {
+		t.Errorf("Expected the fresh token to unlock, got %d", code)
+	}
+	if code := unlock("fresh-token"); code != http.StatusBadRequest {
+		t.Errorf("Expected the token to work only once, got %d", code)
+	}
+}
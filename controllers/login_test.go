@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"MovieVerse/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// liveDatabase points the controllers at a scratch database on the server
+// named by MOVIEVERSE_TEST_MONGO_URI, dropped when the test ends.
+func liveDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MOVIEVERSE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MOVIEVERSE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousClient, previousName := client, databaseName
+	name := fmt.Sprintf("movieverse_controllers_%d", time.Now().UnixNano())
+	SetClient(c)
+	SetDatabaseName(name)
+	t.Cleanup(func() {
+		c.Database(name).Drop(ctx)
+		c.Disconnect(ctx)
+		client, databaseName = previousClient, previousName
+	})
+	return c.Database(name)
+}
+
+// insertUser stores user with password hashed at cost and returns it with
+// its ID.
+func insertUser(t *testing.T, db *mongo.Database, user models.User, password string, cost int) models.User {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Password = string(hash)
+	result, err := db.Collection("users").InsertOne(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return findUser(t, db, result.InsertedID)
+}
+
+func findUser(t *testing.T, db *mongo.Database, id interface{}) models.User {
+	t.Helper()
+	var user models.User
+	if err := db.Collection("users").FindOne(context.Background(), bson.M{"_id": id}).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestLoginUser_LiveRehashesBeforeTwoFactorChallenge(t *testing.T) {
+	db := liveDatabase(t)
+	previousPolicy := passwordPolicy
+	passwordPolicy.BcryptCost = bcrypt.MinCost + 1
+	t.Cleanup(func() { passwordPolicy = previousPolicy })
+
+	user := insertUser(t, db, models.User{Email: "2fa@example.com", TOTPEnabled: true, TOTPSecret: "JBSWY3DPEHPK3PXP"}, "Correct-Horse-42", bcrypt.MinCost)
+
+	body := strings.NewReader(`{"email":"2fa@example.com","password":"Correct-Horse-42"}`)
+	rec := httptest.NewRecorder()
+	LoginUser(rec, httptest.NewRequest(http.MethodPost, "/login", body))
+	var response map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil || response["two_factor_required"] != true {
+		t.Fatalf("Expected a two-factor challenge, got %d %v", rec.Code, response)
+	}
+
+	stored := findUser(t, db, user.ID)
+	if cost, _ := bcrypt.Cost([]byte(stored.Password)); cost != bcrypt.MinCost+1 {
+		t.Errorf("Expected the password to be rehashed at cost %d, got %d", bcrypt.MinCost+1, cost)
+	}
+}
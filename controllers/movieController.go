@@ -1,32 +1,33 @@
 package controllers
 
 import (
+	"MovieVerse/logging"
+	"MovieVerse/metrics"
 	"MovieVerse/models"
 	"context"
 	"encoding/json"
+	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"log"
 	"math"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 )
 
 func GetMovies(w http.ResponseWriter, r *http.Request) {
-	movieCollection := client.Database("movieverse").Collection("movies")
-	cursor, err := movieCollection.Find(context.TODO(), bson.M{})
+	movieCollection := database().Collection("movies")
+	cursor, err := movieCollection.Find(r.Context(), bson.M{})
 	if err != nil {
 		http.Error(w, "Failed to fetch movies", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(r.Context())
 
 	var movies []models.Movie
-	if err = cursor.All(context.TODO(), &movies); err != nil {
+	if err = cursor.All(r.Context(), &movies); err != nil {
 		http.Error(w, "Error decoding movies", http.StatusInternalServerError)
 		return
 	}
@@ -35,7 +36,7 @@ func GetMovies(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(movies)
 }
 func GetMovieByID(w http.ResponseWriter, r *http.Request) {
-	movieCollection := client.Database("movieverse").Collection("movies")
+	movieCollection := database().Collection("movies")
 	id := r.URL.Query().Get("id")
 	if id == "" {
 		http.Error(w, "Movie ID is required", http.StatusBadRequest)
@@ -49,7 +50,7 @@ func GetMovieByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var movie models.Movie
-	err = movieCollection.FindOne(context.TODO(), bson.M{"_id": objID}).Decode(&movie)
+	err = movieCollection.FindOne(r.Context(), bson.M{"_id": objID}).Decode(&movie)
 	if err == mongo.ErrNoDocuments {
 		http.Error(w, "Movie not found", http.StatusNotFound)
 		return
@@ -62,7 +63,7 @@ func GetMovieByID(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(movie)
 }
 func CreateMovie(w http.ResponseWriter, r *http.Request) {
-	movieCollection := client.Database("movieverse").Collection("movies")
+	movieCollection := database().Collection("movies")
 
 	var movie models.Movie
 	if err := json.NewDecoder(r.Body).Decode(&movie); err != nil {
@@ -71,7 +72,7 @@ func CreateMovie(w http.ResponseWriter, r *http.Request) {
 	}
 
 	movie.ID = primitive.NewObjectID()
-	_, err := movieCollection.InsertOne(context.TODO(), movie)
+	_, err := movieCollection.InsertOne(r.Context(), movie)
 	if err != nil {
 		http.Error(w, "Failed to create movie", http.StatusInternalServerError)
 		return
@@ -81,7 +82,7 @@ func CreateMovie(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(movie)
 }
 func UpdateMovie(w http.ResponseWriter, r *http.Request) {
-	movieCollection := client.Database("movieverse").Collection("movies")
+	movieCollection := database().Collection("movies")
 
 	id := r.URL.Query().Get("id")
 	if id == "" {
@@ -102,17 +103,29 @@ func UpdateMovie(w http.ResponseWriter, r *http.Request) {
 	}
 
 	update := bson.M{"$set": updatedData}
-	_, err = movieCollection.UpdateOne(context.TODO(), bson.M{"_id": objID}, update)
-	if err != nil {
+	var before bson.M
+	err = movieCollection.FindOneAndUpdate(r.Context(), bson.M{"_id": objID}, update).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Movie not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, "Failed to update movie", http.StatusInternalServerError)
 		return
 	}
+	after := bson.M{}
+	for field, value := range before {
+		after[field] = value
+	}
+	for field, value := range updatedData {
+		after[field] = value
+	}
+	RecordAudit(w, r, AuditMovieUpdate, "movie", id, before, after)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Movie updated successfully"})
 }
 func DeleteMovie(w http.ResponseWriter, r *http.Request) {
-	movieCollection := client.Database("movieverse").Collection("movies")
+	movieCollection := database().Collection("movies")
 
 	id := r.URL.Query().Get("id")
 	if id == "" {
@@ -126,27 +139,23 @@ func DeleteMovie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = movieCollection.DeleteOne(context.TODO(), bson.M{"_id": objID})
-	if err != nil {
+	var before bson.M
+	err = movieCollection.FindOneAndDelete(r.Context(), bson.M{"_id": objID}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Movie not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, "Failed to delete movie", http.StatusInternalServerError)
 		return
 	}
+	RecordAudit(w, r, AuditMovieDelete, "movie", id, before, nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Movie deleted successfully"})
 }
 
-func init() {
-	logFile, err := os.OpenFile("user_actions.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
-	}
-	log.SetOutput(logFile)
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-}
-
 func GetMoviesWithFilters(w http.ResponseWriter, r *http.Request) {
-	movieCollection := client.Database("movieverse").Collection("movies")
+	movieCollection := database().Collection("movies")
 	genres := r.URL.Query()["genres"]
 	countries := r.URL.Query()["country"]
 	yearFrom := r.URL.Query().Get("yearMin")
@@ -197,7 +206,7 @@ func GetMoviesWithFilters(w http.ResponseWriter, r *http.Request) {
 	}
 	sortOptions = append(sortOptions, bson.E{Key: sortField, Value: sortOrder})
 
-	totalRecords, err := movieCollection.CountDocuments(context.TODO(), filter)
+	totalRecords, err := movieCollection.CountDocuments(r.Context(), filter)
 	if err != nil {
 		http.Error(w, "Error counting movies", http.StatusInternalServerError)
 		return
@@ -206,15 +215,15 @@ func GetMoviesWithFilters(w http.ResponseWriter, r *http.Request) {
 	totalPages := int(math.Ceil(float64(totalRecords) / float64(limit)))
 	skip := (page - 1) * limit
 
-	cursor, err := movieCollection.Find(context.TODO(), filter, options.Find().SetSort(sortOptions).SetSkip(int64(skip)).SetLimit(int64(limit)))
+	cursor, err := movieCollection.Find(r.Context(), filter, options.Find().SetSort(sortOptions).SetSkip(int64(skip)).SetLimit(int64(limit)))
 	if err != nil {
 		http.Error(w, "Error fetching movies", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(r.Context())
 
 	var movies []models.Movie
-	if err = cursor.All(context.TODO(), &movies); err != nil {
+	if err = cursor.All(r.Context(), &movies); err != nil {
 		http.Error(w, "Error decoding movies", http.StatusInternalServerError)
 		return
 	}
@@ -228,8 +237,14 @@ func GetMoviesWithFilters(w http.ResponseWriter, r *http.Request) {
 		status = "sorting"
 	}
 
-	log.Printf("endpoint: /movies, method: GET, status: %s, filters: %+v, sort: %s, order: %s, page: %d, limit: %d",
-		status, filter, sortField, order, page, limit)
+	logging.FromContext(r.Context()).WithFields(logrus.Fields{
+		"status": status,
+		"filter": filter,
+		"sort":   sortField,
+		"order":  order,
+		"page":   page,
+		"limit":  limit,
+	}).Info("movie search")
 
 	response := map[string]interface{}{
 		"movies":      movies,
@@ -247,7 +262,7 @@ func GetMoviesWithFilters(w http.ResponseWriter, r *http.Request) {
 	}
 }
 func SearchAndFilterMovies(w http.ResponseWriter, r *http.Request) {
-	movieCollection := client.Database("movieverse").Collection("movies")
+	movieCollection := database().Collection("movies")
 	query := r.URL.Query()
 
 	filter := bson.M{}
@@ -311,20 +326,20 @@ func SearchAndFilterMovies(w http.ResponseWriter, r *http.Request) {
 	skip := (page - 1) * limit
 
 	opts := options.Find().SetSort(sortOptions).SetSkip(int64(skip)).SetLimit(int64(limit))
-	cursor, err := movieCollection.Find(context.TODO(), filter, opts)
+	cursor, err := movieCollection.Find(r.Context(), filter, opts)
 	if err != nil {
 		http.Error(w, "Error fetching movies", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(r.Context())
 
 	var movies []models.Movie
-	if err = cursor.All(context.TODO(), &movies); err != nil {
+	if err = cursor.All(r.Context(), &movies); err != nil {
 		http.Error(w, "Error decoding movies", http.StatusInternalServerError)
 		return
 	}
 
-	totalCount, err := movieCollection.CountDocuments(context.TODO(), filter)
+	totalCount, err := movieCollection.CountDocuments(r.Context(), filter)
 	if err != nil {
 		totalCount = int64(len(movies))
 	}
@@ -361,10 +376,11 @@ type Order struct {
 }
 
 func Checkout(w http.ResponseWriter, r *http.Request) {
-	log.Println("Checkout handler invoked")
+	logger := logging.FromContext(r.Context())
+	logger.Debugln("Checkout handler invoked")
 
 	if r.Method != http.MethodPost {
-		log.Println("Invalid request method:", r.Method)
+		logger.Warnln("Invalid request method:", r.Method)
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
@@ -372,55 +388,64 @@ func Checkout(w http.ResponseWriter, r *http.Request) {
 	var req CheckoutRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		log.Println("Error decoding JSON payload:", err)
+		logger.Warnln("Error decoding JSON payload:", err)
 		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
 		return
 	}
-	log.Printf("Decoded checkout payload: %+v\n", req)
+	logger.Debugf("Decoded checkout payload: %+v", req)
 
 	if len(req.Movies) == 0 {
-		log.Println("Cart is empty")
+		logger.Warnln("Cart is empty")
 		http.Error(w, "Cart is empty", http.StatusBadRequest)
 		return
 	}
 
-	dummyUserID := primitive.NewObjectID()
-	log.Println("Using dummy user ID:", dummyUserID.Hex())
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	var total float64
 	for i, item := range req.Movies {
 		lineTotal := item.Price * float64(item.Quantity)
-		log.Printf("Movie %d: Price=%.2f, Quantity=%d, LineTotal=%.2f", i, item.Price, item.Quantity, lineTotal)
+		logger.Debugf("Movie %d: Price=%.2f, Quantity=%d, LineTotal=%.2f", i, item.Price, item.Quantity, lineTotal)
 		total += lineTotal
 	}
-	log.Printf("Total order cost: %.2f", total)
+	logger.Debugf("Total order cost: %.2f", total)
 
 	order := Order{
-		UserID:      dummyUserID,
+		UserID:      claims.UserID,
 		Movies:      req.Movies,
 		Total:       total,
 		OrderStatus: "pending",
 		CreatedAt:   time.Now(),
 	}
-	log.Printf("Order to insert: %+v", order)
+	logger.Debugf("Order to insert: %+v", order)
 
-	orderCollection := client.Database("movieverse").Collection("orders")
-	result, err := orderCollection.InsertOne(context.TODO(), order)
+	orderCollection := database().Collection("orders")
+	result, err := orderCollection.InsertOne(r.Context(), order)
 	if err != nil {
-		log.Println("Error inserting order into MongoDB:", err)
+		logger.Errorln("Error inserting order into MongoDB:", err)
+		metrics.Checkouts.WithLabelValues("failure").Inc()
 		http.Error(w, "Failed to process checkout", http.StatusInternalServerError)
 		return
 	}
-	log.Println("Order inserted successfully. InsertedID:", result.InsertedID)
+	logger.Debugln("Order inserted successfully. InsertedID:", result.InsertedID)
+	metrics.Checkouts.WithLabelValues("success").Inc()
+	if total > 0 {
+		// Counters panic on negative values and prices come from the client.
+		metrics.CheckoutRevenue.Add(total)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	response := models.Response{
 		Status:  "success",
 		Message: "Checkout successful!",
 	}
-	log.Printf("Sending success response: %+v", response)
+	logger.Debugf("Sending success response: %+v", response)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Println("Error encoding success response:", err)
+		logger.Errorln("Error encoding success response:", err)
 	}
 }
 
@@ -430,23 +455,27 @@ type ActivityLog struct {
 	Action    string             `bson:"action" json:"action"`
 	Detail    string             `bson:"detail" json:"detail"`
 	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+	ExpireAt  time.Time          `bson:"expire_at" json:"-"`
 }
 
-func LogUserActivity(userID primitive.ObjectID, action, detail string) {
+func LogUserActivity(ctx context.Context, userID primitive.ObjectID, action, detail string) {
+	now := time.Now()
 	logEntry := ActivityLog{
 		UserID:    userID,
 		Action:    action,
 		Detail:    detail,
-		Timestamp: time.Now(),
+		Timestamp: now,
+		ExpireAt:  now.Add(activityRetention),
 	}
-	activityCollection := client.Database("movieverse").Collection("activity_logs")
-	_, err := activityCollection.InsertOne(context.TODO(), logEntry)
+	activityCollection := database().Collection("activity_logs")
+	// Recorded even if the client has gone away by now.
+	_, err := activityCollection.InsertOne(context.WithoutCancel(ctx), logEntry)
 	if err != nil {
-		log.Println("Error logging user activity:", err)
+		logging.Logger().Errorln("Error logging user activity:", err)
 	}
 }
 func GetAnalyticsDashboard(w http.ResponseWriter, r *http.Request) {
-	ordersCollection := client.Database("movieverse").Collection("orders")
+	ordersCollection := database().Collection("orders")
 
 	salesPipeline := mongo.Pipeline{
 		{{Key: "$group", Value: bson.D{
@@ -455,13 +484,13 @@ func GetAnalyticsDashboard(w http.ResponseWriter, r *http.Request) {
 			{Key: "orderCount", Value: bson.D{{Key: "$sum", Value: 1}}},
 		}}},
 	}
-	cursor, err := ordersCollection.Aggregate(context.TODO(), salesPipeline)
+	cursor, err := ordersCollection.Aggregate(r.Context(), salesPipeline)
 	if err != nil {
 		http.Error(w, "Error fetching sales data", http.StatusInternalServerError)
 		return
 	}
 	var salesResults []bson.M
-	if err = cursor.All(context.TODO(), &salesResults); err != nil {
+	if err = cursor.All(r.Context(), &salesResults); err != nil {
 		http.Error(w, "Error decoding sales data", http.StatusInternalServerError)
 		return
 	}
@@ -489,13 +518,13 @@ func GetAnalyticsDashboard(w http.ResponseWriter, r *http.Request) {
 		{{Key: "$sort", Value: bson.D{{Key: "totalQuantity", Value: -1}}}},
 		{{Key: "$limit", Value: 5}},
 	}
-	cursorPurchases, err := ordersCollection.Aggregate(context.TODO(), purchasesPipeline)
+	cursorPurchases, err := ordersCollection.Aggregate(r.Context(), purchasesPipeline)
 	if err != nil {
 		http.Error(w, "Error fetching purchase data", http.StatusInternalServerError)
 		return
 	}
 	var purchaseResults []bson.M
-	if err = cursorPurchases.All(context.TODO(), &purchaseResults); err != nil {
+	if err = cursorPurchases.All(r.Context(), &purchaseResults); err != nil {
 		http.Error(w, "Error decoding purchase data", http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,482 @@
+package controllers
+
+import (
+	"MovieVerse/logging"
+	"MovieVerse/models"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcStateCookie = "oidc_auth"
+	oidcStateTTL    = 10 * time.Minute
+	jwksRefreshWait = time.Minute
+)
+
+// OIDCProvider is an external OpenID Connect identity provider users can
+// log in with. Endpoints are discovered from the issuer on first use.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	HTTPClient   *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcIDClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Nonce             string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+type oidcStateClaims struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+var oidcProviders = make(map[string]*OIDCProvider)
+
+func RegisterOIDCProvider(provider *OIDCProvider) {
+	if provider.HTTPClient == nil {
+		provider.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(provider.Scopes) == 0 {
+		provider.Scopes = []string{"openid", "email", "profile"}
+	}
+	oidcProviders[provider.Name] = provider
+}
+
+func (p *OIDCProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", p.Name, err)
+	}
+	if discovery.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", discovery.Issuer, p.Issuer)
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, endpoint string, target interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+// authCodeURL builds the authorization request for the code flow with a
+// S256 PKCE challenge.
+func (p *OIDCProvider) authCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// exchange trades the authorization code for the raw ID token.
+func (p *OIDCProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// verifyIDToken checks the signature against the provider's JWKS and the
+// issuer, audience, expiry and nonce claims.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, raw, nonce string) (*oidcIDClaims, error) {
+	claims := &oidcIDClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256"}))
+	_, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	if claims.Issuer != p.Issuer {
+		return nil, fmt.Errorf("id token issuer %q does not match %q", claims.Issuer, p.Issuer)
+	}
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, errors.New("id token was not issued for this client")
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("id token has no expiry")
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	return claims, nil
+}
+
+func (p *OIDCProvider) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	stale := time.Since(p.keysFetched) > jwksRefreshWait
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := p.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (p *OIDCProvider) refreshKeys(ctx context.Context) error {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+func randomURLString() (string, error) {
+	token, err := generateVerificationToken()
+	return strings.TrimRight(token, "="), err
+}
+
+// OIDCLogin redirects to the provider's authorization endpoint. The state,
+// nonce and PKCE verifier travel in a signed, short-lived cookie so any
+// instance can complete the callback.
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProviders[r.URL.Query().Get("provider")]
+	if !ok {
+		http.Error(w, "Unknown login provider", http.StatusBadRequest)
+		return
+	}
+	var values [3]string
+	for i := range values {
+		value, err := randomURLString()
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed to generate OIDC state: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	authURL, err := provider.authCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("OIDC provider %s unavailable: %v", provider.Name, err)
+		http.Error(w, "Login provider unavailable", http.StatusBadGateway)
+		return
+	}
+	stateToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &oidcStateClaims{
+		Provider: provider.Name,
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(oidcStateTTL)),
+		},
+	}).SignedString(jwtKey)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to sign OIDC state: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    stateToken,
+		Path:     "/auth/oidc/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		http.Error(w, "Login was not completed: "+errCode, http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "Login session expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/auth/oidc/", MaxAge: -1})
+
+	stateClaims := &oidcStateClaims{}
+	token, err := jwt.ParseWithClaims(cookie.Value, stateClaims, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+	if err != nil || !token.Valid || stateClaims.State != query.Get("state") {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	provider, ok := oidcProviders[stateClaims.Provider]
+	if !ok {
+		http.Error(w, "Unknown login provider", http.StatusBadRequest)
+		return
+	}
+
+	rawIDToken, err := provider.exchange(r.Context(), query.Get("code"), stateClaims.Verifier)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("OIDC code exchange with %s failed: %v", provider.Name, err)
+		http.Error(w, "Failed to complete login", http.StatusBadGateway)
+		return
+	}
+	idClaims, err := provider.verifyIDToken(r.Context(), rawIDToken, stateClaims.Nonce)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("OIDC id token from %s rejected: %v", provider.Name, err)
+		http.Error(w, "Failed to complete login", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := findOrLinkOIDCUser(r.Context(), provider.Name, idClaims)
+	switch {
+	case errors.Is(err, errEmailNotVerified):
+		oidcRedirect(w, r, url.Values{"error": {"Your email address is not verified with this provider"}})
+		return
+	case errors.Is(err, errLocalEmailNotVerified):
+		oidcRedirect(w, r, url.Values{"error": {"An account with this email already exists. Verify its email address, then log in with " + provider.Name + " again."}})
+		return
+	case errors.Is(err, errAccountLocked):
+		oidcRedirect(w, r, url.Values{"error": {"Account is temporarily locked. Check your email for an unlock link."}})
+		return
+	case err != nil:
+		logging.FromContext(r.Context()).Errorf("Failed to link OIDC account: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if user.TOTPEnabled {
+		challenge, err := issueTwoFactorChallenge(user)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed to sign challenge: %v", err)
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		oidcRedirect(w, r, url.Values{"challenge": {challenge}})
+		return
+	}
+	tokenString, err := issueToken(user, false)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to sign token: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	LogUserActivity(r.Context(), user.ID, ActivityLogin, provider.Name)
+	oidcRedirect(w, r, url.Values{"token": {tokenString}, "admin": {strconv.FormatBool(isStaff(userRoles(user)))}})
+}
+
+// oidcRedirect hands the outcome of an external login to the frontend. The
+// values travel in the URL fragment, which browsers neither send to the
+// server nor pass on in the Referer header, so the token stays out of logs.
+func oidcRedirect(w http.ResponseWriter, r *http.Request, values url.Values) {
+	http.Redirect(w, r, publicURL+"/oidc-callback.html#"+values.Encode(), http.StatusSeeOther)
+}
+
+var (
+	errEmailNotVerified      = errors.New("email not verified by provider")
+	errLocalEmailNotVerified = errors.New("existing account has not verified its email")
+	errAccountLocked         = errors.New("account is locked")
+)
+
+// findOrLinkOIDCUser resolves the local account for an external identity:
+// an existing link wins, otherwise the identity is added to the account with
+// the same email, otherwise a new password-less account is created. An
+// existing account is only linked once its owner has verified the address;
+// anyone could have signed up with it before then. Locked accounts are
+// refused before anything is written.
+func findOrLinkOIDCUser(ctx context.Context, providerName string, claims *oidcIDClaims) (models.User, error) {
+	collection := database().Collection("users")
+	identity := models.ExternalIdentity{Provider: providerName, Subject: claims.Subject}
+
+	var user models.User
+	err := collection.FindOne(ctx, bson.M{"identities": bson.M{"$elemMatch": bson.M{
+		"provider": identity.Provider,
+		"subject":  identity.Subject,
+	}}}).Decode(&user)
+	if err == nil {
+		if user.LockedUntil.After(time.Now()) {
+			return user, errAccountLocked
+		}
+		return user, nil
+	} else if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+
+	if !claims.EmailVerified || claims.Email == "" {
+		return user, errEmailNotVerified
+	}
+
+	err = collection.FindOne(ctx, bson.M{"email": claims.Email}).Decode(&user)
+	if err == nil {
+		if user.LockedUntil.After(time.Now()) {
+			return user, errAccountLocked
+		}
+		if !user.EmailVerified {
+			return user, errLocalEmailNotVerified
+		}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$push": bson.M{"identities": identity}}); err != nil {
+			return user, err
+		}
+		user.Identities = append(user.Identities, identity)
+		return user, nil
+	} else if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Name
+	}
+	if username == "" {
+		username, _, _ = strings.Cut(claims.Email, "@")
+	}
+	user = models.User{
+		ID:            primitive.NewObjectID(),
+		Email:         claims.Email,
+		Username:      username,
+		EmailVerified: true,
+		Identities:    []models.ExternalIdentity{identity},
+	}
+	if _, err := collection.InsertOne(ctx, user); err != nil {
+		return user, err
+	}
+	return user, nil
+}
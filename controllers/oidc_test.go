@@ -0,0 +1,345 @@
+package controllers
+
+import (
+	"MovieVerse/models"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubOIDCProvider is a minimal local OpenID Connect provider implementing
+// discovery, the authorization endpoint, the token endpoint with PKCE and a
+// JWKS document.
+type stubOIDCProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	secret   string
+	claims   map[string]interface{}
+
+	mu         sync.Mutex
+	challenges map[string]string
+	nonces     map[string]string
+}
+
+func newStubOIDCProvider(t *testing.T) *stubOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	stub := &stubOIDCProvider{
+		key:        key,
+		clientID:   "movieverse",
+		secret:     "s3cret",
+		challenges: make(map[string]string),
+		nonces:     make(map[string]string),
+		claims: map[string]interface{}{
+			"sub":            "user-123",
+			"email":          "fan@example.com",
+			"email_verified": true,
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 stub.server.URL,
+			"authorization_endpoint": stub.server.URL + "/authorize",
+			"token_endpoint":         stub.server.URL + "/token",
+			"jwks_uri":               stub.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != stub.clientID {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		code := "code-" + q.Get("state")
+		stub.mu.Lock()
+		stub.challenges[code] = q.Get("code_challenge")
+		stub.nonces[code] = q.Get("nonce")
+		stub.mu.Unlock()
+		redirect := q.Get("redirect_uri") + "?code=" + url.QueryEscape(code) + "&state=" + url.QueryEscape(q.Get("state"))
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != stub.clientID || pass != stub.secret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		code := r.FormValue("code")
+		stub.mu.Lock()
+		challenge, nonce := stub.challenges[code], stub.nonces[code]
+		delete(stub.challenges, code)
+		stub.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if challenge == "" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "unused",
+			"token_type":   "Bearer",
+			"id_token":     stub.signIDToken(t, stub.key, nonce, stub.clientID),
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "stub-key",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(stub.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(stub.key.E)).Bytes()),
+		}}})
+	})
+	stub.server = httptest.NewServer(mux)
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+func (s *stubOIDCProvider) signIDToken(t *testing.T, key *rsa.PrivateKey, nonce, audience string) string {
+	claims := jwt.MapClaims{
+		"iss":   s.server.URL,
+		"aud":   audience,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range s.claims {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "stub-key"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign id token: %v", err)
+	}
+	return signed
+}
+
+func registerStubProvider(stub *stubOIDCProvider) *OIDCProvider {
+	provider := &OIDCProvider{
+		Name:         "stub",
+		Issuer:       stub.server.URL,
+		ClientID:     stub.clientID,
+		ClientSecret: stub.secret,
+		RedirectURL:  "http://movieverse.test/auth/oidc/callback",
+	}
+	RegisterOIDCProvider(provider)
+	return provider
+}
+
+// startOIDCLogin runs OIDCLogin and the stub's authorization endpoint and
+// returns the callback query and the state cookie claims.
+func startOIDCLogin(t *testing.T) (url.Values, *http.Cookie, *oidcStateClaims) {
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/login?provider=stub", nil)
+	rr := httptest.NewRecorder()
+	OIDCLogin(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("Expected redirect, got %d: %s", rr.Code, rr.Body.String())
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || !cookies[0].HttpOnly {
+		t.Fatalf("Expected HttpOnly state cookie, got %v", cookies)
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Authorization request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Stub provider rejected authorization request: %s", resp.Status)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid callback URL: %v", err)
+	}
+
+	stateClaims := &oidcStateClaims{}
+	if _, err := jwt.ParseWithClaims(cookies[0].Value, stateClaims, func(*jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	}); err != nil {
+		t.Fatalf("Invalid state cookie: %v", err)
+	}
+	return callback.Query(), cookies[0], stateClaims
+}
+
+func TestOIDC_AuthorizationCodeFlowWithPKCE(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	provider := registerStubProvider(stub)
+
+	callback, _, state := startOIDCLogin(t)
+	if callback.Get("state") != state.State {
+		t.Fatalf("State mismatch: %q vs %q", callback.Get("state"), state.State)
+	}
+
+	rawIDToken, err := provider.exchange(context.Background(), callback.Get("code"), state.Verifier)
+	if err != nil {
+		t.Fatalf("exchange returned error: %v", err)
+	}
+	claims, err := provider.verifyIDToken(context.Background(), rawIDToken, state.Nonce)
+	if err != nil {
+		t.Fatalf("verifyIDToken returned error: %v", err)
+	}
+	if claims.Subject != "user-123" || claims.Email != "fan@example.com" || !claims.EmailVerified {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+}
+
+func TestOIDC_ExchangeRejectsWrongVerifier(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	provider := registerStubProvider(stub)
+
+	callback, _, _ := startOIDCLogin(t)
+	if _, err := provider.exchange(context.Background(), callback.Get("code"), "not-the-verifier"); err == nil {
+		t.Error("Expected exchange with wrong PKCE verifier to fail")
+	}
+}
+
+func TestOIDC_VerifyIDTokenRejectsBadTokens(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	provider := registerStubProvider(stub)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+	}{
+		{"wrong nonce", stub.signIDToken(t, stub.key, "nonce-a", stub.clientID), "nonce-b"},
+		{"wrong audience", stub.signIDToken(t, stub.key, "nonce-a", "someone-else"), "nonce-a"},
+		{"wrong signing key", stub.signIDToken(t, otherKey, "nonce-a", stub.clientID), "nonce-a"},
+		{"hmac signed", func() string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+				"iss": stub.server.URL, "aud": stub.clientID, "sub": "x", "nonce": "nonce-a",
+				"exp": time.Now().Add(time.Minute).Unix(),
+			}).SignedString([]byte("secret"))
+			return signed
+		}(), "nonce-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := provider.verifyIDToken(context.Background(), tt.token, tt.nonce); err == nil {
+				t.Error("Expected id token to be rejected")
+			}
+		})
+	}
+}
+
+func TestOIDCCallback_RejectsStateMismatch(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	registerStubProvider(stub)
+
+	callback, cookie, _ := startOIDCLogin(t)
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?code="+url.QueryEscape(callback.Get("code"))+"&state=forged", nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	OIDCCallback(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Invalid login state") {
+		t.Errorf("Expected invalid state error, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestOIDCCallback_LiveRedirectsWithTokenInFragment(t *testing.T) {
+	db := liveDatabase(t)
+	stub := newStubOIDCProvider(t)
+	registerStubProvider(stub)
+
+	callback, cookie, _ := startOIDCLogin(t)
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?code="+url.QueryEscape(callback.Get("code"))+"&state="+url.QueryEscape(callback.Get("state")), nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	OIDCCallback(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect to the frontend, got %d: %s", rr.Code, rr.Body.String())
+	}
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil || location.Path != "/oidc-callback.html" || location.RawQuery != "" {
+		t.Fatalf("Unexpected redirect %q", rr.Header().Get("Location"))
+	}
+	fragment, _ := url.ParseQuery(location.Fragment)
+	if fragment.Get("token") == "" || fragment.Get("admin") != "false" {
+		t.Errorf("Expected the token in the fragment, got %q", location.Fragment)
+	}
+
+	var entry ActivityLog
+	if err := db.Collection("activity_logs").FindOne(context.Background(), bson.M{"action": ActivityLogin}).Decode(&entry); err != nil || entry.Detail != "stub" {
+		t.Errorf("Expected a login activity naming the provider, got %+v, %v", entry, err)
+	}
+}
+
+func TestFindOrLinkOIDCUser_LiveLinksOnlyVerifiedAccounts(t *testing.T) {
+	db := liveDatabase(t)
+	verified := insertUser(t, db, models.User{Email: "fan@example.com", EmailVerified: true, TokenVersion: 3}, "Correct-Horse-42", bcrypt.MinCost)
+	unverified := insertUser(t, db, models.User{Email: "squatted@example.com"}, "Squatter-Pass-42", bcrypt.MinCost)
+
+	claims := &oidcIDClaims{Email: "fan@example.com", EmailVerified: true}
+	claims.Subject = "user-123"
+	user, err := findOrLinkOIDCUser(context.Background(), "stub", claims)
+	if err != nil {
+		t.Fatalf("Failed to link: %v", err)
+	}
+	if user.ID != verified.ID {
+		t.Fatalf("Expected the existing account to be linked, got %s", user.ID.Hex())
+	}
+	stored := findUser(t, db, verified.ID)
+	if stored.Password != verified.Password || stored.TokenVersion != 3 {
+		t.Error("Expected linking to leave the password and sessions alone")
+	}
+	if len(stored.Identities) != 1 || stored.Identities[0].Subject != "user-123" {
+		t.Errorf("Expected the identity to be linked, got %+v", stored.Identities)
+	}
+
+	claims = &oidcIDClaims{Email: "squatted@example.com", EmailVerified: true}
+	claims.Subject = "user-456"
+	if _, err := findOrLinkOIDCUser(context.Background(), "stub", claims); !errors.Is(err, errLocalEmailNotVerified) {
+		t.Errorf("Expected an unverified account to be refused, got %v", err)
+	}
+	if stored := findUser(t, db, unverified.ID); len(stored.Identities) != 0 {
+		t.Errorf("Expected the unverified account to stay unlinked, got %+v", stored.Identities)
+	}
+}
+
+func TestFindOrLinkOIDCUser_LiveRefusesLockedAccount(t *testing.T) {
+	db := liveDatabase(t)
+	locked := insertUser(t, db, models.User{Email: "fan@example.com", EmailVerified: true, LockedUntil: time.Now().Add(time.Hour)}, "Correct-Horse-42", bcrypt.MinCost)
+
+	claims := &oidcIDClaims{Email: "fan@example.com", EmailVerified: true}
+	claims.Subject = "user-123"
+	if _, err := findOrLinkOIDCUser(context.Background(), "stub", claims); !errors.Is(err, errAccountLocked) {
+		t.Errorf("Expected the locked account to be refused, got %v", err)
+	}
+	if stored := findUser(t, db, locked.ID); len(stored.Identities) != 0 {
+		t.Errorf("Expected nothing to be linked to a locked account, got %+v", stored.Identities)
+	}
+}
+
+func TestUser_IgnoresClientSuppliedVerification(t *testing.T) {
+	var user models.User
+	body := `{"email":"fan@example.com","email_verified":true,"EmailVerified":true,"verification_token":"x","VerificationToken":"x"}`
+	if err := json.Unmarshal([]byte(body), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerified || user.VerificationToken != "" {
+		t.Errorf("Expected verification fields to be ignored, got %+v", user)
+	}
+}
@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"MovieVerse/logging"
+	"MovieVerse/models"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const resetTokenTTL = time.Hour
+
+const forgotPasswordMessage = "If an account with that email exists, a password reset link has been sent."
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	collection := database().Collection("users")
+	var user models.User
+	err := collection.FindOne(r.Context(), bson.M{"email": email}).Decode(&user)
+	if err == nil {
+		token, err := generateVerificationToken()
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed to generate reset token: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		update := bson.M{"$set": bson.M{
+			"reset_token_hash":    hashToken(token),
+			"reset_token_expires": time.Now().Add(resetTokenTTL),
+		}}
+		if _, err := collection.UpdateOne(r.Context(), bson.M{"_id": user.ID}, update); err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed to store reset token: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		// Sent in the background so the response time does not reveal
+		// whether the address belongs to an account. The request context is
+		// cancelled once the response is written, so only its values are
+		// kept.
+		ctx := context.WithoutCancel(r.Context())
+		go func() {
+			if err := sendPasswordResetEmail(ctx, user.Email, token); err != nil {
+				logging.FromContext(ctx).Errorf("Failed to send password reset email: %v", err)
+			}
+		}()
+	} else if err != mongo.ErrNoDocuments {
+		logging.FromContext(r.Context()).Errorf("Error finding user: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": forgotPasswordMessage})
+}
+
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		http.Error(w, "Reset token is required", http.StatusBadRequest)
+		return
+	}
+
+	collection := database().Collection("users")
+	filter := bson.M{
+		"reset_token_hash":    hashToken(req.Token),
+		"reset_token_expires": bson.M{"$gt": time.Now()},
+	}
+	var user models.User
+	if err := collection.FindOne(r.Context(), filter).Decode(&user); err != nil {
+		if err != mongo.ErrNoDocuments {
+			logging.FromContext(r.Context()).Errorf("Error finding user: %v", err)
+		}
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err := passwordPolicy.Validate(req.Password, user.Email, user.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := passwordPolicy.Hash(req.Password)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to hash password: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Matching on the token hash again and clearing it in the same update
+	// makes the token single-use even under concurrent requests. Bumping the
+	// token version invalidates every JWT issued before the reset, and proving
+	// ownership of the mailbox also lifts any lockout.
+	filter["_id"] = user.ID
+	update := bson.M{
+		"$set": bson.M{"password": hashedPassword, "failed_logins": 0},
+		"$unset": bson.M{
+			"reset_token_hash":     "",
+			"reset_token_expires":  "",
+			"locked_until":         "",
+			"unlock_token_hash":    "",
+			"unlock_token_expires": "",
+			"last_failed_login":    "",
+		},
+		"$inc": bson.M{"token_version": 1},
+	}
+	result, err := collection.UpdateOne(r.Context(), filter, update)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to reset password: %v", err)
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	if result.ModifiedCount == 0 {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset. Please log in with your new password."})
+}
+
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	collection := database().Collection("users")
+	var user models.User
+	if err := collection.FindOne(r.Context(), bson.M{"_id": claims.UserID}).Decode(&user); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)); err != nil {
+		http.Error(w, "Current password is incorrect", http.StatusUnauthorized)
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		http.Error(w, "New password must be different from the current password", http.StatusBadRequest)
+		return
+	}
+	if err := passwordPolicy.Validate(req.NewPassword, user.Email, user.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := passwordPolicy.Hash(req.NewPassword)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to hash password: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	update := bson.M{
+		"$set": bson.M{"password": hashedPassword},
+		"$inc": bson.M{"token_version": 1},
+	}
+	result, err := collection.UpdateOne(r.Context(), bson.M{"_id": user.ID, "password": user.Password}, update)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to change password: %v", err)
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	if result.ModifiedCount == 0 {
+		http.Error(w, "Password was changed concurrently, please try again", http.StatusConflict)
+		return
+	}
+
+	// Other sessions are signed out by the version bump; the caller gets a
+	// fresh token so this one stays logged in.
+	user.TokenVersion++
+	tokenString, err := issueToken(user, claims.MFA)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to sign token: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password changed successfully",
+		"token":   tokenString,
+	})
+}
+
+func sendPasswordResetEmail(ctx context.Context, email, token string) error {
+	resetURL := publicURL + "/reset-password.html?token=" + token
+	body := "A password reset was requested for your MovieVerse account.\n\n" +
+		"Reset your password using this link within the next hour: " + resetURL + "\n\n" +
+		"If you did not request this, you can ignore this email."
+	if err := sendEmail(ctx, email, "MovieVerse - Password Reset", body); err != nil {
+		return err
+	}
+	logging.Logger().Infof("Password reset email sent to %s", email)
+	return nil
+}
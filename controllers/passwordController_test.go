@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"MovieVerse/models"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetPassword(token, password string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"token":"` + token + `","password":"` + password + `"}`)
+	ResetPassword(rec, httptest.NewRequest(http.MethodPost, "/password/reset", body))
+	return rec
+}
+
+func TestForgotPassword_LiveStoresExpiringTokenHash(t *testing.T) {
+	db := liveDatabase(t)
+	user := insertUser(t, db, models.User{Email: "fan@example.com"}, "Correct-Horse-42", bcrypt.MinCost)
+
+	rec := httptest.NewRecorder()
+	ForgotPassword(rec, httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(`{"email":"fan@example.com"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	stored := findUser(t, db, user.ID)
+	if stored.ResetTokenHash == "" {
+		t.Fatal("Expected a reset token hash to be stored")
+	}
+	if until := time.Until(stored.ResetTokenExpires); until <= 0 || until > resetTokenTTL {
+		t.Errorf("Expected the token to expire within %v, got %v", resetTokenTTL, until)
+	}
+}
+
+func TestResetPassword_LiveIsSingleUseAndRevokesSessions(t *testing.T) {
+	db := liveDatabase(t)
+	user := insertUser(t, db, models.User{
+		Email:             "fan@example.com",
+		TokenVersion:      2,
+		ResetTokenHash:    hashToken("reset-token"),
+		ResetTokenExpires: time.Now().Add(resetTokenTTL),
+	}, "Correct-Horse-42", bcrypt.MinCost)
+
+	if rec := resetPassword("reset-token", "Battery-Staple-77"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the reset to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	stored := findUser(t, db, user.ID)
+	if bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte("Battery-Staple-77")) != nil {
+		t.Error("Expected the new password to be stored")
+	}
+	if stored.TokenVersion != 3 {
+		t.Errorf("Expected existing sessions to be revoked, got token version %d", stored.TokenVersion)
+	}
+	if stored.ResetTokenHash != "" {
+		t.Error("Expected the reset token to be cleared")
+	}
+
+	if rec := resetPassword("reset-token", "Another-Horse-99"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the token to work only once, got %d", rec.Code)
+	}
+}
+
+func TestResetPassword_LiveRejectsExpiredToken(t *testing.T) {
+	db := liveDatabase(t)
+	user := insertUser(t, db, models.User{
+		Email:             "fan@example.com",
+		ResetTokenHash:    hashToken("reset-token"),
+		ResetTokenExpires: time.Now().Add(-time.Minute),
+	}, "Correct-Horse-42", bcrypt.MinCost)
+
+	if rec := resetPassword("reset-token", "Battery-Staple-77"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the expired token to be rejected, got %d", rec.Code)
+	}
+	if stored := findUser(t, db, user.ID); bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte("Correct-Horse-42")) != nil {
+		t.Error("Expected the password to be left alone")
+	}
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+)
+
+// PasswordPolicy decides which passwords are accepted at signup, reset and
+// change, and which bcrypt cost new hashes are created with.
+type PasswordPolicy struct {
+	MinLength  int
+	MaxLength  int
+	BcryptCost int
+	breached   map[string]struct{}
+}
+
+var (
+	ErrPasswordTooShort       = errors.New("password is too short")
+	ErrPasswordTooLong        = errors.New("password is too long")
+	ErrPasswordBreached       = errors.New("password appears in a list of breached passwords")
+	ErrPasswordMatchesAccount = errors.New("password must not match your email or username")
+)
+
+// commonBreachedPasswords is used when no breached-password list is
+// configured, so the most common leaked passwords are always rejected.
+var commonBreachedPasswords = []string{
+	"123456", "123456789", "12345678", "1234567890", "password", "password1",
+	"password123", "qwerty", "qwerty123", "qwertyuiop", "111111", "11111111",
+	"123123", "abc123", "iloveyou", "admin", "admin123", "welcome", "welcome1",
+	"letmein", "monkey", "dragon", "football", "baseball", "sunshine",
+	"princess", "trustno1", "1q2w3e4r", "zaq12wsx", "passw0rd", "000000",
+	"superman", "starwars", "master", "shadow", "michael", "movieverse",
+}
+
+var passwordPolicy = DefaultPasswordPolicy()
+
+func DefaultPasswordPolicy() PasswordPolicy {
+	policy := PasswordPolicy{
+		MinLength:  8,
+		MaxLength:  72,
+		BcryptCost: bcrypt.DefaultCost,
+		breached:   make(map[string]struct{}),
+	}
+	policy.AddBreached(commonBreachedPasswords...)
+	return policy
+}
+
+func SetPasswordPolicy(policy PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+// PasswordSettings are the configurable parts of a PasswordPolicy.
+type PasswordSettings struct {
+	MinLength  int
+	MaxLength  int
+	BcryptCost int
+	// BreachedList is a file with one password per line, rejected on top of
+	// the built-in list.
+	BreachedList string
+}
+
+// LoadPasswordPolicy builds a policy from settings, reading the breached
+// password list if one is given.
+func LoadPasswordPolicy(settings PasswordSettings) (PasswordPolicy, error) {
+	policy := DefaultPasswordPolicy()
+	policy.MinLength = settings.MinLength
+	policy.MaxLength = settings.MaxLength
+	policy.BcryptCost = settings.BcryptCost
+	if settings.BreachedList != "" {
+		if err := policy.LoadBreachedList(settings.BreachedList); err != nil {
+			return policy, err
+		}
+	}
+	return policy, policy.check()
+}
+
+func (p PasswordPolicy) check() error {
+	if p.MinLength < 1 {
+		return fmt.Errorf("password min length must be at least 1, got %d", p.MinLength)
+	}
+	if p.MaxLength < p.MinLength || p.MaxLength > 72 {
+		return fmt.Errorf("password max length must be between %d and 72, got %d", p.MinLength, p.MaxLength)
+	}
+	if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, p.BcryptCost)
+	}
+	return nil
+}
+
+func (p *PasswordPolicy) AddBreached(passwords ...string) {
+	if p.breached == nil {
+		p.breached = make(map[string]struct{})
+	}
+	for _, password := range passwords {
+		p.breached[strings.ToLower(password)] = struct{}{}
+	}
+}
+
+func (p *PasswordPolicy) LoadBreachedList(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open breached password list: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.AddBreached(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read breached password list: %w", err)
+	}
+	return nil
+}
+
+// Validate returns one of the ErrPassword* errors when password is not
+// acceptable for the account identified by email and username.
+func (p PasswordPolicy) Validate(password, email, username string) error {
+	length := len([]rune(password))
+	if length < p.MinLength {
+		return fmt.Errorf("%w: at least %d characters required", ErrPasswordTooShort, p.MinLength)
+	}
+	if length > p.MaxLength || len(password) > 72 {
+		return fmt.Errorf("%w: at most %d characters allowed", ErrPasswordTooLong, p.MaxLength)
+	}
+	lower := strings.ToLower(password)
+	if _, found := p.breached[lower]; found {
+		return ErrPasswordBreached
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	localPart, _, _ := strings.Cut(email, "@")
+	for _, identity := range []string{email, localPart, strings.ToLower(strings.TrimSpace(username))} {
+		if identity != "" && lower == identity {
+			return ErrPasswordMatchesAccount
+		}
+	}
+	return nil
+}
+
+func (p PasswordPolicy) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// NeedsRehash reports whether hash was created with a lower bcrypt cost than
+// the policy currently requires.
+func (p PasswordPolicy) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost < p.BcryptCost
+}
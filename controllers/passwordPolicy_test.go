@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordPolicy_Validate(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+
+	tests := []struct {
+		name     string
+		password string
+		want     error
+	}{
+		{"valid", "Correct-Horse-42", nil},
+		{"too short", "abc12", ErrPasswordTooShort},
+		{"empty", "", ErrPasswordTooShort},
+		{"too long", string(make([]byte, 73)), ErrPasswordTooLong},
+		{"breached", "Password123", ErrPasswordBreached},
+		{"equals email", "film.lover@example.com", ErrPasswordMatchesAccount},
+		{"equals email local part", "Film.Lover", ErrPasswordMatchesAccount},
+		{"equals username", "cinephile99", ErrPasswordMatchesAccount},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Validate(tt.password, "film.lover@example.com", "cinephile99")
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Validate(%q) = %v, want %v", tt.password, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicy_LoadBreachedList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte("hunter2hunter2\n\n  Tr0ub4dor&3  \n"), 0600); err != nil {
+		t.Fatalf("Failed to write list: %v", err)
+	}
+
+	policy := DefaultPasswordPolicy()
+	if err := policy.LoadBreachedList(path); err != nil {
+		t.Fatalf("LoadBreachedList returned error: %v", err)
+	}
+	for _, password := range []string{"hunter2hunter2", "tr0ub4dor&3"} {
+		if err := policy.Validate(password, "a@example.com", "a"); !errors.Is(err, ErrPasswordBreached) {
+			t.Errorf("Validate(%q) = %v, want %v", password, err, ErrPasswordBreached)
+		}
+	}
+}
+
+func TestPasswordPolicy_NeedsRehash(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+	policy.BcryptCost = bcrypt.MinCost + 1
+
+	oldHash, _ := bcrypt.GenerateFromPassword([]byte("Correct-Horse-42"), bcrypt.MinCost)
+	if !policy.NeedsRehash(string(oldHash)) {
+		t.Error("Expected hash with lower cost to need rehash")
+	}
+
+	newHash, err := policy.Hash("Correct-Horse-42")
+	if err != nil {
+		t.Fatalf("Hash returned error: %v", err)
+	}
+	if policy.NeedsRehash(newHash) {
+		t.Error("Expected hash with current cost not to need rehash")
+	}
+}
+
+func TestLoadPasswordPolicy_RejectsInvalidCost(t *testing.T) {
+	if _, err := LoadPasswordPolicy(PasswordSettings{MinLength: 8, MaxLength: 72, BcryptCost: 2}); err == nil {
+		t.Error("Expected error for bcrypt cost below minimum")
+	}
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"MovieVerse/logging"
+	"MovieVerse/models"
+	"context"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	RoleViewer        = "viewer"
+	RoleCustomer      = "customer"
+	RoleSupportAgent  = "support_agent"
+	RoleCatalogEditor = "catalog_editor"
+	RoleFinance       = "finance"
+	RoleSuperAdmin    = "super_admin"
+)
+
+const (
+	PermMoviesRead     = "movies:read"
+	PermMoviesWrite    = "movies:write"
+	PermOrdersCreate   = "orders:create"
+	PermOrdersRead     = "orders:read"
+	PermOrdersRefund   = "orders:refund"
+	PermChatsUse       = "chats:use"
+	PermChatsRead      = "chats:read"
+	PermChatsModerate  = "chats:moderate"
+	PermAnalyticsRead  = "analytics:read"
+	PermActivityRead   = "activity:read"
+	PermAuditRead      = "audit:read"
+	PermUsersRead      = "users:read"
+	PermUsersManage    = "users:manage"
+	PermRolesAssign    = "roles:assign"
+	PermAdminDashboard = "admin:dashboard"
+)
+
+var rolePermissions = map[string][]string{
+	RoleViewer:        {PermMoviesRead},
+	RoleCustomer:      {PermMoviesRead, PermOrdersCreate, PermChatsUse},
+	RoleSupportAgent:  {PermMoviesRead, PermChatsUse, PermChatsRead, PermChatsModerate, PermUsersRead, PermActivityRead, PermAdminDashboard},
+	RoleCatalogEditor: {PermMoviesRead, PermMoviesWrite, PermAdminDashboard},
+	RoleFinance:       {PermMoviesRead, PermOrdersRead, PermOrdersRefund, PermAnalyticsRead, PermAdminDashboard},
+	RoleSuperAdmin:    {"*"},
+}
+
+// userRoles returns the roles to enforce for a user. Accounts created before
+// roles existed only carry the legacy admin flag.
+func userRoles(user models.User) []string {
+	if len(user.Roles) > 0 {
+		return user.Roles
+	}
+	if user.Admin {
+		return []string{RoleSuperAdmin}
+	}
+	return []string{RoleCustomer}
+}
+
+func hasPermission(roles []string, permission string) bool {
+	for _, role := range roles {
+		for _, granted := range rolePermissions[role] {
+			if granted == "*" || granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether the session's roles grant permission, for
+// handlers that decide access per resource rather than per route.
+func (c *Claims) HasPermission(permission string) bool {
+	return hasPermission(c.Roles, permission)
+}
+
+// UserHasPermission looks up a user's current roles and reports whether
+// they grant permission.
+func UserHasPermission(ctx context.Context, userID primitive.ObjectID, permission string) (bool, error) {
+	var user models.User
+	err := database().Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return hasPermission(userRoles(user), permission), nil
+}
+
+// isStaff reports whether the roles grant access to the admin dashboard;
+// staff accounts are the ones two-factor enforcement applies to.
+func isStaff(roles []string) bool {
+	return hasPermission(roles, PermAdminDashboard)
+}
+
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value("user").(*Claims)
+			if !ok || !hasPermission(claims.Roles, permission) {
+				http.Error(w, "Access denied: missing permission "+permission, http.StatusForbidden)
+				return
+			}
+			if requireAdminTwoFactor && isStaff(claims.Roles) && !claims.MFA {
+				http.Error(w, "Access denied: two-factor authentication is required for staff accounts", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles := make([]string, 0, len(rolePermissions))
+	for role := range rolePermissions {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	response := make([]map[string]interface{}, 0, len(roles))
+	for _, role := range roles {
+		response = append(response, map[string]interface{}{
+			"role":        role,
+			"permissions": rolePermissions[role],
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func AssignRoles(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		UserID string   `json:"user_id"`
+		Roles  []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	userID, err := primitive.ObjectIDFromHex(req.UserID)
+	if err != nil {
+		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+		return
+	}
+	if userID == claims.UserID {
+		http.Error(w, "You cannot change your own roles", http.StatusForbidden)
+		return
+	}
+	if len(req.Roles) == 0 {
+		http.Error(w, "At least one role is required", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool)
+	roles := make([]string, 0, len(req.Roles))
+	for _, role := range req.Roles {
+		role = strings.TrimSpace(role)
+		if _, known := rolePermissions[role]; !known {
+			http.Error(w, "Unknown role: "+role, http.StatusBadRequest)
+			return
+		}
+		if !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	if seen[RoleSuperAdmin] && !hasPermission(claims.Roles, "*") {
+		http.Error(w, "Only super admins can grant the super_admin role", http.StatusForbidden)
+		return
+	}
+
+	collection := database().Collection("users")
+	result, err := collection.UpdateOne(r.Context(), bson.M{"_id": userID}, bson.M{"$set": bson.M{"roles": roles, "admin": false}})
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to assign roles: %v", err)
+		http.Error(w, "Failed to assign roles", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	LogUserActivity(r.Context(), claims.UserID, "roles_assigned", req.UserID+": "+strings.Join(roles, ","))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Roles updated",
+		"user_id": req.UserID,
+		"roles":   roles,
+	})
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"MovieVerse/models"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserRoles_MapsLegacyAdminFlag(t *testing.T) {
+	if roles := userRoles(models.User{Admin: true}); len(roles) != 1 || roles[0] != RoleSuperAdmin {
+		t.Errorf("Expected legacy admin to be super admin, got %v", roles)
+	}
+	if roles := userRoles(models.User{}); len(roles) != 1 || roles[0] != RoleCustomer {
+		t.Errorf("Expected legacy user to be customer, got %v", roles)
+	}
+	if roles := userRoles(models.User{Admin: true, Roles: []string{RoleFinance}}); len(roles) != 1 || roles[0] != RoleFinance {
+		t.Errorf("Expected explicit roles to win over legacy flag, got %v", roles)
+	}
+}
+
+func TestHasPermission(t *testing.T) {
+	tests := []struct {
+		roles      []string
+		permission string
+		want       bool
+	}{
+		{[]string{RoleCustomer}, PermOrdersCreate, true},
+		{[]string{RoleCustomer}, PermMoviesWrite, false},
+		{[]string{RoleCatalogEditor}, PermMoviesWrite, true},
+		{[]string{RoleCatalogEditor}, PermOrdersRefund, false},
+		{[]string{RoleFinance}, PermOrdersRefund, true},
+		{[]string{RoleSupportAgent}, PermChatsModerate, true},
+		{[]string{RoleViewer, RoleFinance}, PermAnalyticsRead, true},
+		{[]string{RoleSuperAdmin}, PermRolesAssign, true},
+		{[]string{"unknown"}, PermMoviesRead, false},
+		{nil, PermMoviesRead, false},
+	}
+	for _, tt := range tests {
+		if got := hasPermission(tt.roles, tt.permission); got != tt.want {
+			t.Errorf("hasPermission(%v, %q) = %v, want %v", tt.roles, tt.permission, got, tt.want)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	handler := RequirePermission(PermMoviesWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(claims *Claims) int {
+		req := httptest.NewRequest(http.MethodPost, "/movies", nil)
+		if claims != nil {
+			req = req.WithContext(context.WithValue(req.Context(), "user", claims))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := serve(nil); code != http.StatusForbidden {
+		t.Errorf("Expected anonymous request to be forbidden, got %d", code)
+	}
+	if code := serve(&Claims{Roles: []string{RoleCustomer}}); code != http.StatusForbidden {
+		t.Errorf("Expected customer to be forbidden, got %d", code)
+	}
+	if code := serve(&Claims{Roles: []string{RoleCatalogEditor}}); code != http.StatusNoContent {
+		t.Errorf("Expected catalog editor to be allowed, got %d", code)
+	}
+
+	SetRequireAdminTwoFactor(true)
+	defer SetRequireAdminTwoFactor(false)
+	if code := serve(&Claims{Roles: []string{RoleCatalogEditor}}); code != http.StatusForbidden {
+		t.Errorf("Expected staff without 2FA to be forbidden, got %d", code)
+	}
+	if code := serve(&Claims{Roles: []string{RoleCatalogEditor}, MFA: true}); code != http.StatusNoContent {
+		t.Errorf("Expected staff with 2FA to be allowed, got %d", code)
+	}
+}
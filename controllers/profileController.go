@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"MovieVerse/logging"
+	"MovieVerse/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	emailChangeTTL    = 24 * time.Hour
+	maxAvatarSize     = 2 << 20
+	minUsernameLength = 3
+	maxUsernameLength = 32
+)
+
+var avatarDir = "static/avatars"
+
+var avatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+func GetProfile(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toProfile(user))
+}
+
+func UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username *string `json:"username"`
+		Email    *string `json:"email"`
+		// An email change must be confirmed like a password change,
+		// since whoever controls the address can reset the password.
+		CurrentPassword string `json:"current_password"`
+		Code            string `json:"code"`
+		RecoveryCode    string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	changingEmail := req.Email != nil && !strings.EqualFold(strings.TrimSpace(*req.Email), user.Email)
+	if changingEmail {
+		if user.Password == "" && !user.TOTPEnabled {
+			http.Error(w, "Set a password through the password reset flow before changing your email address", http.StatusForbidden)
+			return
+		}
+		if user.Password != "" {
+			if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)); err != nil {
+				http.Error(w, "Current password is incorrect", http.StatusUnauthorized)
+				return
+			}
+		}
+		if user.TOTPEnabled && !verifySecondFactor(r.Context(), user, req.Code, req.RecoveryCode) {
+			http.Error(w, "Invalid verification code", http.StatusUnauthorized)
+			return
+		}
+	}
+	collection := database().Collection("users")
+	message := "Profile updated"
+
+	if req.Username != nil {
+		username := strings.TrimSpace(*req.Username)
+		if n := len([]rune(username)); n < minUsernameLength || n > maxUsernameLength {
+			http.Error(w, fmt.Sprintf("Username must be between %d and %d characters", minUsernameLength, maxUsernameLength), http.StatusBadRequest)
+			return
+		}
+		if _, err := collection.UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"username": username}}); err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed to update username: %v", err)
+			http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+			return
+		}
+		user.Username = username
+	}
+
+	if changingEmail {
+		address, err := mail.ParseAddress(strings.TrimSpace(*req.Email))
+		if err != nil || address.Name != "" {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		newEmail := address.Address
+		count, err := collection.CountDocuments(r.Context(), bson.M{"email": newEmail})
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed to check email: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if count > 0 {
+			http.Error(w, "Email already exists", http.StatusBadRequest)
+			return
+		}
+		token, err := generateVerificationToken()
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed to generate email change token: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		update := bson.M{"$set": bson.M{
+			"pending_email":       newEmail,
+			"email_change_hash":   hashToken(token),
+			"email_change_expiry": time.Now().Add(emailChangeTTL),
+		}}
+		if _, err := collection.UpdateOne(r.Context(), bson.M{"_id": user.ID}, update); err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed to store pending email: %v", err)
+			http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+			return
+		}
+		if err := sendEmailChangeVerification(r.Context(), newEmail, token); err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed to send email change verification: %v", err)
+			http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+			return
+		}
+		// The request context is cancelled once the response is written.
+		ctx := context.WithoutCancel(r.Context())
+		go func(oldEmail string) {
+			body := "A change of the email address on your MovieVerse account to " + newEmail + " was requested.\n\n" +
+				"If this was not you, reset your password immediately."
+			if err := sendEmail(ctx, oldEmail, "MovieVerse - Email Change Requested", body); err != nil {
+				logging.FromContext(ctx).Errorf("Failed to notify previous email address: %v", err)
+			}
+		}(user.Email)
+		user.PendingEmail = newEmail
+		message = "Profile updated. Check your new email address to confirm the change."
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": message,
+		"profile": toProfile(user),
+	})
+}
+
+func VerifyEmailChange(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Verification token is required", http.StatusBadRequest)
+		return
+	}
+	collection := database().Collection("users")
+	var user models.User
+	err := collection.FindOne(r.Context(), bson.M{
+		"email_change_hash":   hashToken(token),
+		"email_change_expiry": bson.M{"$gt": time.Now()},
+	}).Decode(&user)
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	count, err := collection.CountDocuments(r.Context(), bson.M{"email": user.PendingEmail})
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to check email: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		http.Error(w, "Email already exists", http.StatusConflict)
+		return
+	}
+	update := bson.M{
+		"$set":   bson.M{"email": user.PendingEmail, "email_verified": true},
+		"$unset": bson.M{"pending_email": "", "email_change_hash": "", "email_change_expiry": ""},
+	}
+	_, err = collection.UpdateOne(r.Context(), bson.M{"_id": user.ID, "email_change_hash": user.EmailChangeHash}, update)
+	if mongo.IsDuplicateKeyError(err) {
+		http.Error(w, "Email already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to change email: %v", err)
+		http.Error(w, "Failed to change email", http.StatusInternalServerError)
+		return
+	}
+	LogUserActivity(r.Context(), user.ID, "email_changed", user.Email+" -> "+user.PendingEmail)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email address changed successfully."})
+}
+
+func UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+1024)
+	if err := r.ParseMultipartForm(maxAvatarSize); err != nil {
+		http.Error(w, "Avatar must be an image of at most 2 MB", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		http.Error(w, "Missing avatar file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+	if err != nil || len(data) > maxAvatarSize {
+		http.Error(w, "Avatar must be an image of at most 2 MB", http.StatusBadRequest)
+		return
+	}
+	ext, ok := avatarExtensions[http.DetectContentType(data)]
+	if !ok {
+		http.Error(w, "Avatar must be a PNG, JPEG, GIF or WebP image", http.StatusBadRequest)
+		return
+	}
+
+	if err := os.MkdirAll(avatarDir, 0755); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to create avatar directory: %v", err)
+		http.Error(w, "Failed to store avatar", http.StatusInternalServerError)
+		return
+	}
+	for _, other := range avatarExtensions {
+		if other != ext {
+			os.Remove(filepath.Join(avatarDir, user.ID.Hex()+other))
+		}
+	}
+	name := user.ID.Hex() + ext
+	if err := os.WriteFile(filepath.Join(avatarDir, name), data, 0644); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to write avatar: %v", err)
+		http.Error(w, "Failed to store avatar", http.StatusInternalServerError)
+		return
+	}
+
+	user.AvatarURL = fmt.Sprintf("/static/avatars/%s?v=%d", name, time.Now().Unix())
+	collection := database().Collection("users")
+	if _, err := collection.UpdateOne(r.Context(), bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"avatar_url": user.AvatarURL}}); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to store avatar URL: %v", err)
+		http.Error(w, "Failed to store avatar", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toProfile(user))
+}
+
+func sendEmailChangeVerification(ctx context.Context, email, token string) error {
+	verificationURL := publicURL + "/verify-email-change?token=" + token
+	if err := sendEmail(ctx, email, "MovieVerse - Confirm Email Change", "Confirm your new email address by clicking the link: "+verificationURL); err != nil {
+		return err
+	}
+	logging.Logger().Infof("Email change verification sent to %s", email)
+	return nil
+}
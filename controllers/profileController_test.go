@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"MovieVerse/models"
+	"context"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestToProfile_NeverSerializesSecrets(t *testing.T) {
+	user := models.User{
+		ID:                primitive.NewObjectID(),
+		Email:             "fan@example.com",
+		Username:          "fan",
+		Password:          "$2a$10$secrethash",
+		VerificationToken: "verify-token",
+		ResetTokenHash:    "reset-hash",
+		TOTPSecret:        "TOTPSECRET",
+		TOTPEnabled:       true,
+		RecoveryCodes:     []string{"recovery-hash"},
+		UnlockTokenHash:   "unlock-hash",
+		EmailChangeHash:   "change-hash",
+		Roles:             []string{RoleFinance},
+	}
+	body, err := json.Marshal(toProfile(user))
+	if err != nil {
+		t.Fatalf("Failed to marshal profile: %v", err)
+	}
+	for _, secret := range []string{"secrethash", "verify-token", "reset-hash", "TOTPSECRET", "recovery-hash", "unlock-hash", "change-hash"} {
+		if strings.Contains(string(body), secret) {
+			t.Errorf("Profile JSON leaks %q: %s", secret, body)
+		}
+	}
+
+	var profile map[string]interface{}
+	json.Unmarshal(body, &profile)
+	if profile["email"] != "fan@example.com" || profile["two_factor_enabled"] != true {
+		t.Errorf("Unexpected profile: %s", body)
+	}
+	if roles, _ := profile["roles"].([]interface{}); len(roles) != 1 || roles[0] != RoleFinance {
+		t.Errorf("Unexpected roles: %v", profile["roles"])
+	}
+}
+
+func TestUpdateProfile_LiveEmailChangeRequiresPassword(t *testing.T) {
+	db := liveDatabase(t)
+	withPassword := insertUser(t, db, models.User{Email: "fan@example.com"}, "Correct-Horse-42", bcrypt.MinCost)
+	passwordless := insertUser(t, db, models.User{Email: "sso@example.com"}, "unused", bcrypt.MinCost)
+	db.Collection("users").UpdateOne(context.Background(), bson.M{"_id": passwordless.ID}, bson.M{"$set": bson.M{"password": ""}})
+
+	update := func(user models.User, body string) int {
+		r := httptest.NewRequest(http.MethodPut, "/profile", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), "user", &Claims{UserID: user.ID}))
+		rr := httptest.NewRecorder()
+		UpdateProfile(rr, r)
+		return rr.Code
+	}
+	if code := update(withPassword, `{"email":"attacker@example.com"}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected an email change without the password to be refused, got %d", code)
+	}
+	if code := update(withPassword, `{"email":"attacker@example.com","current_password":"wrong"}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be refused, got %d", code)
+	}
+	if code := update(passwordless, `{"email":"attacker@example.com"}`); code != http.StatusForbidden {
+		t.Errorf("Expected an account with nothing to confirm with to be refused, got %d", code)
+	}
+	if code := update(withPassword, `{"username":"moviefan"}`); code != http.StatusOK {
+		t.Errorf("Expected other profile changes to need no password, got %d", code)
+	}
+	if stored := findUser(t, db, withPassword.ID); stored.PendingEmail != "" {
+		t.Errorf("Expected no pending email change, got %q", stored.PendingEmail)
+	}
+}
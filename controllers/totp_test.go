@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode_RFC6238Vectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret returned error: %v", err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Unix(1700000000, 0)
+	step := now.Unix() / totpPeriod
+
+	if got, ok := validateTOTP(secret, totpCode(key, step), now, 0); !ok || got != step {
+		t.Errorf("Expected current code to be valid at step %d, got %d, %v", step, got, ok)
+	}
+	if _, ok := validateTOTP(secret, totpCode(key, step-1), now, 0); !ok {
+		t.Error("Expected previous step to be accepted within skew")
+	}
+	if _, ok := validateTOTP(secret, totpCode(key, step-2), now, 0); ok {
+		t.Error("Expected code two steps old to be rejected")
+	}
+	if _, ok := validateTOTP(secret, totpCode(key, step), now, step); ok {
+		t.Error("Expected replayed code to be rejected")
+	}
+	if _, ok := validateTOTP(secret, "12345", now, 0); ok {
+		t.Error("Expected malformed code to be rejected")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(totpProvisioningURI("JBSWY3DPEHPK3PXP", "fan@example.com"))
+	if err != nil {
+		t.Fatalf("Failed to parse URI: %v", err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" {
+		t.Errorf("Unexpected URI prefix: %s", uri)
+	}
+	if uri.Path != "/MovieVerse:fan@example.com" {
+		t.Errorf("Unexpected label: %s", uri.Path)
+	}
+	if uri.Query().Get("secret") != "JBSWY3DPEHPK3PXP" || uri.Query().Get("issuer") != "MovieVerse" {
+		t.Errorf("Unexpected query: %s", uri.RawQuery)
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("generateRecoveryCodes returned error: %v", err)
+	}
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if len(code) != 9 || code[4] != '-' {
+			t.Errorf("Unexpected recovery code format: %q", code)
+		}
+		if seen[code] {
+			t.Errorf("Duplicate recovery code: %q", code)
+		}
+		seen[code] = true
+		if hashRecoveryCode(strings.ToUpper(strings.Replace(code, "-", "", 1))) != hashes[i] {
+			t.Errorf("Expected hash of %q to ignore case and dashes", code)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package controllers
+
+import (
+	"MovieVerse/logging"
+	"MovieVerse/metrics"
+	"MovieVerse/models"
+	"context"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"time"
+)
+
+const (
+	twoFactorChallengePurpose = "2fa_challenge"
+	twoFactorChallengeTTL     = 5 * time.Minute
+	recoveryCodeCount         = 10
+)
+
+var requireAdminTwoFactor bool
+
+// SetRequireAdminTwoFactor makes RequirePermission reject staff sessions
+// that were not established with a second factor.
+func SetRequireAdminTwoFactor(required bool) {
+	requireAdminTwoFactor = required
+}
+
+func issueTwoFactorChallenge(user models.User) (string, error) {
+	claims := &Claims{
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
+		Purpose:      twoFactorChallengePurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(twoFactorChallengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+func currentUser(r *http.Request) (models.User, bool) {
+	var user models.User
+	claims, ok := r.Context().Value("user").(*Claims)
+	if !ok {
+		return user, false
+	}
+	collection := database().Collection("users")
+	if err := collection.FindOne(r.Context(), bson.M{"_id": claims.UserID}).Decode(&user); err != nil {
+		return user, false
+	}
+	return user, true
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code
+// and consumes it.
+func verifySecondFactor(ctx context.Context, user models.User, code, recoveryCode string) bool {
+	collection := database().Collection("users")
+	if recoveryCode != "" {
+		hash := hashRecoveryCode(recoveryCode)
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": user.ID, "recovery_codes": hash},
+			bson.M{"$pull": bson.M{"recovery_codes": hash}})
+		if err != nil {
+			logging.Logger().Errorf("Failed to consume recovery code: %v", err)
+			return false
+		}
+		return result.ModifiedCount == 1
+	}
+	step, ok := validateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false
+	}
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": user.ID, "totp_last_step": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"totp_last_step": step}})
+	if err != nil {
+		logging.Logger().Errorf("Failed to record TOTP step: %v", err)
+		return false
+	}
+	return result.ModifiedCount == 1
+}
+
+func EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to generate TOTP secret: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	collection := database().Collection("users")
+	update := bson.M{"$set": bson.M{"totp_secret": secret, "totp_enabled": false, "totp_last_step": 0}}
+	if _, err := collection.UpdateOne(r.Context(), bson.M{"_id": user.ID}, update); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to store TOTP secret: %v", err)
+		http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(secret, user.Email),
+	})
+}
+
+func VerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "Start enrollment before verifying", http.StatusBadRequest)
+		return
+	}
+	step, valid := validateTOTP(user.TOTPSecret, req.Code, time.Now(), user.TOTPLastStep)
+	if !valid {
+		http.Error(w, "Invalid verification code", http.StatusUnauthorized)
+		return
+	}
+	codes, hashes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to generate recovery codes: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	collection := database().Collection("users")
+	update := bson.M{"$set": bson.M{"totp_enabled": true, "totp_last_step": step, "recovery_codes": hashes}}
+	if _, err := collection.UpdateOne(r.Context(), bson.M{"_id": user.ID}, update); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to enable two-factor authentication: %v", err)
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	LogUserActivity(r.Context(), user.ID, "2fa_enabled", "")
+
+	tokenString, err := issueToken(user, true)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to sign token: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Two-factor authentication enabled. Store your recovery codes somewhere safe.",
+		"recovery_codes": codes,
+		"token":          tokenString,
+	})
+}
+
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if !user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	}
+	if !verifySecondFactor(r.Context(), user, req.Code, req.RecoveryCode) {
+		http.Error(w, "Invalid verification code", http.StatusUnauthorized)
+		return
+	}
+	collection := database().Collection("users")
+	update := bson.M{
+		"$set":   bson.M{"totp_enabled": false},
+		"$unset": bson.M{"totp_secret": "", "totp_last_step": "", "recovery_codes": ""},
+	}
+	if _, err := collection.UpdateOne(r.Context(), bson.M{"_id": user.ID}, update); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to disable two-factor authentication: %v", err)
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	LogUserActivity(r.Context(), user.ID, "2fa_disabled", "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// LoginTwoFactor exchanges the challenge returned by LoginUser plus a TOTP or
+// recovery code for a session token.
+func LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(req.Challenge, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+	if err != nil || !token.Valid || claims.Purpose != twoFactorChallengePurpose {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	collection := database().Collection("users")
+	var user models.User
+	if err := collection.FindOne(r.Context(), bson.M{"_id": claims.UserID}).Decode(&user); err != nil {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	if user.TokenVersion != claims.TokenVersion || !user.TOTPEnabled {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	if user.LockedUntil.After(time.Now()) {
+		metrics.FailedLogins.WithLabelValues(metrics.LoginLocked).Inc()
+		http.Error(w, "Account is temporarily locked. Check your email for an unlock link.", http.StatusLocked)
+		return
+	}
+	if !verifySecondFactor(r.Context(), user, req.Code, req.RecoveryCode) {
+		recordAccountFailure(r.Context(), user, clientIP(r))
+		metrics.FailedLogins.WithLabelValues(metrics.LoginBadSecondFactor).Inc()
+		http.Error(w, "Invalid verification code", http.StatusUnauthorized)
+		return
+	}
+
+	tokenString, err := issueToken(user, true)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to sign token: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	LogUserActivity(r.Context(), user.ID, ActivityLogin, clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	roles := userRoles(user)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Login successful",
+		"token":   tokenString,
+		"admin":   isStaff(roles),
+		"roles":   roles,
+	})
+}
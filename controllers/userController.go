@@ -1,7 +1,10 @@
 package controllers
 
 import (
+	"MovieVerse/logging"
+	"MovieVerse/metrics"
 	"MovieVerse/models"
+	"MovieVerse/tracing"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
@@ -12,10 +15,18 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/gomail.v2"
-	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,20 +36,102 @@ func SetClient(c *mongo.Client) {
 	client = c
 }
 
+var databaseName = "movieverse"
+
+func SetDatabaseName(name string) {
+	databaseName = name
+}
+
+func database() *mongo.Database {
+	return client.Database(databaseName)
+}
+
+// publicURL is the address users reach the site at; links in emails are
+// built from it.
+var publicURL = "http://localhost:8080"
+
+func SetPublicURL(url string) {
+	publicURL = url
+}
+
 func GetUsers(w http.ResponseWriter, r *http.Request) {
-	collection := client.Database("movieverse").Collection("users")
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	collection := database().Collection("users")
+	query := r.URL.Query()
+
+	filter := bson.M{}
+	if search := strings.TrimSpace(query.Get("q")); search != "" {
+		pattern := bson.M{"$regex": regexp.QuoteMeta(search), "$options": "i"}
+		filter["$or"] = bson.A{bson.M{"email": pattern}, bson.M{"username": pattern}}
+	}
+	if role := query.Get("role"); role != "" {
+		filter["roles"] = role
+	}
+
+	page, limit := pagination(query)
+	total, err := collection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Failed to count users", http.StatusInternalServerError)
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetSkip(int64((page - 1) * limit)).SetLimit(int64(limit))
+	cursor, err := collection.Find(r.Context(), filter, opts)
 	if err != nil {
 		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
 		return
 	}
 	var users []models.User
-	if err = cursor.All(context.TODO(), &users); err != nil {
+	if err = cursor.All(r.Context(), &users); err != nil {
 		http.Error(w, "Failed to decode users", http.StatusInternalServerError)
 		return
 	}
+	profiles := make([]models.UserProfile, 0, len(users))
+	for _, user := range users {
+		profiles = append(profiles, toProfile(user))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":       profiles,
+		"page":        page,
+		"limit":       limit,
+		"total":       total,
+		"total_pages": int(math.Ceil(float64(total) / float64(limit))),
+	})
+}
+
+// pagination reads the page and limit query parameters shared by the admin
+// list endpoints.
+func pagination(query url.Values) (page, limit int) {
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err = strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	return page, limit
+}
+
+func toProfile(user models.User) models.UserProfile {
+	profile := models.UserProfile{
+		ID:               user.ID,
+		Email:            user.Email,
+		Username:         user.Username,
+		EmailVerified:    user.EmailVerified,
+		PendingEmail:     user.PendingEmail,
+		AvatarURL:        user.AvatarURL,
+		Roles:            userRoles(user),
+		TwoFactorEnabled: user.TOTPEnabled,
+		CreatedAt:        user.ID.Timestamp(),
+	}
+	if !user.DeletionScheduled.IsZero() {
+		profile.DeletionScheduled = &user.DeletionScheduled
+	}
+	return profile
 }
 
 func CreateUser(w http.ResponseWriter, r *http.Request) {
@@ -48,9 +141,18 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := client.Database("movieverse").Collection("users")
+	if user.Email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	if err := passwordPolicy.Validate(user.Password, user.Email, user.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	collection := database().Collection("users")
 	var existingUser models.User
-	err := collection.FindOne(context.TODO(), bson.M{"email": user.Email}).Decode(&existingUser)
+	err := collection.FindOne(r.Context(), bson.M{"email": user.Email}).Decode(&existingUser)
 	if err == nil {
 		http.Error(w, "Email already exists", http.StatusBadRequest)
 		return
@@ -60,17 +162,33 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user.ID = primitive.NewObjectID()
-	user.VerificationToken, _ = generateVerificationToken()
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	user.Password = string(hashedPassword)
-
-	_, err = collection.InsertOne(context.TODO(), user)
+	user.Admin = false
+	user.Roles = []string{RoleCustomer}
+	user.EmailVerified = false
+	user.VerificationToken, err = generateVerificationToken()
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to generate verification token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	user.Password, err = passwordPolicy.Hash(user.Password)
 	if err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to hash password: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = collection.InsertOne(r.Context(), user)
+	if mongo.IsDuplicateKeyError(err) {
+		// Another signup for the same address won the race.
+		http.Error(w, "Email already exists", http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
 
-	err = sendVerificationEmail(user.Email, user.VerificationToken)
+	err = sendVerificationEmail(r.Context(), user.Email, user.VerificationToken)
 	if err != nil {
 		http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
 		return
@@ -94,9 +212,9 @@ func VerifyEmail(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Verification token is required", http.StatusBadRequest)
 		return
 	}
-	collection := client.Database("movieverse").Collection("users")
+	collection := database().Collection("users")
 	var user models.User
-	err := collection.FindOne(context.TODO(), bson.M{"verificationtoken": token}).Decode(&user)
+	err := collection.FindOne(r.Context(), bson.M{"verification_token": token}).Decode(&user)
 	if err != nil {
 		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
 		return
@@ -105,8 +223,8 @@ func VerifyEmail(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Email is already verified", http.StatusBadRequest)
 		return
 	}
-	update := bson.M{"$set": bson.M{"emailverified": true, "verificationtoken": ""}}
-	_, err = collection.UpdateOne(context.TODO(), bson.M{"_id": user.ID}, update)
+	update := bson.M{"$set": bson.M{"email_verified": true, "verification_token": ""}}
+	_, err = collection.UpdateOne(r.Context(), bson.M{"_id": user.ID}, update)
 	if err != nil {
 		http.Error(w, "Failed to verify user", http.StatusInternalServerError)
 		return
@@ -115,26 +233,80 @@ func VerifyEmail(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified successfully. You can now log in."})
 }
 
-func sendVerificationEmail(email, token string) error {
+func sendVerificationEmail(ctx context.Context, email, token string) error {
+	verificationURL := publicURL + "/verify-email?token=" + token
+	if err := sendEmail(ctx, email, "MovieVerse - Email Verification", "Please verify your email by clicking the link: "+verificationURL); err != nil {
+		return err
+	}
+	logging.Logger().Infof("Verification email sent to %s", email)
+	return nil
+}
+
+// SMTPSettings is the account outgoing mail is sent through.
+type SMTPSettings struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+var smtpSettings SMTPSettings
+
+func SetSMTPSettings(settings SMTPSettings) {
+	smtpSettings = settings
+}
+
+func sendEmail(ctx context.Context, to, subject, body string) (err error) {
+	_, span := tracing.Start(ctx, "email.send", attribute.String("email.subject", subject))
+	defer func() { tracing.End(span, err) }()
 	mailer := gomail.NewMessage()
-	mailer.SetHeader("From", "gamebeast66@gmail.com")
-	mailer.SetHeader("To", email)
-	mailer.SetHeader("Subject", "MovieVerse - Email Verification")
-	verificationURL := "http://localhost:8080/verify-email?token=" + token
-	mailer.SetBody("text/plain", "Please verify your email by clicking the link: "+verificationURL)
-	dialer := gomail.NewDialer("smtp.gmail.com", 587, "gamebeast66@gmail.com", "xfjv jsee cpcg rusr")
+	mailer.SetHeader("From", smtpSettings.From)
+	mailer.SetHeader("To", to)
+	mailer.SetHeader("Subject", subject)
+	mailer.SetBody("text/plain", body)
+	dialer := gomail.NewDialer(smtpSettings.Host, smtpSettings.Port, smtpSettings.Username, smtpSettings.Password)
 	if err := dialer.DialAndSend(mailer); err != nil {
-		return fmt.Errorf("failed to send email to %s: %w", email, err)
+		return fmt.Errorf("failed to send email to %s: %w", to, err)
 	}
-	log.Printf("Verification email sent to %s", email)
 	return nil
 }
 
-var jwtKey = []byte("your_secret_key")
+// CheckMailer connects to the SMTP server and waits for its greeting,
+// without logging in or sending anything.
+func CheckMailer(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(smtpSettings.Host, strconv.Itoa(smtpSettings.Port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return fmt.Errorf("unexpected SMTP greeting: %w", err)
+	}
+	text.PrintfLine("QUIT")
+	return nil
+}
+
+// jwtKey is empty until SetJWTSecret is called with the configured secret.
+var jwtKey []byte
+
+// SetJWTSecret sets the key session tokens are signed with. Changing it
+// signs every user out.
+func SetJWTSecret(secret string) {
+	jwtKey = []byte(secret)
+}
 
 type Claims struct {
-	UserID primitive.ObjectID `json:"userId"`
-	Admin  bool               `json:"admin"`
+	UserID       primitive.ObjectID `json:"userId"`
+	Roles        []string           `json:"roles"`
+	TokenVersion int                `json:"tokenVersion"`
+	MFA          bool               `json:"mfa,omitempty"`
+	Purpose      string             `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -148,93 +320,209 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := client.Database("movieverse").Collection("users")
+	ip := clientIP(r)
+	if wait := ipFailures.retryAfter(ip); wait > 0 {
+		metrics.FailedLogins.WithLabelValues(metrics.LoginThrottled).Inc()
+		writeRetryAfter(w, wait)
+		return
+	}
+
+	collection := database().Collection("users")
 	var user models.User
-	err := collection.FindOne(context.TODO(), bson.M{"email": credentials.Email}).Decode(&user)
+	err := collection.FindOne(r.Context(), bson.M{"email": credentials.Email}).Decode(&user)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
+			ipFailures.recordFailure(ip)
+			metrics.FailedLogins.WithLabelValues(metrics.LoginUnknownUser).Inc()
 			http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		} else {
-			log.Printf("Error finding user: %v", err)
+			logging.FromContext(r.Context()).Errorf("Error finding user: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		}
 		return
 	}
 
+	now := time.Now()
+	if user.LockedUntil.After(now) {
+		metrics.FailedLogins.WithLabelValues(metrics.LoginLocked).Inc()
+		http.Error(w, "Account is temporarily locked. Check your email for an unlock link.", http.StatusLocked)
+		return
+	}
+	if wait := accountRetryAfter(user, now); wait > 0 {
+		metrics.FailedLogins.WithLabelValues(metrics.LoginThrottled).Inc()
+		writeRetryAfter(w, wait)
+		return
+	}
+
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credentials.Password)); err != nil {
+		if ipFailures.recordFailure(ip) {
+			logging.FromContext(r.Context()).Warnf("Blocking logins from %s after repeated failures", ip)
+		}
+		recordAccountFailure(r.Context(), user, ip)
+		metrics.FailedLogins.WithLabelValues(metrics.LoginBadPassword).Inc()
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
+	ipFailures.reset(ip)
+	resetAccountFailures(r.Context(), user)
+	// The password was verified, which is the only time it can be
+	// rehashed, so this comes before any second factor.
+	if passwordPolicy.NeedsRehash(user.Password) {
+		rehashPassword(r.Context(), user, credentials.Password)
+	}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		UserID: user.ID,
-		Admin:  user.Admin,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
+	if user.TOTPEnabled {
+		challenge, err := issueTwoFactorChallenge(user)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("Failed to sign challenge: %v", err)
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":             "Two-factor authentication required",
+			"two_factor_required": true,
+			"challenge":           challenge,
+		})
+		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	tokenString, err := issueToken(user, false)
 	if err != nil {
-		log.Printf("Failed to sign token: %v", err)
+		logging.FromContext(r.Context()).Errorf("Failed to sign token: %v", err)
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
+	LogUserActivity(r.Context(), user.ID, ActivityLogin, clientIP(r))
 
 	w.Header().Set("Content-Type", "application/json")
+	roles := userRoles(user)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message": "Login successful",
 		"token":   tokenString,
-		"admin":   user.Admin,
+		"admin":   isStaff(roles),
+		"roles":   roles,
 	})
 }
 
+// rehashPassword upgrades a hash created with an older bcrypt cost. It only
+// replaces the exact hash that was verified, so a concurrent password change
+// is never overwritten.
+func rehashPassword(ctx context.Context, user models.User, password string) {
+	hashed, err := passwordPolicy.Hash(password)
+	if err != nil {
+		logging.Logger().Errorf("Failed to rehash password: %v", err)
+		return
+	}
+	collection := database().Collection("users")
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": user.ID, "password": user.Password}, bson.M{"$set": bson.M{"password": hashed}})
+	if err != nil {
+		logging.Logger().Errorf("Failed to store rehashed password: %v", err)
+	}
+}
+
+func issueToken(user models.User, mfa bool) (string, error) {
+	expirationTime := time.Now().Add(24 * time.Hour)
+	claims := &Claims{
+		UserID:       user.ID,
+		Roles:        userRoles(user),
+		TokenVersion: user.TokenVersion,
+		MFA:          mfa,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
 func ValidateJWT(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenStr := r.Header.Get("Authorization")
-		if tokenStr == "" {
-			tokenStr = r.URL.Query().Get("token")
-		}
+		tokenStr := bearerToken(r)
 		if tokenStr == "" {
 			http.Error(w, "Missing token", http.StatusUnauthorized)
 			return
 		}
-		if len(tokenStr) > 7 && tokenStr[:7] == "Bearer " {
-			tokenStr = tokenStr[7:]
+		claims, ok := parseSessionToken(tokenStr)
+		if !ok {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
 		}
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-		if err != nil || !token.Valid {
+		if !sessionStillValid(r.Context(), claims) {
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 			return
 		}
+		logging.SetUserID(r.Context(), claims.UserID.Hex())
 		ctx := context.WithValue(r.Context(), "user", claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func AdminOnly(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		claims, ok := r.Context().Value("user").(*Claims)
-		if !ok || !claims.Admin {
-			http.Error(w, "Access denied: Admins only", http.StatusForbidden)
-			return
-		}
-		next.ServeHTTP(w, r)
+func bearerToken(r *http.Request) string {
+	tokenStr := r.Header.Get("Authorization")
+	if tokenStr == "" {
+		tokenStr = r.URL.Query().Get("token")
+	}
+	if len(tokenStr) > 7 && tokenStr[:7] == "Bearer " {
+		tokenStr = tokenStr[7:]
+	}
+	return tokenStr
+}
+
+// SessionUserID returns the user ID from a validly signed session token on
+// the request, or "" if there is none. It does not consult the database, so
+// only use it where a revoked session doing harm is not a concern.
+func SessionUserID(r *http.Request) string {
+	claims, ok := parseSessionToken(bearerToken(r))
+	if !ok {
+		return ""
+	}
+	return claims.UserID.Hex()
+}
+
+// parseSessionToken checks the signature and expiry of a session token. It
+// does not consult the database; see sessionStillValid for that.
+func parseSessionToken(tokenStr string) (*Claims, bool) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
 	})
+	if err != nil || !token.Valid || claims.Purpose != "" {
+		return nil, false
+	}
+	return claims, true
+}
+
+// sessionStillValid rejects tokens issued before the user's token version was
+// bumped, which is how password resets sign out every existing session. It
+// also refreshes the roles so role changes apply without a new login.
+func sessionStillValid(ctx context.Context, claims *Claims) bool {
+	collection := database().Collection("users")
+	var user models.User
+	err := collection.FindOne(ctx, bson.M{"_id": claims.UserID}).Decode(&user)
+	if err != nil {
+		return false
+	}
+	if user.TokenVersion != claims.TokenVersion {
+		return false
+	}
+	claims.Roles = userRoles(user)
+	return true
+}
+
+// SessionClaims returns the claims ValidateJWT attached to the request.
+func SessionClaims(r *http.Request) (*Claims, bool) {
+	claims, ok := r.Context().Value("user").(*Claims)
+	return claims, ok
 }
 
 func UsersOnly(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		claims, ok := r.Context().Value("user").(*Claims)
+		_, ok := SessionClaims(r)
 		if !ok {
 			http.Error(w, "Access denied: Users only", http.StatusForbidden)
 			return
 		}
-		print(claims.UserID.Hex())
 		next.ServeHTTP(w, r)
 	})
 }
@@ -246,21 +534,21 @@ func GetUserByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := client.Database("movieverse").Collection("users")
+	collection := database().Collection("users")
 	var user models.User
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
 		return
 	}
-	err = collection.FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&user)
+	err = collection.FindOne(r.Context(), bson.M{"_id": objectID}).Decode(&user)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(toProfile(user))
 }
 
 func DeleteUser(w http.ResponseWriter, r *http.Request) {
@@ -269,14 +557,13 @@ func DeleteUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "User ID is required", http.StatusBadRequest)
 		return
 	}
-	collection := client.Database("movieverse").Collection("users")
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
 		return
 	}
-	_, err = collection.DeleteOne(context.TODO(), bson.M{"_id": objectID})
-	if err != nil {
+	if err := deleteUserData(r.Context(), objectID); err != nil {
+		logging.FromContext(r.Context()).Errorf("Failed to delete user %s: %v", id, err)
 		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
 		return
 	}
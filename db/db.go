@@ -0,0 +1,137 @@
+// Package db owns the application's single MongoDB connection pool.
+package db
+
+import (
+	"MovieVerse/logging"
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"time"
+)
+
+// Options configures the connection. Zero pool and timeout values leave the
+// driver defaults in place.
+type Options struct {
+	URI      string
+	Database string
+
+	MaxPoolSize     uint64
+	MinPoolSize     uint64
+	MaxConnIdleTime time.Duration
+	ConnectTimeout  time.Duration
+	// ServerSelectionTimeout bounds how long an operation waits for a
+	// usable server, and with it each startup attempt.
+	ServerSelectionTimeout time.Duration
+	// StartupTimeout is how long Connect keeps retrying before giving up.
+	StartupTimeout time.Duration
+
+	// CommandMonitor receives command events, e.g. for metrics and traces.
+	CommandMonitor *event.CommandMonitor
+}
+
+// Manager holds the one client every part of the application shares.
+type Manager struct {
+	client   *mongo.Client
+	database *mongo.Database
+}
+
+const (
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+)
+
+// backoff returns the delay before retry number attempt (starting at 1).
+func backoff(attempt int) time.Duration {
+	delay := initialBackoff
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// Connect creates the client and pings the server until it answers,
+// backing off between attempts, so a database that is still starting up
+// does not take the application down with it. It gives up after
+// StartupTimeout or when ctx is done.
+func Connect(ctx context.Context, opts Options) (*Manager, error) {
+	clientOptions := options.Client().
+		ApplyURI(opts.URI).
+		SetPoolMonitor(poolMonitor()).
+		SetServerMonitor(serverMonitor())
+	if opts.CommandMonitor != nil {
+		clientOptions.SetMonitor(opts.CommandMonitor)
+	}
+	if opts.MaxPoolSize > 0 {
+		clientOptions.SetMaxPoolSize(opts.MaxPoolSize)
+	}
+	if opts.MinPoolSize > 0 {
+		clientOptions.SetMinPoolSize(opts.MinPoolSize)
+	}
+	if opts.MaxConnIdleTime > 0 {
+		clientOptions.SetMaxConnIdleTime(opts.MaxConnIdleTime)
+	}
+	if opts.ConnectTimeout > 0 {
+		clientOptions.SetConnectTimeout(opts.ConnectTimeout)
+	}
+	if opts.ServerSelectionTimeout > 0 {
+		clientOptions.SetServerSelectionTimeout(opts.ServerSelectionTimeout)
+	}
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MongoDB options: %w", err)
+	}
+	m := &Manager{client: client, database: client.Database(opts.Database)}
+
+	if opts.StartupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.StartupTimeout)
+		defer cancel()
+	}
+	logger := logging.Subsystem("mongo")
+	for attempt := 1; ; attempt++ {
+		err = m.Ping(ctx)
+		if err == nil {
+			logger.Infof("Connected to MongoDB database %s", opts.Database)
+			return m, nil
+		}
+		delay := backoff(attempt)
+		logger.Warnf("MongoDB is not reachable (attempt %d), retrying in %v: %v", attempt, delay, err)
+		select {
+		case <-ctx.Done():
+			client.Disconnect(context.Background())
+			return nil, fmt.Errorf("MongoDB unreachable after %d attempts: %w", attempt, errors.Join(err, ctx.Err()))
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (m *Manager) Client() *mongo.Client {
+	return m.client
+}
+
+func (m *Manager) Database() *mongo.Database {
+	return m.database
+}
+
+func (m *Manager) Collection(name string) *mongo.Collection {
+	return m.database.Collection(name)
+}
+
+// Ping checks that the primary is reachable; it backs the readiness probe.
+func (m *Manager) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, readpref.Primary())
+}
+
+// Close waits for in-use connections to be returned, up to ctx's deadline,
+// and closes the pool.
+func (m *Manager) Close(ctx context.Context) error {
+	return m.client.Disconnect(ctx)
+}
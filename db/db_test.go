@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackoff_DoublesUpToCap(t *testing.T) {
+	want := []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, expected := range want {
+		if got := backoff(i + 1); got != expected {
+			t.Errorf("Attempt %d: expected %v, got %v", i+1, expected, got)
+		}
+	}
+}
+
+func TestConnect_GivesUpAfterStartupTimeout(t *testing.T) {
+	start := time.Now()
+	_, err := Connect(context.Background(), Options{
+		// Nothing listens on port 1, so every attempt fails quickly.
+		URI:                    "mongodb://127.0.0.1:1/?connect=direct",
+		Database:               "movieverse_test",
+		ServerSelectionTimeout: 50 * time.Millisecond,
+		StartupTimeout:         700 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("Expected Connect to fail without a server")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Connect kept retrying for %v past its startup timeout", elapsed)
+	}
+}
+
+// TestConnect_LiveServer runs against a real server when
+// MOVIEVERSE_TEST_MONGO_URI is set.
+func TestConnect_LiveServer(t *testing.T) {
+	uri := os.Getenv("MOVIEVERSE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MOVIEVERSE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	m, err := Connect(ctx, Options{URI: uri, Database: "movieverse_test", MaxPoolSize: 5, StartupTimeout: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if m.Collection("users").Database().Name() != "movieverse_test" {
+		t.Error("Expected collections to come from the configured database")
+	}
+	if err := m.Close(ctx); err != nil {
+		t.Errorf("Failed to close: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"MovieVerse/logging"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// poolMonitor logs the pool's lifecycle. Routine connection churn is only
+// visible at debug level; failures to get a connection and pool clears,
+// which the driver does after network errors, are warnings.
+func poolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			logger := logging.Subsystem("mongo").WithFields(logrus.Fields{
+				"pool_event": e.Type,
+				"address":    e.Address,
+			})
+			switch e.Type {
+			case event.PoolCleared:
+				logger.WithError(e.Error).Warn("MongoDB connection pool cleared")
+			case event.GetFailed:
+				logger.WithField("reason", e.Reason).Warn("Failed to check out a MongoDB connection")
+			case event.ConnectionCreated, event.ConnectionClosed:
+				if e.Reason != "" {
+					logger = logger.WithField("reason", e.Reason)
+				}
+				logger.WithField("connection_id", e.ConnectionID).Debug("MongoDB connection " + e.Type)
+			case event.PoolReady, event.PoolClosedEvent:
+				logger.Info("MongoDB connection pool " + e.Type)
+			}
+		},
+	}
+}
+
+// serverMonitor logs topology changes, such as a replica set election, and
+// failed heartbeats.
+func serverMonitor() *event.ServerMonitor {
+	return &event.ServerMonitor{
+		ServerDescriptionChanged: func(e *event.ServerDescriptionChangedEvent) {
+			if e.PreviousDescription.Kind == e.NewDescription.Kind {
+				return
+			}
+			logging.Subsystem("mongo").WithFields(logrus.Fields{
+				"address":  e.Address,
+				"previous": e.PreviousDescription.Kind.String(),
+				"current":  e.NewDescription.Kind.String(),
+			}).Info("MongoDB server changed state")
+		},
+		ServerHeartbeatFailed: func(e *event.ServerHeartbeatFailedEvent) {
+			logging.Subsystem("mongo").WithFields(logrus.Fields{
+				"connection_id": e.ConnectionID,
+				"duration_ms":   e.Duration.Milliseconds(),
+			}).WithError(e.Failure).Warn("MongoDB heartbeat failed")
+		},
+	}
+}
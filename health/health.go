@@ -0,0 +1,159 @@
+// Package health serves the liveness and readiness endpoints.
+package health
+
+import (
+	"MovieVerse/logging"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Check reports whether a dependency is usable. It should give up when ctx
+// is done.
+type Check func(ctx context.Context) error
+
+// Cached wraps check so that it runs at most once per ttl, for dependencies
+// too costly to contact on every probe. Calls in between get the last
+// result.
+func Cached(check Check, ttl time.Duration) Check {
+	var (
+		mu      sync.Mutex
+		checked time.Time
+		last    error
+	)
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checked.IsZero() && time.Since(checked) < ttl {
+			return last
+		}
+		last, checked = check(ctx), time.Now()
+		return last
+	}
+}
+
+type registration struct {
+	check Check
+	// optional checks cover dependencies the instance can serve without.
+	optional bool
+}
+
+// Checker runs the registered checks for the readiness endpoint. Once
+// Drain has been called the instance reports itself as not ready, so load
+// balancers stop routing to it while in-flight requests finish.
+type Checker struct {
+	// Timeout bounds each round of checks.
+	Timeout time.Duration
+
+	mu       sync.RWMutex
+	checks   map[string]registration
+	draining atomic.Bool
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{Timeout: timeout, checks: make(map[string]registration)}
+}
+
+// Register adds or replaces the check reported under name. The instance is
+// not ready while it fails.
+func (c *Checker) Register(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = registration{check: check}
+}
+
+// RegisterOptional adds or replaces a check whose failure leaves the
+// instance ready but degraded, such as the mailer: most requests do not
+// send email.
+func (c *Checker) RegisterOptional(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = registration{check: check, optional: true}
+}
+
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+// Run executes every check concurrently and returns "ok" or "unavailable"
+// for each, keyed by name, and the overall status: "ok", "degraded" when
+// only optional checks failed, or "unavailable". The errors themselves are
+// logged rather than returned, since the readiness endpoint is public.
+func (c *Checker) Run(ctx context.Context) (map[string]string, string) {
+	c.mu.RLock()
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]registration, len(names))
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.mu.RUnlock()
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = check.check(ctx)
+		}()
+	}
+	wg.Wait()
+
+	results := make(map[string]string, len(names))
+	status := "ok"
+	for i, name := range names {
+		results[name] = "ok"
+		if errs[i] == nil {
+			continue
+		}
+		results[name] = "unavailable"
+		logging.Subsystem("health").Warnf("%s check failed: %v", name, errs[i])
+		if !checks[i].optional {
+			status = "unavailable"
+		} else if status == "ok" {
+			status = "degraded"
+		}
+	}
+	return results, status
+}
+
+// Live answers the liveness probe. It does not look at dependencies: a
+// restart would not bring a database back.
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// Ready answers the readiness probe with 503 while draining or while any
+// required check fails.
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	if c.draining.Load() {
+		writeStatus(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "draining"})
+		return
+	}
+	results, status := c.Run(r.Context())
+	code := http.StatusOK
+	if status == "unavailable" {
+		code = http.StatusServiceUnavailable
+	}
+	writeStatus(w, code, map[string]interface{}{"status": status, "checks": results})
+}
+
+func writeStatus(w http.ResponseWriter, code int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,109 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func ready(t *testing.T, c *Checker) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c.Ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("Response is not JSON: %v", err)
+	}
+	return rec.Code, body
+}
+
+func TestReady_ReportsFailingChecks(t *testing.T) {
+	c := NewChecker(time.Second)
+	c.Register("mongo", func(ctx context.Context) error { return errors.New("dial tcp 10.0.0.5:27017: connection refused") })
+	c.Register("cache", func(ctx context.Context) error { return nil })
+
+	code, body := ready(t, c)
+	if code != http.StatusServiceUnavailable || body["status"] != "unavailable" {
+		t.Fatalf("Expected 503 with a failing check, got %d %v", code, body)
+	}
+	checks := body["checks"].(map[string]interface{})
+	if checks["cache"] != "ok" || checks["mongo"] != "unavailable" {
+		t.Errorf("Expected the failure without its error, got %v", checks)
+	}
+
+	c.Register("mongo", func(ctx context.Context) error { return nil })
+	if code, _ := ready(t, c); code != http.StatusOK {
+		t.Errorf("Expected 200 once every check passes, got %d", code)
+	}
+}
+
+func TestReady_OptionalCheckOnlyDegrades(t *testing.T) {
+	c := NewChecker(time.Second)
+	c.Register("mongo", func(ctx context.Context) error { return nil })
+	c.RegisterOptional("mailer", func(ctx context.Context) error { return errors.New("connection refused") })
+
+	code, body := ready(t, c)
+	if code != http.StatusOK || body["status"] != "degraded" {
+		t.Errorf("Expected 200 degraded, got %d %v", code, body)
+	}
+	if checks := body["checks"].(map[string]interface{}); checks["mailer"] != "unavailable" {
+		t.Errorf("Expected the mailer to be reported unavailable, got %v", checks)
+	}
+}
+
+func TestCached_ReusesResultWithinTTL(t *testing.T) {
+	calls := 0
+	check := Cached(func(ctx context.Context) error {
+		calls++
+		return errors.New("connection refused")
+	}, time.Hour)
+	for i := 0; i < 3; i++ {
+		if err := check(context.Background()); err == nil {
+			t.Error("Expected the cached error")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected one call within the TTL, got %d", calls)
+	}
+}
+
+func TestReady_TimesOutSlowChecks(t *testing.T) {
+	c := NewChecker(20 * time.Millisecond)
+	c.Register("mongo", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	code, _ := ready(t, c)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a hanging check to fail, got %d", code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Readiness waited %v for a hanging check", elapsed)
+	}
+}
+
+func TestReady_DrainingSkipsChecks(t *testing.T) {
+	c := NewChecker(time.Second)
+	c.Register("mongo", func(ctx context.Context) error {
+		t.Error("Checks should not run while draining")
+		return nil
+	})
+	c.Drain()
+
+	code, body := ready(t, c)
+	if code != http.StatusServiceUnavailable || body["status"] != "draining" {
+		t.Errorf("Expected 503 draining, got %d %v", code, body)
+	}
+
+	rec := httptest.NewRecorder()
+	c.Live(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected liveness to stay up while draining, got %d", rec.Code)
+	}
+}
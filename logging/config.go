@@ -0,0 +1,200 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config selects where log entries go and how verbose each subsystem is.
+type Config struct {
+	// Outputs lists the sinks: "stdout", "stderr", "file" and "syslog".
+	Outputs []string
+	File    FileConfig
+	Syslog  SyslogConfig
+	// Level applies to every subsystem without an entry in Levels.
+	Level  string
+	Levels map[string]string
+}
+
+type FileConfig struct {
+	Path        string
+	MaxSizeMB   int
+	RotateEvery time.Duration
+	MaxAge      time.Duration
+	MaxBackups  int
+	Compress    bool
+}
+
+// SyslogConfig points at a syslog daemon. An empty Network and Address use
+// the local one.
+type SyslogConfig struct {
+	Network string
+	Address string
+	Tag     string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Outputs: []string{"stdout", "file"},
+		File: FileConfig{
+			Path:        "user_actions.log",
+			MaxSizeMB:   100,
+			RotateEvery: 24 * time.Hour,
+			MaxAge:      30 * 24 * time.Hour,
+			MaxBackups:  10,
+			Compress:    true,
+		},
+		Syslog: SyslogConfig{Tag: "movieverse"},
+		Level:  "info",
+		Levels: map[string]string{},
+	}
+}
+
+var (
+	subsystemsMu sync.Mutex
+	subsystems   = map[string]*logrus.Logger{}
+	levels       = map[string]logrus.Level{}
+	closers      []io.Closer
+)
+
+// Configure opens the configured sinks and applies the levels. Nothing is
+// written anywhere but stdout until it is called. Calling it again closes
+// the sinks of the previous configuration.
+func Configure(cfg Config) error {
+	level, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+	subsystemLevels := map[string]logrus.Level{}
+	for name, value := range cfg.Levels {
+		l, err := logrus.ParseLevel(value)
+		if err != nil {
+			return fmt.Errorf("invalid log level for %s: %w", name, err)
+		}
+		subsystemLevels[strings.ToLower(name)] = l
+	}
+
+	var writers []io.Writer
+	var hooks []logrus.Hook
+	var opened []io.Closer
+	fail := func(err error) error {
+		for _, c := range opened {
+			c.Close()
+		}
+		return err
+	}
+	for _, output := range cfg.Outputs {
+		switch output {
+		case "stdout":
+			writers = append(writers, os.Stdout)
+		case "stderr":
+			writers = append(writers, os.Stderr)
+		case "file":
+			file := &RotatingFile{
+				Path:        cfg.File.Path,
+				MaxSize:     int64(cfg.File.MaxSizeMB) << 20,
+				RotateEvery: cfg.File.RotateEvery,
+				MaxAge:      cfg.File.MaxAge,
+				MaxBackups:  cfg.File.MaxBackups,
+				Compress:    cfg.File.Compress,
+			}
+			if err := file.open(); err != nil {
+				return fail(fmt.Errorf("opening log file: %w", err))
+			}
+			writers = append(writers, file)
+			opened = append(opened, file)
+		case "syslog":
+			hook, closer, err := newSyslogHook(cfg.Syslog)
+			if err != nil {
+				return fail(fmt.Errorf("connecting to syslog: %w", err))
+			}
+			hooks = append(hooks, hook)
+			opened = append(opened, closer)
+		default:
+			return fail(fmt.Errorf("unknown log output %q", output))
+		}
+	}
+
+	var out io.Writer = io.Discard
+	if len(writers) == 1 {
+		out = writers[0]
+	} else if len(writers) > 1 {
+		out = io.MultiWriter(writers...)
+	}
+	hookSet := make(logrus.LevelHooks)
+	for _, hook := range hooks {
+		hookSet.Add(hook)
+	}
+
+	subsystemsMu.Lock()
+	defer subsystemsMu.Unlock()
+	previous := closers
+	closers = opened
+	levels = subsystemLevels
+	base.SetOutput(out)
+	base.SetLevel(level)
+	base.ReplaceHooks(hookSet)
+	for name, logger := range subsystems {
+		applyBase(name, logger)
+	}
+	for _, c := range previous {
+		c.Close()
+	}
+	return nil
+}
+
+// Close flushes and closes the configured sinks.
+func Close() error {
+	subsystemsMu.Lock()
+	defer subsystemsMu.Unlock()
+	var first error
+	for _, c := range closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	closers = nil
+	base.SetOutput(os.Stdout)
+	base.ReplaceHooks(make(logrus.LevelHooks))
+	return first
+}
+
+func applyBase(name string, logger *logrus.Logger) {
+	logger.SetOutput(base.Out)
+	logger.SetFormatter(base.Formatter)
+	logger.ReplaceHooks(base.Hooks)
+	if level, ok := levels[name]; ok {
+		logger.SetLevel(level)
+	} else {
+		logger.SetLevel(base.GetLevel())
+	}
+}
+
+func subsystemLogger(name string) *logrus.Logger {
+	subsystemsMu.Lock()
+	defer subsystemsMu.Unlock()
+	logger, ok := subsystems[name]
+	if !ok {
+		logger = logrus.New()
+		applyBase(name, logger)
+		subsystems[name] = logger
+	}
+	return logger
+}
+
+// Subsystem returns a logger whose level can be set on its own with
+// LOG_LEVEL_<NAME>, e.g. LOG_LEVEL_HTTP=warn to silence access logs.
+func Subsystem(name string) *logrus.Entry {
+	return subsystemLogger(name).WithField("subsystem", name)
+}
+
+// SubsystemFromContext is FromContext for a subsystem logger.
+func SubsystemFromContext(ctx context.Context, name string) *logrus.Entry {
+	return requestEntry(ctx, subsystemLogger(name)).WithField("subsystem", name)
+}
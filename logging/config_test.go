@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigure_SubsystemLevels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	cfg := DefaultConfig()
+	cfg.Outputs = []string{"file"}
+	cfg.File.Path = path
+	cfg.Levels = map[string]string{"http": "error"}
+	if err := Configure(cfg); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	t.Cleanup(func() {
+		Configure(Config{Outputs: []string{"stdout"}, Level: "info"})
+	})
+
+	Subsystem("http").Info("access log entry")
+	Subsystem("chat").Info("chat entry")
+	Logger().Debug("debug entry")
+	Close()
+
+	data, _ := os.ReadFile(path)
+	logs := string(data)
+	if strings.Contains(logs, "access log entry") || strings.Contains(logs, "debug entry") {
+		t.Errorf("Entries below their level were written: %s", logs)
+	}
+	if !strings.Contains(logs, `"subsystem":"chat"`) {
+		t.Errorf("Expected the chat entry with its subsystem: %s", logs)
+	}
+
+	cfg.Outputs = []string{"carrier-pigeon"}
+	if err := Configure(cfg); err == nil {
+		t.Error("Expected an unknown output to be rejected")
+	}
+}
@@ -0,0 +1,120 @@
+// Package logging provides the application's structured logger and the
+// request-scoped loggers derived from it.
+package logging
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+var base = newLogger(os.Stdout)
+
+func newLogger(out io.Writer) *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(out)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+	return logger
+}
+
+// Logger returns the process-wide logger. Prefer FromContext inside request
+// handlers so entries carry the request ID.
+func Logger() *logrus.Logger {
+	return base
+}
+
+// SetOutput sends all log entries, from every subsystem, to out.
+func SetOutput(out io.Writer) {
+	subsystemsMu.Lock()
+	defer subsystemsMu.Unlock()
+	base.SetOutput(out)
+	for _, logger := range subsystems {
+		logger.SetOutput(out)
+	}
+}
+
+// RedirectStdlib routes the standard library's log package through the
+// structured logger so stray log.Printf calls don't produce a second format.
+func RedirectStdlib() {
+	log.SetFlags(0)
+	log.SetOutput(stdlibWriter{})
+}
+
+// stdlibWriter logs synchronously, unlike logrus' own Writer, so the message
+// from a log.Fatal is written before the process exits.
+type stdlibWriter struct{}
+
+func (stdlibWriter) Write(p []byte) (int, error) {
+	base.Info(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+type contextKey int
+
+const requestKey contextKey = iota
+
+// requestInfo is shared by every context derived from the request, so
+// values learned deeper in the handler chain, like the authenticated user,
+// are visible to the access log written by Middleware.
+type requestInfo struct {
+	id string
+
+	mu     sync.Mutex
+	userID string
+}
+
+func withRequest(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestKey, info)
+}
+
+func requestFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestKey).(*requestInfo)
+	return info
+}
+
+// RequestID returns the ID assigned to the request by Middleware, or "".
+func RequestID(ctx context.Context) string {
+	if info := requestFrom(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// SetUserID records the authenticated user for the request's log entries.
+func SetUserID(ctx context.Context, userID string) {
+	if info := requestFrom(ctx); info != nil {
+		info.mu.Lock()
+		info.userID = userID
+		info.mu.Unlock()
+	}
+}
+
+// FromContext returns a logger tagged with the request ID and user ID of the
+// request ctx belongs to, and with the trace and span IDs when ctx carries a
+// span. Outside a request it returns the plain logger.
+func FromContext(ctx context.Context) *logrus.Entry {
+	return requestEntry(ctx, base)
+}
+
+func requestEntry(ctx context.Context, logger *logrus.Logger) *logrus.Entry {
+	fields := logrus.Fields{}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		fields["trace_id"] = span.TraceID().String()
+		fields["span_id"] = span.SpanID().String()
+	}
+	if info := requestFrom(ctx); info != nil {
+		fields["request_id"] = info.id
+		info.mu.Lock()
+		if info.userID != "" {
+			fields["user_id"] = info.userID
+		}
+		info.mu.Unlock()
+	}
+	return logger.WithFields(fields)
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := base.Out
+	SetOutput(&buf)
+	t.Cleanup(func() { SetOutput(previous) })
+	return &buf
+}
+
+func lastEntry(t *testing.T, buf *bytes.Buffer) map[string]interface{} {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		t.Fatalf("Log line is not JSON: %v", err)
+	}
+	return entry
+}
+
+func TestMiddleware_AccessLog(t *testing.T) {
+	buf := captureLogs(t)
+	var handlerRequestID string
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerRequestID = RequestID(r.Context())
+		// Authentication happens further down the chain, on a derived context.
+		type claimsKey struct{}
+		SetUserID(context.WithValue(r.Context(), claimsKey{}, "claims"), "user-1")
+		FromContext(r.Context()).Info("inside handler")
+		http.Error(w, "nope", http.StatusForbidden)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/users", nil))
+
+	id := rec.Header().Get(RequestIDHeader)
+	if id == "" || id != handlerRequestID {
+		t.Fatalf("Expected the response to carry the handler's request ID, got %q and %q", id, handlerRequestID)
+	}
+	inner := strings.Split(strings.TrimSpace(buf.String()), "\n")[0]
+	if !strings.Contains(inner, `"request_id":"`+id+`"`) {
+		t.Errorf("Handler log entry is missing the request ID: %s", inner)
+	}
+	entry := lastEntry(t, buf)
+	if entry["method"] != "GET" || entry["path"] != "/admin/users" || entry["status"] != float64(403) {
+		t.Errorf("Unexpected access log entry: %v", entry)
+	}
+	if entry["user_id"] != "user-1" || entry["level"] != "warning" {
+		t.Errorf("Expected a warning carrying the user ID, got %v", entry)
+	}
+	if _, ok := entry["latency_ms"]; !ok {
+		t.Errorf("Access log entry is missing latency: %v", entry)
+	}
+}
+
+func TestMiddleware_RequestIDPropagation(t *testing.T) {
+	captureLogs(t)
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for incoming, keep := range map[string]bool{
+		"abc-123":                 true,
+		"bad id with spaces":      false,
+		strings.Repeat("a", 65):   false,
+		"upstream.service_42-xyz": true,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(RequestIDHeader, incoming)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		got := rec.Header().Get(RequestIDHeader)
+		if (got == incoming) != keep || got == "" {
+			t.Errorf("Incoming %q: got %q, expected kept=%v", incoming, got, keep)
+		}
+	}
+}
+
+func TestResponseRecorder_SupportsHijack(t *testing.T) {
+	var hijackable bool
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hijackable = w.(http.Hijacker)
+	}))
+	captureLogs(t)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if !hijackable {
+		t.Error("WebSocket upgrades need the wrapped writer to implement http.Hijacker")
+	}
+}
+
+func TestFromContext_OutsideRequest(t *testing.T) {
+	buf := captureLogs(t)
+	FromContext(httptest.NewRequest(http.MethodGet, "/", nil).Context()).Info("background")
+	if entry := lastEntry(t, buf); entry["request_id"] != nil {
+		t.Errorf("Background entries should not carry a request ID: %v", entry)
+	}
+}
+
+func TestFromContext_AddsTraceIDs(t *testing.T) {
+	buf := captureLogs(t)
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+
+	FromContext(ctx).Info("traced")
+	entry := lastEntry(t, buf)
+	if entry["trace_id"] != traceID.String() || entry["span_id"] != spanID.String() {
+		t.Errorf("Expected trace and span IDs on the entry, got %v", entry)
+	}
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile_RotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &RotatingFile{Path: filepath.Join(dir, "app.log"), MaxSize: 10, Compress: true}
+	f.now = func() time.Time { clock = clock.Add(time.Second); return clock }
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	current, _ := os.ReadFile(f.Path)
+	if string(current) != "third\n" {
+		t.Errorf("Expected the current file to hold the last line, got %q", current)
+	}
+	backups, err := f.backups()
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %v (%v)", backups, err)
+	}
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup.path, ".log.gz") {
+			t.Errorf("Expected a compressed backup, got %s", backup.path)
+		}
+	}
+	if got := readGzip(t, backups[1].path); got != "first\n" {
+		t.Errorf("Oldest backup holds %q", got)
+	}
+}
+
+func TestRotatingFile_RotatesByAgeAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &RotatingFile{Path: filepath.Join(dir, "app.log"), RotateEvery: time.Hour, MaxBackups: 2}
+	f.now = func() time.Time { return clock }
+
+	for i := 0; i < 5; i++ {
+		f.Write([]byte("entry\n"))
+		clock = clock.Add(time.Hour)
+	}
+	f.Close()
+
+	backups, _ := f.backups()
+	if len(backups) != 2 {
+		t.Fatalf("Expected pruning to keep 2 backups, got %d", len(backups))
+	}
+	if want := time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC); !backups[0].time.Equal(want) {
+		t.Errorf("Expected the newest backup to be kept, got %v", backups[0].time)
+	}
+
+	f.MaxBackups = 0
+	f.MaxAge = 90 * time.Minute
+	f.prune(clock)
+	if backups, _ = f.backups(); len(backups) != 1 {
+		t.Errorf("Expected backups older than MaxAge to be removed, %d left", len(backups))
+	}
+}
+
+func readGzip(t *testing.T, path string) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("%s is not gzip: %v", path, err)
+	}
+	data, _ := io.ReadAll(gz)
+	return string(data)
+}
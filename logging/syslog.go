@@ -0,0 +1,20 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"github.com/sirupsen/logrus"
+	logrussyslog "github.com/sirupsen/logrus/hooks/syslog"
+	"io"
+	"log/syslog"
+)
+
+// newSyslogHook forwards entries to syslog with a priority matching their
+// level; the message is the entry formatted as JSON.
+func newSyslogHook(cfg SyslogConfig) (logrus.Hook, io.Closer, error) {
+	hook, err := logrussyslog.NewSyslogHook(cfg.Network, cfg.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, cfg.Tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hook, hook.Writer, nil
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io"
+)
+
+func newSyslogHook(cfg SyslogConfig) (logrus.Hook, io.Closer, error) {
+	return nil, nil, errors.New("syslog is not supported on this platform")
+}
@@ -1,367 +1,785 @@
 package main
 
 import (
+	"MovieVerse/chat"
+	"MovieVerse/config"
 	"MovieVerse/controllers"
+	"MovieVerse/db"
+	"MovieVerse/health"
+	"MovieVerse/logging"
+	"MovieVerse/metrics"
+	"MovieVerse/migrations"
 	"MovieVerse/models"
+	"MovieVerse/ratelimit"
+	"MovieVerse/support"
+	"MovieVerse/tracing"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/gorilla/websocket"
-	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/time/rate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
-func connectDB() {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	var err error
-	client, err = mongo.Connect(context.TODO(), options.Client().ApplyURI("mongodb://127.0.0.1:27017"))
+func connectMongo(cfg config.Mongo) *db.Manager {
+	manager, err := db.Connect(context.Background(), db.Options{
+		URI:                    cfg.URI,
+		Database:               cfg.Database,
+		MaxPoolSize:            cfg.MaxPoolSize,
+		MinPoolSize:            cfg.MinPoolSize,
+		MaxConnIdleTime:        cfg.MaxConnIdleTime,
+		ConnectTimeout:         cfg.ConnectTimeout,
+		ServerSelectionTimeout: cfg.ServerSelectionTimeout,
+		StartupTimeout:         cfg.StartupTimeout,
+		CommandMonitor:         mongoMonitor(),
+	})
 	if err != nil {
 		log.Fatalf("Failed to connect to MongoDB: %v", err)
 	}
-
-	err = client.Ping(ctx, nil)
-	if err != nil {
-		log.Fatalf("Failed to ping MongoDB: %v", err)
-	}
-
-	fmt.Println("Connected to MongoDB!")
+	database = manager.Database()
+	controllers.SetClient(manager.Client())
+	controllers.SetDatabaseName(cfg.Database)
+	return manager
 }
 
 var (
-	client    *mongo.Client
-	database  *mongo.Database
-	logger    = logrus.New()
-	rlimiter  *RateLimiter
-	broadcast = make(chan ChatWSMessage)
-	upgrader  = websocket.Upgrader{
+	database *mongo.Database
+	desk     *support.Desk
+	hub      = chat.NewHub(chat.DefaultOptions())
+	upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
-	mutex = &sync.Mutex{}
 )
 
+// bus relays chat traffic between instances; each instance hands what it
+// receives to its own connections in deliverChat.
+var bus chat.Bus = chat.NewMemoryBus()
+
 type Message struct {
 	Username  string `json:"username"`
 	Content   string `json:"content"`
 	Timestamp string `json:"timestamp"`
 }
 
-type ChatWSMessage struct {
-	ChatID    string `json:"chat_id"`
-	Username  string `json:"username"`
-	Content   string `json:"content"`
-	Timestamp string `json:"timestamp"`
+// chatSession loads the session named by the chat_id query parameter and
+// checks that the caller may use it: clients only reach their own sessions,
+// while staff holding staffPermission reach any. It writes the error
+// response itself and returns false when access is refused.
+func chatSession(w http.ResponseWriter, r *http.Request, staffPermission string) (models.ChatSession, bool) {
+	var session models.ChatSession
+	claims, ok := controllers.SessionClaims(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return session, false
+	}
+	chatID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("chat_id"))
+	if err != nil {
+		http.Error(w, "Invalid chat_id", http.StatusBadRequest)
+		return session, false
+	}
+	err = database.Collection("chat_sessions").FindOne(r.Context(), bson.M{"_id": chatID}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return session, false
+	} else if err != nil {
+		http.Error(w, "Failed to load chat session", http.StatusInternalServerError)
+		return session, false
+	}
+	if !canAccessChat(claims, session, staffPermission) {
+		// Someone else's session is reported as missing rather than
+		// forbidden so session IDs cannot be probed.
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return session, false
+	}
+	return session, true
 }
 
-var activeChats = make(map[string]map[*websocket.Conn]bool)
+func canAccessChat(claims *controllers.Claims, session models.ChatSession, staffPermission string) bool {
+	return session.ClientID == claims.UserID || claims.HasPermission(staffPermission)
+}
 
 func handleConnections(w http.ResponseWriter, r *http.Request) {
-	chatID := r.URL.Query().Get("chat_id")
-	if chatID == "" {
-		http.Error(w, "Missing chat session ID", http.StatusBadRequest)
+	session, ok := chatSession(w, r, controllers.PermChatsModerate)
+	if !ok {
 		return
 	}
-
-	sessionID, err := strconv.ParseUint(chatID, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid chat session ID", http.StatusBadRequest)
+	if session.Status == models.ChatStatusClosed {
+		http.Error(w, "Chat is closed", http.StatusGone)
 		return
 	}
-	var session models.ChatSession
-	err = database.Collection("chat_sessions").FindOne(context.TODO(), map[string]interface{}{"id": sessionID}).Decode(&session)
-	if err != nil {
-		newSession, err2 := getOrCreateChatSession(1)
-		if err2 != nil {
-			http.Error(w, "Failed to create chat session", http.StatusInternalServerError)
+	// A reconnecting client passes the ID of the last message it has to
+	// be sent the ones it missed.
+	var since primitive.ObjectID
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = primitive.ObjectIDFromHex(s); err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
 			return
 		}
-		chatID = strconv.Itoa(int(newSession.ID))
+	}
+	chatID := session.ID.Hex()
+	claims, _ := controllers.SessionClaims(r)
+	sender := &chat.Sender{UserID: claims.UserID.Hex(), Name: chatSenderName(r.Context(), claims.UserID), Role: "agent"}
+	if claims.UserID == session.ClientID {
+		sender.Role = "client"
+	}
+	presence := func(status string) chat.Envelope {
+		return chat.Envelope{Type: chat.TypeSystem, ChatID: chatID, Sender: sender, Event: chat.EventPresence, Status: status, Timestamp: time.Now()}
 	}
 
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("WebSocket upgrade error:", err)
+		logging.SubsystemFromContext(r.Context(), "chat").Warnln("WebSocket upgrade error:", err)
 		return
 	}
 	defer ws.Close()
 
-	mutex.Lock()
-	if activeChats[chatID] == nil {
-		activeChats[chatID] = make(map[*websocket.Conn]bool)
+	client := hub.Attach(chatID, ws)
+	if !since.IsZero() {
+		if err := replayChat(r.Context(), client, session.ID, since); err != nil {
+			logging.SubsystemFromContext(r.Context(), "chat").Errorln("Failed to replay chat messages:", err)
+			client.Send(chat.Error(chat.ErrCodeInternal, errors.New("missed messages could not be loaded"), ""))
+		}
 	}
-	activeChats[chatID][ws] = true
-	mutex.Unlock()
+	notifyChat(context.WithoutCancel(r.Context()), presence("online"))
 
 	for {
-		var msg ChatWSMessage
-		err := ws.ReadJSON(&msg)
+		_, data, err := ws.ReadMessage()
 		if err != nil {
-			mutex.Lock()
-			delete(activeChats[chatID], ws)
-			mutex.Unlock()
+			hub.Unregister(client)
+			notifyChat(context.WithoutCancel(r.Context()), presence("offline"))
 			break
 		}
-		msg.Timestamp = time.Now().Format("2006-01-02 15:04:05")
-		saveChatMessage(chatID, msg)
-		broadcast <- msg
-	}
-}
-
-func handleMessages() {
-	for {
-		msg := <-broadcast
-		mutex.Lock()
-		if conns, ok := activeChats[msg.ChatID]; ok {
-			for client := range conns {
-				err := client.WriteJSON(msg)
-				if err != nil {
-					client.Close()
-					delete(conns, client)
-				}
+		in, err := chat.ParseClient(data)
+		// The connection's span lasts as long as the socket, so every
+		// message starts its own trace linked back to it.
+		ctx, span := tracing.Tracer().Start(context.Background(), "chat.message",
+			trace.WithLinks(trace.LinkFromContext(r.Context())),
+			trace.WithAttributes(attribute.String("chat.id", chatID), attribute.String("chat.type", in.Type)))
+		if err != nil {
+			client.Send(chat.Error(chat.ErrCodeInvalid, err, in.ClientMsgID))
+			tracing.End(span, err)
+			continue
+		}
+		// The socket is bound to one session and one user whatever the
+		// client sends.
+		out := chat.Envelope{Type: in.Type, ChatID: chatID, Sender: sender, Timestamp: time.Now()}
+		switch in.Type {
+		case chat.TypeMessage:
+			// The session may have been closed since the client connected,
+			// and the close may not have reached this instance yet.
+			if open, err := chatOpen(ctx, session.ID); err != nil {
+				logging.SubsystemFromContext(ctx, "chat").Errorln("Failed to check chat status:", err)
+				client.Send(chat.Error(chat.ErrCodeInternal, errors.New("message was not saved, send it again"), in.ClientMsgID))
+				break
+			} else if !open {
+				client.Send(chat.Error(chat.ErrCodeClosed, errors.New("chat is closed"), in.ClientMsgID))
+				break
 			}
+			out.ClientMsgID, out.Content = in.ClientMsgID, in.Content
+			stored, fresh, err := saveChatMessage(ctx, session.ID, out)
+			if err != nil {
+				logging.SubsystemFromContext(ctx, "chat").Errorln("Failed to save chat message:", err)
+				client.Send(chat.Error(chat.ErrCodeInternal, errors.New("message was not saved, send it again"), in.ClientMsgID))
+				break
+			}
+			out = chat.FromMessage(stored)
+			client.Send(chat.Envelope{Type: chat.TypeAck, ChatID: chatID, ID: out.ID, ClientMsgID: out.ClientMsgID, Timestamp: out.Timestamp})
+			// A resent message is acknowledged again but not repeated
+			// to the others.
+			if fresh {
+				notifyChat(ctx, out)
+			}
+		case chat.TypeTyping:
+			// Typing indicators are relayed but not stored.
+			notifyChat(ctx, out)
+		case chat.TypeReadReceipt:
+			out.ID = in.ID
+			notifyChat(ctx, out)
 		}
-		mutex.Unlock()
+		span.End()
 	}
 }
 
-func saveChatMessage(chatID string, msg ChatWSMessage) {
-	sessionID, err := strconv.ParseUint(chatID, 10, 64)
+// chatOpen reports whether the session still accepts messages.
+func chatOpen(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	n, err := database.Collection("chat_sessions").CountDocuments(ctx,
+		bson.M{"_id": sessionID, "status": bson.M{"$ne": models.ChatStatusClosed}}, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// chatSenderName is the name shown next to a user's chat messages.
+func chatSenderName(ctx context.Context, userID primitive.ObjectID) string {
+	var user models.User
+	err := database.Collection("users").FindOne(ctx, bson.M{"_id": userID},
+		options.FindOne().SetProjection(bson.M{"username": 1})).Decode(&user)
 	if err != nil {
-		log.Println("Invalid chatID:", err)
-		return
+		logging.SubsystemFromContext(ctx, "chat").Warnln("Failed to look up chat sender name:", err)
 	}
-	chatMsg := models.ChatMessage{
-		ChatSessionID: uint(sessionID),
-		Sender:        msg.Username,
-		Content:       msg.Content,
-		Timestamp:     time.Now(),
+	return user.Username
+}
+
+// chatReplayLimit caps how many missed messages are replayed on connecting;
+// clients that were away longer load the rest from /chat-history.
+const chatReplayLimit = 200
+
+// replayChat sends client the messages stored after the message since, then
+// a replay system event. Messages sent to the chat meanwhile may arrive
+// before the replayed ones or repeat them, so clients order by timestamp
+// and match on id.
+func replayChat(ctx context.Context, client *chat.Client, sessionID, since primitive.ObjectID) error {
+	messages := database.Collection("chat_messages")
+	var last models.ChatMessage
+	err := messages.FindOne(ctx, bson.M{"_id": since, "chat_session_id": sessionID}).Decode(&last)
+	if err == mongo.ErrNoDocuments {
+		_, err := client.Send(chat.Error(chat.ErrCodeInvalid, errors.New("since is not a message in this chat"), ""))
+		return err
+	} else if err != nil {
+		return err
 	}
-	_, err = database.Collection("chat_messages").InsertOne(context.TODO(), chatMsg)
+	cursor, err := messages.Find(ctx,
+		bson.M{"chat_session_id": sessionID, "timestamp": bson.M{"$gte": last.Timestamp}, "_id": bson.M{"$ne": since}},
+		options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(chatReplayLimit+1))
 	if err != nil {
-		log.Println("Failed to save chat message:", err)
+		return err
+	}
+	var missed []models.ChatMessage
+	if err := cursor.All(ctx, &missed); err != nil {
+		return err
 	}
+	status := "complete"
+	if len(missed) > chatReplayLimit {
+		missed, status = missed[:chatReplayLimit], "truncated"
+	}
+	for _, m := range missed {
+		if ok, err := client.SendWait(chat.FromMessage(m)); !ok || err != nil {
+			return err
+		}
+	}
+	_, err = client.Send(chat.Envelope{Type: chat.TypeSystem, ChatID: sessionID.Hex(), Event: chat.EventReplay, Status: status, Timestamp: time.Now()})
+	return err
 }
 
-func getOrCreateChatSession(clientID uint) (*models.ChatSession, error) {
-	var session models.ChatSession
-	err := database.Collection("chat_sessions").FindOne(context.TODO(), map[string]interface{}{"client_id": clientID, "status": "active"}).Decode(&session)
+// notifyChat publishes msg to everyone in msg.ChatID, on whichever
+// instance they are connected.
+func notifyChat(ctx context.Context, msg chat.Envelope) {
+	ctx, span := tracing.Start(ctx, "chat.publish", attribute.String("chat.id", msg.ChatID))
+	payload, err := json.Marshal(msg)
 	if err == nil {
-		return &session, nil
+		// Typing indicators are dropped for clients that cannot keep up,
+		// while anything else disconnects them.
+		err = bus.Publish(ctx, chat.Event{ChatID: msg.ChatID, Payload: payload, Lossy: msg.Type == chat.TypeTyping})
 	}
-	session = models.ChatSession{
-		ClientID:  clientID,
-		Status:    "active",
-		CreatedAt: time.Now(),
+	if err != nil {
+		logging.SubsystemFromContext(ctx, "chat").Errorln("Failed to publish chat message:", err)
 	}
-	_, err = database.Collection("chat_sessions").InsertOne(context.TODO(), session)
+	tracing.End(span, err)
+}
+
+// publishChatClose hangs up on everyone in chatID, on every instance.
+func publishChatClose(ctx context.Context, chatID string) {
+	ctx, span := tracing.Start(ctx, "chat.publish", attribute.String("chat.id", chatID))
+	err := bus.Publish(ctx, chat.Event{ChatID: chatID, Close: "chat closed"})
 	if err != nil {
-		return nil, err
+		logging.SubsystemFromContext(ctx, "chat").Errorln("Failed to publish chat close:", err)
 	}
-	return &session, nil
+	tracing.End(span, err)
+}
+
+// deliverChat hands an event from the bus to the connections on this
+// instance. It never waits on a connection.
+func deliverChat(ctx context.Context, e chat.Event) {
+	_, span := tracing.Start(ctx, "chat.broadcast", attribute.String("chat.id", e.ChatID))
+	span.SetAttributes(attribute.Int("chat.recipients", hub.Deliver(e)))
+	span.End()
+}
+
+// notifyAssignment tells a session's participants which agent now has it.
+func notifyAssignment(ctx context.Context, session models.ChatSession, status string) {
+	notifyChat(ctx, chat.Envelope{
+		Type:      chat.TypeSystem,
+		ChatID:    session.ID.Hex(),
+		Sender:    &chat.Sender{UserID: session.AgentID.Hex(), Name: chatSenderName(ctx, session.AgentID), Role: "agent"},
+		Event:     chat.EventAssignment,
+		Status:    status,
+		Timestamp: time.Now(),
+	})
 }
 
-func extractClientID(r *http.Request) uint {
-	return 1
+// closeChats says goodbye to every WebSocket client with a close frame.
+// http.Server.Shutdown does not track hijacked connections, so without this
+// chats would be cut off mid-stream.
+func closeChats() {
+	hub.Shutdown("server shutting down")
+}
+
+// saveChatMessage stores a message and reports whether it is new. A message
+// resent with a client_msg_id already stored is not stored again; the
+// original is returned instead.
+func saveChatMessage(ctx context.Context, sessionID primitive.ObjectID, msg chat.Envelope) (models.ChatMessage, bool, error) {
+	senderID, _ := primitive.ObjectIDFromHex(msg.Sender.UserID)
+	stored := models.ChatMessage{
+		ID:            primitive.NewObjectID(),
+		ChatSessionID: sessionID,
+		Sender:        msg.Sender.Name,
+		SenderID:      senderID,
+		SenderRole:    msg.Sender.Role,
+		ClientMsgID:   msg.ClientMsgID,
+		Content:       msg.Content,
+		// MongoDB keeps milliseconds; the ack should match replays.
+		Timestamp: msg.Timestamp.Truncate(time.Millisecond),
+	}
+	messages := database.Collection("chat_messages")
+	_, err := messages.InsertOne(ctx, stored)
+	if mongo.IsDuplicateKeyError(err) && msg.ClientMsgID != "" {
+		var original models.ChatMessage
+		err = messages.FindOne(ctx, bson.M{"chat_session_id": sessionID, "sender_id": senderID, "client_msg_id": msg.ClientMsgID}).Decode(&original)
+		return original, false, err
+	}
+	return stored, err == nil, err
+}
+
+// getOrCreateChatSession returns the client's open session, queueing a new
+// one if there is none. A unique index on open sessions per client settles
+// two concurrent starts in favour of the first.
+func getOrCreateChatSession(ctx context.Context, clientID primitive.ObjectID) (*models.ChatSession, error) {
+	sessions := database.Collection("chat_sessions")
+	for attempt := 0; attempt < 2; attempt++ {
+		var session models.ChatSession
+		err := sessions.FindOne(ctx, bson.M{"client_id": clientID, "closed_at": nil}).Decode(&session)
+		if err == nil {
+			return &session, nil
+		} else if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+		session = models.ChatSession{
+			ID:        primitive.NewObjectID(),
+			ClientID:  clientID,
+			Status:    models.ChatStatusWaiting,
+			CreatedAt: time.Now(),
+		}
+		_, err = sessions.InsertOne(ctx, session)
+		if err == nil {
+			return &session, nil
+		} else if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+	}
+	return nil, errors.New("chat session is under contention")
 }
 
 func startChatHandler(w http.ResponseWriter, r *http.Request) {
-	clientID := extractClientID(r)
-	session, err := getOrCreateChatSession(clientID)
+	claims, ok := controllers.SessionClaims(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	session, err := getOrCreateChatSession(r.Context(), claims.UserID)
 	if err != nil {
+		logging.SubsystemFromContext(r.Context(), "chat").Errorf("Failed to start chat session: %v", err)
 		http.Error(w, "Failed to create chat session", http.StatusInternalServerError)
 		return
 	}
+	if session.Status == models.ChatStatusWaiting {
+		assigned, ok, err := desk.AutoAssign(r.Context(), session.ID)
+		if err != nil {
+			logging.SubsystemFromContext(r.Context(), "chat").Errorf("Failed to assign chat session: %v", err)
+		} else if ok {
+			session = &assigned
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(session)
 }
 
 func closeChatHandler(w http.ResponseWriter, r *http.Request) {
-	chatIDStr := r.URL.Query().Get("chat_id")
-	if chatIDStr == "" {
-		http.Error(w, "Missing chat_id", http.StatusBadRequest)
-		return
-	}
-	chatID, err := strconv.ParseUint(chatIDStr, 10, 64)
+	chatID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("chat_id"))
 	if err != nil {
 		http.Error(w, "Invalid chat_id", http.StatusBadRequest)
 		return
 	}
 	now := time.Now()
-	_, err = database.Collection("chat_sessions").UpdateOne(context.TODO(), map[string]interface{}{"id": uint(chatID)}, map[string]interface{}{"$set": map[string]interface{}{"status": "closed", "closed_at": now}})
-	if err != nil {
+	sessions := database.Collection("chat_sessions")
+	var before bson.M
+	// Only an open chat is closed, so a repeated request neither overwrites
+	// closed_at nor records a second audit entry.
+	err = sessions.FindOneAndUpdate(r.Context(),
+		bson.M{"_id": chatID, "status": bson.M{"$ne": models.ChatStatusClosed}},
+		bson.M{"$set": bson.M{"status": models.ChatStatusClosed, "closed_at": now}}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		if n, err := sessions.CountDocuments(r.Context(), bson.M{"_id": chatID}); err == nil && n > 0 {
+			http.Error(w, "Chat is already closed", http.StatusConflict)
+		} else {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+		}
+		return
+	} else if err != nil {
 		http.Error(w, "Failed to close chat", http.StatusInternalServerError)
 		return
 	}
-	mutex.Lock()
-	if conns, ok := activeChats[chatIDStr]; ok {
-		for conn := range conns {
-			conn.Close()
-			delete(conns, conn)
-		}
-		delete(activeChats, chatIDStr)
+	after := bson.M{}
+	for field, value := range before {
+		after[field] = value
+	}
+	after["status"] = models.ChatStatusClosed
+	after["closed_at"] = now
+	controllers.RecordAudit(w, r, controllers.AuditChatClose, "chat_session", chatID.Hex(), before, after)
+	if assignedAt, ok := before["assigned_at"].(primitive.DateTime); ok && before["status"] == models.ChatStatusActive {
+		metrics.ChatHandleTime.Observe(now.Sub(assignedAt.Time()).Seconds())
+		// The agent has room for another chat.
+		assignWaiting(context.WithoutCancel(r.Context()))
 	}
-	mutex.Unlock()
+	publishChatClose(context.WithoutCancel(r.Context()), chatID.Hex())
 	w.Write([]byte("Chat closed successfully"))
 }
 
 func chatHistoryHandler(w http.ResponseWriter, r *http.Request) {
-	chatIDStr := r.URL.Query().Get("chat_id")
-	if chatIDStr == "" {
-		http.Error(w, "Missing chat_id", http.StatusBadRequest)
+	session, ok := chatSession(w, r, controllers.PermChatsRead)
+	if !ok {
 		return
 	}
-	chatID, err := strconv.ParseUint(chatIDStr, 10, 64)
+	messages := []models.ChatMessage{}
+	cursor, err := database.Collection("chat_messages").Find(r.Context(),
+		bson.M{"chat_session_id": session.ID},
+		options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}}))
 	if err != nil {
-		http.Error(w, "Invalid chat_id", http.StatusBadRequest)
+		http.Error(w, "Failed to load chat history", http.StatusInternalServerError)
 		return
 	}
-	var messages []models.ChatMessage
-	cursor, err := database.Collection("chat_messages").Find(context.TODO(), map[string]interface{}{"chat_session_id": uint(chatID)})
-	if err != nil {
+	if err := cursor.All(r.Context(), &messages); err != nil {
 		http.Error(w, "Failed to load chat history", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.TODO())
-	for cursor.Next(context.TODO()) {
-		var message models.ChatMessage
-		cursor.Decode(&message)
-		messages = append(messages, message)
-	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(messages)
 }
 
 type ActiveChat struct {
-	ChatID    string `json:"chat_id"`
-	Client    string `json:"client"`
-	StartedAt string `json:"started_at"`
-	Clients   int    `json:"clients"`
+	ChatID      string  `json:"chat_id"`
+	Client      string  `json:"client"`
+	StartedAt   string  `json:"started_at"`
+	Clients     int     `json:"clients"`
+	Status      string  `json:"status"`
+	Agent       string  `json:"agent,omitempty"`
+	WaitSeconds float64 `json:"wait_seconds"`
 }
 
+// activeChatsHandler lists the support queue: waiting sessions in the order
+// they will be served, then the active ones, with how many sockets each has
+// open on this instance.
 func activeChatsHandler(w http.ResponseWriter, r *http.Request) {
-	var chats []ActiveChat
-	mutex.Lock()
-	for id, conns := range activeChats {
-		if len(conns) > 0 {
-			sessionID, err := strconv.ParseUint(id, 10, 64)
-			clientStr := "Unknown"
-			startedAt := "Unknown"
-			if err == nil {
-				var session models.ChatSession
-				err := database.Collection("chat_sessions").FindOne(context.TODO(), map[string]interface{}{"id": uint(sessionID)}).Decode(&session)
-				if err == nil {
-					clientStr = strconv.Itoa(int(session.ClientID))
-					startedAt = session.CreatedAt.Format("2006-01-02 15:04:05")
-				}
-			}
-			chats = append(chats, ActiveChat{
-				ChatID:    id,
-				Client:    clientStr,
-				StartedAt: startedAt,
-				Clients:   len(conns),
-			})
+	sessions, err := desk.Open(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to load chats", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	chats := []ActiveChat{}
+	conns := hub.Connections()
+	for _, session := range sessions {
+		chat := ActiveChat{
+			ChatID:    session.ID.Hex(),
+			Client:    session.ClientID.Hex(),
+			StartedAt: session.CreatedAt.Format("2006-01-02 15:04:05"),
+			Clients:   conns[session.ID.Hex()],
+			Status:    session.Status,
+		}
+		waitedUntil := now
+		if session.AssignedAt != nil {
+			waitedUntil = *session.AssignedAt
+			chat.Agent = session.AgentID.Hex()
 		}
+		chat.WaitSeconds = waitedUntil.Sub(session.CreatedAt).Seconds()
+		chats = append(chats, chat)
 	}
-	mutex.Unlock()
+	sort.SliceStable(chats, func(i, j int) bool {
+		return chats[i].Status == models.ChatStatusWaiting && chats[j].Status != models.ChatStatusWaiting
+	})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(chats)
 }
 
-type RateLimiter struct {
-	limiter *rate.Limiter
-	mutex   sync.Mutex
+// supportError maps desk errors to responses.
+func supportError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, support.ErrNotFound):
+		http.Error(w, "Chat not found", http.StatusNotFound)
+	case errors.Is(err, support.ErrNotWaiting), errors.Is(err, support.ErrNotActive),
+		errors.Is(err, support.ErrSameAgent), errors.Is(err, support.ErrChanged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		logging.SubsystemFromContext(r.Context(), "chat").Errorf("Support desk error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
 }
 
-func NewRateLimiter(rps int, burst int) *RateLimiter {
-	return &RateLimiter{
-		limiter: rate.NewLimiter(rate.Limit(rps), burst),
+func claimChatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+	claims, _ := controllers.SessionClaims(r)
+	chatID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("chat_id"))
+	if err != nil {
+		http.Error(w, "Invalid chat_id", http.StatusBadRequest)
+		return
+	}
+	session, err := desk.Claim(r.Context(), chatID, claims.UserID)
+	if err != nil {
+		supportError(w, r, err)
+		return
+	}
+	notifyAssignment(context.WithoutCancel(r.Context()), session, "assigned")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
 }
 
-func (rl *RateLimiter) Allow() bool {
-	rl.mutex.Lock()
-	defer rl.mutex.Unlock()
-	return rl.limiter.Allow()
+// transferChatHandler hands an active chat to another agent. Only the agent
+// handling the chat, or a super admin, can give it away.
+func transferChatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, _ := controllers.SessionClaims(r)
+	chatID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("chat_id"))
+	if err != nil {
+		http.Error(w, "Invalid chat_id", http.StatusBadRequest)
+		return
+	}
+	to, err := primitive.ObjectIDFromHex(r.URL.Query().Get("agent_id"))
+	if err != nil {
+		http.Error(w, "Invalid agent_id", http.StatusBadRequest)
+		return
+	}
+	isAgent, err := controllers.UserHasPermission(r.Context(), to, controllers.PermChatsModerate)
+	if err != nil {
+		supportError(w, r, err)
+		return
+	}
+	if !isAgent {
+		http.Error(w, "Chats can only be transferred to support agents", http.StatusBadRequest)
+		return
+	}
+
+	var current models.ChatSession
+	err = database.Collection("chat_sessions").FindOne(r.Context(), bson.M{"_id": chatID}).Decode(&current)
+	if err == mongo.ErrNoDocuments {
+		supportError(w, r, support.ErrNotFound)
+		return
+	} else if err != nil {
+		supportError(w, r, err)
+		return
+	}
+	if current.AgentID != claims.UserID && !claims.HasPermission("*") {
+		http.Error(w, "Only the agent handling this chat can transfer it", http.StatusForbidden)
+		return
+	}
+
+	before, after, err := desk.Transfer(r.Context(), chatID, to)
+	if err != nil {
+		supportError(w, r, err)
+		return
+	}
+	controllers.RecordAudit(w, r, controllers.AuditChatTransfer, "chat_session", chatID.Hex(),
+		bson.M{"agent_id": before.AgentID}, bson.M{"agent_id": after.AgentID})
+	notifyAssignment(context.WithoutCancel(r.Context()), after, "transferred")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(after)
 }
 
-func rateLimitedHandler(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if !rlimiter.Allow() {
-			w.Header().Set("Content-Type", "text/html")
-			w.WriteHeader(http.StatusTooManyRequests)
-			_, err := w.Write([]byte("<script>alert('Too Many Requests. Please try again later.');</script>"))
-			if err != nil {
-				logger.WithError(err).Error("Failed to write alert response for rate limiting")
-			}
+// agentAvailabilityHandler puts the calling agent on or off duty.
+func agentAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, _ := controllers.SessionClaims(r)
+	var req struct {
+		Available *bool `json:"available"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Available == nil {
+		http.Error(w, `Body must be {"available": true|false}`, http.StatusBadRequest)
+		return
+	}
+	agent, err := desk.SetAvailable(r.Context(), claims.UserID, *req.Available)
+	if err != nil {
+		supportError(w, r, err)
+		return
+	}
+	if agent.Available {
+		assignWaiting(context.WithoutCancel(r.Context()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agent)
+}
+
+// supportStatsHandler reports the queue and wait and handle times over the
+// window given by ?since= (a duration, default 24h).
+func supportStatsHandler(w http.ResponseWriter, r *http.Request) {
+	window := 24 * time.Hour
+	if value := r.URL.Query().Get("since"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			http.Error(w, "since must be a positive duration such as 24h", http.StatusBadRequest)
 			return
 		}
-		next(w, r)
+		window = d
+	}
+	stats, err := desk.Stats(r.Context(), time.Now().Add(-window))
+	if err != nil {
+		supportError(w, r, err)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
 }
 
-func initLogger() {
-	file, err := os.OpenFile("user_actions.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+// assignWaiting hands queued sessions to available agents and tells the
+// sessions' participants.
+func assignWaiting(ctx context.Context) {
+	assigned, err := desk.AssignWaiting(ctx)
 	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
+		logging.Subsystem("chat").Errorf("Failed to assign waiting chats: %v", err)
+	}
+	for _, session := range assigned {
+		notifyAssignment(ctx, session, "assigned")
 	}
-	logger.SetOutput(file)
-	logger.SetFormatter(&logrus.JSONFormatter{})
-	logger.SetLevel(logrus.InfoLevel)
 }
 
-func logAction(fields logrus.Fields, message string) {
-	logger.WithFields(fields).Info(message)
+// runAssigner retries the queue periodically, which picks up capacity freed
+// on other instances.
+func runAssigner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			assignWaiting(ctx)
+		}
+	}
 }
 
-var movieCollection *mongo.Collection
+// Route budgets, set from the configuration by setRateLimits. Anonymous
+// endpoints are keyed by IP; endpoints used after login count against the
+// user so clients behind one NAT don't share a budget.
+var (
+	rateLimits ratelimit.Limiter = ratelimit.NewTokenBucket(10 * time.Minute)
 
-func initDatabase() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+	loginLimit, signupLimit, passwordLimit, checkoutLimit, apiLimit ratelimit.Policy
+
+	byUser = ratelimit.FirstOf(func(r *http.Request) string {
+		if id := controllers.SessionUserID(r); id != "" {
+			return "user:" + id
+		}
+		return ""
+	})
+)
+
+func setRateLimits(cfg config.RateLimit) {
+	policy := func(name string, budget config.Budget) ratelimit.Policy {
+		return ratelimit.Policy{Name: name, Limit: budget.Limit, Window: budget.Window}
 	}
+	loginLimit = policy("login", cfg.Login)
+	signupLimit = policy("signup", cfg.Signup)
+	passwordLimit = policy("password", cfg.Password)
+	checkoutLimit = policy("checkout", cfg.Checkout)
+	apiLimit = policy("api", cfg.API)
+}
 
-	clientOptions := options.Client().ApplyURI(os.Getenv("MONGODB_URI"))
-	client, err = mongo.Connect(context.TODO(), clientOptions)
-	if err != nil {
-		log.Fatal("Failed to connect to MongoDB:", err)
+func rateLimitedHandler(policy ratelimit.Policy, key ratelimit.KeyFunc, next http.HandlerFunc) http.HandlerFunc {
+	return ratelimit.Middleware(rateLimits, policy, key)(next).ServeHTTP
+}
+
+// mongoMonitor feeds driver command events to both metrics and tracing.
+func mongoMonitor() *event.CommandMonitor {
+	monitors := []*event.CommandMonitor{metrics.MongoMonitor(), tracing.MongoMonitor()}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, e)
+				}
+			}
+		},
 	}
+}
 
-	err = client.Ping(context.TODO(), nil)
+func initTracing(cfg config.Tracing) func(context.Context) error {
+	shutdown, err := tracing.Setup(context.Background(), tracing.Config{Exporter: cfg.Exporter, ServiceName: cfg.ServiceName})
 	if err != nil {
-		log.Fatal("Failed to ping MongoDB:", err)
+		log.Fatalf("Failed to set up tracing: %v", err)
 	}
+	return shutdown
+}
 
-	database = client.Database(os.Getenv("MONGODB_DATABASE"))
-	movieCollection = database.Collection("movies")
+func initLogger(cfg config.Logging) {
+	err := logging.Configure(logging.Config{
+		Outputs: cfg.Outputs,
+		File:    logging.FileConfig(cfg.File),
+		Syslog:  logging.SyslogConfig(cfg.Syslog),
+		Level:   cfg.Level,
+		Levels:  cfg.Levels,
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	logging.RedirectStdlib()
+}
 
-	log.Println("Database connected successfully")
+func logAction(r *http.Request, fields logrus.Fields, message string) {
+	logging.FromContext(r.Context()).WithFields(fields).Info(message)
 }
+
 func handlePostRequest(w http.ResponseWriter, r *http.Request) {
 	var input map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
-		logger.WithError(err).Error("Invalid JSON format in POST request")
+		logging.FromContext(r.Context()).WithError(err).Warn("Invalid JSON format in POST request")
 		return
 	}
 	message, ok := input["message"].(string)
 	if !ok || message == "" {
 		http.Error(w, "Invalid JSON message", http.StatusBadRequest)
-		logger.Error("Invalid or empty JSON message in POST request")
+		logging.FromContext(r.Context()).Warn("Invalid or empty JSON message in POST request")
 		return
 	}
-	logAction(logrus.Fields{
+	logAction(r, logrus.Fields{
 		"message": message,
 		"action":  "post_request",
 	}, "POST request received")
@@ -373,7 +791,7 @@ func handlePostRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleGetRequest(w http.ResponseWriter, r *http.Request) {
-	logAction(logrus.Fields{"action": "get_request"}, "GET request received")
+	logAction(r, logrus.Fields{"action": "get_request"}, "GET request received")
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(models.Response{
 		Status:  "success",
@@ -381,13 +799,274 @@ func handleGetRequest(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// verifyAudit backs the verify-audit command and returns the exit status.
+func verifyAudit() int {
+	entries, head, err := controllers.VerifyAuditChain(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Audit log verification failed after %d valid entries: %v\n", entries, err)
+		return 1
+	}
+	fmt.Printf("Audit log OK: %d entries, head %s\n", entries, head)
+	return 0
+}
+
+// migrate backs the migrate command and returns the exit status.
+func migrate(runner *migrations.Runner, args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "Usage: movieverse migrate up | down [steps] | status")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := runner.Up(ctx)
+		for _, version := range applied {
+			fmt.Printf("Applied %d\n", version)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("Database is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return usage()
+			}
+			steps = n
+		}
+		reverted, err := runner.Down(ctx, steps)
+		for _, version := range reverted {
+			fmt.Printf("Reverted %d\n", version)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Rollback failed: %v\n", err)
+			return 1
+		}
+	case "status":
+		states, err := runner.Status(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read migration status: %v\n", err)
+			return 1
+		}
+		out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(out, "VERSION\tAPPLIED\tDESCRIPTION")
+		for _, state := range states {
+			applied := "pending"
+			if state.Applied {
+				applied = state.AppliedAt.Format(time.RFC3339)
+			}
+			description := state.Description
+			if state.Unknown {
+				description += " (not in this build)"
+			}
+			fmt.Fprintf(out, "%d\t%s\t%s\n", state.Version, applied, description)
+		}
+		out.Flush()
+	default:
+		return usage()
+	}
+	return 0
+}
+
+const commandUsage = "Usage: movieverse [flags] [migrate up | down [steps] | status | verify-audit]"
+
+// runCommand runs a maintenance subcommand and returns the exit status.
+// Commands only talk to the database, so only the settings they use are
+// validated; they work without the mail and token settings the server needs.
+func runCommand(cfg config.Config, args []string) int {
+	var err error
+	switch args[0] {
+	case "migrate":
+		err = cfg.ValidateMongo()
+	case "verify-audit":
+		err = errors.Join(cfg.ValidateMongo(), cfg.ValidateAuditKey())
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n%s\n", args[0], commandUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	initLogger(cfg.Logging)
+	defer logging.Close()
+	mongoDB := connectMongo(cfg.Mongo)
+	defer mongoDB.Close(context.Background())
+	if args[0] == "verify-audit" {
+		controllers.SetAuditKey(cfg.Auth.AuditKey)
+		return verifyAudit()
+	}
+	runner, err := migrations.New(mongoDB.Database(), migrations.All)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid migrations: %v\n", err)
+		return 1
+	}
+	return migrate(runner, args[1:])
+}
+
+// migrationPollInterval is how often startup checks on migrations another
+// instance is applying.
+var migrationPollInterval = 2 * time.Second
+
+// applyMigrations runs pending migrations at startup, or only warns about
+// them when auto-migration is off. A migration that fails stops the ones
+// after it, so the error is returned for startup to fail on rather than
+// leave the server running on a half-migrated database. When another
+// instance holds the lock, startup waits up to wait for it to finish.
+func applyMigrations(runner *migrations.Runner, auto bool, wait time.Duration) error {
+	logger := logging.Subsystem("migrations")
+	if !auto {
+		pending, err := runner.Pending(context.Background())
+		if err != nil {
+			logger.Errorf("Failed to check migrations: %v", err)
+		} else if pending > 0 {
+			logger.Warnf("%d migrations are pending; run \"movieverse migrate up\"", pending)
+		}
+		return nil
+	}
+	_, err := runner.Up(context.Background())
+	if !errors.Is(err, migrations.ErrLocked) {
+		return err
+	}
+
+	logger.Info("Another instance is applying migrations, waiting for it to finish")
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	ticker := time.NewTicker(migrationPollInterval)
+	defer ticker.Stop()
+	for {
+		pending, err := runner.Pending(ctx)
+		if err == nil && pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("waiting for migrations: %w", err)
+			}
+			return fmt.Errorf("%d migrations still pending after %v", pending, wait)
+		case <-ticker.C:
+		}
+	}
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		// Generous enough for the data export; WebSockets are unaffected
+		// because the upgrader clears deadlines after hijacking.
+		WriteTimeout: 60 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+}
+
 func main() {
-	connectDB()
-	controllers.SetClient(client)
-	initLogger()
-	initDatabase()
+	cfg, invocation, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if len(invocation.Args) > 0 {
+		os.Exit(runCommand(cfg, invocation.Args))
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if invocation.PrintConfig {
+		if err := cfg.Write(os.Stdout); err != nil {
+			log.Fatalf("Failed to print configuration: %v", err)
+		}
+		return
+	}
 
-	rlimiter = NewRateLimiter(1, 1)
+	initLogger(cfg.Logging)
+	shutdownTracing := initTracing(cfg.Tracing)
+	mongoDB := connectMongo(cfg.Mongo)
+	runner, err := migrations.New(mongoDB.Database(), migrations.All)
+	if err != nil {
+		log.Fatalf("Invalid migrations: %v", err)
+	}
+	controllers.SetAuditKey(cfg.Auth.AuditKey)
+	if err := applyMigrations(runner, cfg.Mongo.AutoMigrate, cfg.Mongo.MigrationWait); err != nil {
+		log.Fatalf("Failed to apply migrations: %v", err)
+	}
+	controllers.SetPublicURL(cfg.Server.PublicURL)
+	controllers.SetSMTPSettings(controllers.SMTPSettings(cfg.SMTP))
+	controllers.SetJWTSecret(cfg.Auth.JWTSecret)
+
+	passwordPolicy, err := controllers.LoadPasswordPolicy(controllers.PasswordSettings(cfg.Password))
+	if err != nil {
+		log.Fatalf("Invalid password policy: %v", err)
+	}
+	controllers.SetPasswordPolicy(passwordPolicy)
+	controllers.SetLockoutPolicy(controllers.LockoutPolicy(cfg.Lockout))
+	controllers.SetRequireAdminTwoFactor(cfg.Auth.RequireAdmin2FA)
+
+	for _, provider := range cfg.OIDC.Providers {
+		controllers.RegisterOIDCProvider(&controllers.OIDCProvider{
+			Name:         provider.Name,
+			Issuer:       provider.Issuer,
+			ClientID:     provider.ClientID,
+			ClientSecret: provider.ClientSecret,
+			RedirectURL:  provider.RedirectURL,
+		})
+	}
+	setRateLimits(cfg.RateLimit)
+
+	controllers.SetAccountDeletionGrace(cfg.Retention.AccountDeletionGrace)
+	controllers.SetActivityRetention(cfg.Retention.Activity)
+
+	// Background work stops on SIGTERM or Ctrl+C, before the server
+	// drains, and is waited for before the database connection closes.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	workers, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	var running sync.WaitGroup
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		controllers.RunAccountPurger(workers, time.Hour)
+	}()
+
+	strategy, err := support.ParseStrategy(cfg.Support.Assignment)
+	if err != nil {
+		log.Fatalf("Invalid support configuration: %v", err)
+	}
+	desk = support.NewDesk(database, strategy, cfg.Support.MaxChatsPerAgent)
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		runAssigner(workers, 30*time.Second)
+	}()
+
+	if cfg.RateLimit.Store == "mongo" {
+		rateLimits = ratelimit.NewSlidingWindow(ratelimit.NewMongoStore(database.Collection("rate_limits")))
+	}
+	if cfg.Chat.Bus == "mongo" {
+		bus = chat.NewMongoBus(database.Collection("chat_events"))
+	}
+	if err := bus.Subscribe(workers, deliverChat); err != nil {
+		log.Fatalf("Failed to subscribe to the chat bus: %v", err)
+	}
+
+	if err := metrics.RegisterChat(hub); err != nil {
+		log.Fatalf("Failed to register chat metrics: %v", err)
+	}
+	http.Handle("/metrics", metrics.Handler(cfg.Metrics.Token))
 
 	http.Handle("/", controllers.ValidateJWT(controllers.UsersOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		absPath, err := filepath.Abs("static/index.html")
@@ -402,27 +1081,66 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		log.Printf("Handling request for: %s", r.URL.Path)
 		http.ServeFile(w, r, absPath)
 	}))))
 
-	http.Handle("/admin.html", controllers.ValidateJWT(controllers.AdminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/admin.html", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermAdminDashboard)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "static/admin.html")
 	}))))
 
-	http.Handle("/start-chat", controllers.ValidateJWT(controllers.UsersOnly(http.HandlerFunc(startChatHandler))))
+	http.Handle("/start-chat", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermChatsUse)(http.HandlerFunc(startChatHandler))))
 	http.Handle("/chat-history", controllers.ValidateJWT(controllers.UsersOnly(http.HandlerFunc(chatHistoryHandler))))
-	http.Handle("/admin/active-chats", controllers.ValidateJWT(controllers.AdminOnly(http.HandlerFunc(activeChatsHandler))))
-	http.Handle("/close-chat", controllers.ValidateJWT(controllers.AdminOnly(http.HandlerFunc(closeChatHandler))))
-	http.Handle("/checkout", rateLimitedHandler(controllers.Checkout))
-	http.Handle("/search", http.HandlerFunc(controllers.SearchAndFilterMovies))
-	http.HandleFunc("/admin/dashboard", controllers.GetAnalyticsDashboard)
-	http.HandleFunc("/post", rateLimitedHandler(func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/admin/active-chats", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermChatsRead)(http.HandlerFunc(activeChatsHandler))))
+	http.Handle("/close-chat", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermChatsModerate)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			closeChatHandler(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+	http.Handle("/support/claim", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermChatsModerate)(http.HandlerFunc(claimChatHandler))))
+	http.Handle("/support/transfer", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermChatsModerate)(http.HandlerFunc(transferChatHandler))))
+	http.Handle("/support/availability", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermChatsModerate)(http.HandlerFunc(agentAvailabilityHandler))))
+	http.Handle("/support/stats", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermChatsRead)(http.HandlerFunc(supportStatsHandler))))
+	http.Handle("/checkout", rateLimitedHandler(checkoutLimit, byUser, controllers.ValidateJWT(controllers.RequirePermission(controllers.PermOrdersCreate)(controllers.TrackActivity(controllers.ActivityCheckout)(http.HandlerFunc(controllers.Checkout)))).ServeHTTP))
+	http.Handle("/search", controllers.TrackActivity(controllers.ActivitySearch)(http.HandlerFunc(controllers.SearchAndFilterMovies)))
+	http.Handle("/movie", controllers.TrackActivity(controllers.ActivityViewMovie)(http.HandlerFunc(controllers.GetMovieByID)))
+	http.Handle("/admin/audit", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermAuditRead)(http.HandlerFunc(controllers.GetAuditLog))))
+	http.Handle("/admin/audit/verify", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermAuditRead)(http.HandlerFunc(controllers.VerifyAuditLog))))
+	http.Handle("/admin/activity", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermActivityRead)(http.HandlerFunc(controllers.GetActivityLogs))))
+	http.Handle("/admin/dashboard", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermAnalyticsRead)(http.HandlerFunc(controllers.GetAnalyticsDashboard))))
+	http.Handle("/admin/users", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermUsersRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			controllers.GetUsers(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+	deleteUser := controllers.RequirePermission(controllers.PermUsersManage)(http.HandlerFunc(controllers.DeleteUser))
+	http.Handle("/admin/user", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermUsersRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			controllers.GetUserByID(w, r)
+		case http.MethodDelete:
+			deleteUser.ServeHTTP(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+	http.Handle("/admin/roles", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermRolesAssign)(http.HandlerFunc(controllers.ListRoles))))
+	http.Handle("/admin/users/roles", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermRolesAssign)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			controllers.AssignRoles(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+	http.HandleFunc("/post", rateLimitedHandler(apiLimit, byUser, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			handlePostRequest(w, r)
 		} else {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-			logger.Warn("Invalid request method for /post endpoint")
+			logging.FromContext(r.Context()).Warn("Invalid request method for /post endpoint")
 		}
 	}))
 
@@ -433,14 +1151,14 @@ func main() {
 		http.ServeFile(w, r, "static/login.html")
 	})
 
-	http.Handle("/login", rateLimitedHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/login", rateLimitedHandler(loginLimit, ratelimit.ByIP, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			controllers.LoginUser(w, r)
 		} else {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})))
-	http.Handle("/signup", rateLimitedHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/signup", rateLimitedHandler(signupLimit, ratelimit.ByIP, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
 			controllers.CreateUser(w, r)
@@ -449,7 +1167,110 @@ func main() {
 		}
 	})))
 
-	http.Handle("/logout", controllers.ValidateJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/auth/oidc/login", controllers.OIDCLogin)
+	http.HandleFunc("/auth/oidc/callback", controllers.OIDCCallback)
+	http.Handle("/me", controllers.ValidateJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			controllers.GetProfile(w, r)
+		case http.MethodPatch:
+			controllers.UpdateProfile(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.Handle("/me/avatar", controllers.ValidateJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			controllers.UploadAvatar(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.Handle("/me/export", controllers.ValidateJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			controllers.ExportMyData(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.Handle("/me/delete", controllers.ValidateJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			controllers.RequestAccountDeletion(w, r)
+		case http.MethodDelete:
+			controllers.CancelAccountDeletion(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.HandleFunc("/verify-email-change", controllers.VerifyEmailChange)
+	http.Handle("/login/2fa", rateLimitedHandler(loginLimit, ratelimit.ByIP, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			controllers.LoginTwoFactor(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.Handle("/2fa/enroll", controllers.ValidateJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			controllers.EnrollTwoFactor(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.Handle("/2fa/verify", controllers.ValidateJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			controllers.VerifyTwoFactor(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.Handle("/2fa/disable", controllers.ValidateJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			controllers.DisableTwoFactor(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.Handle("/password/forgot", rateLimitedHandler(passwordLimit, ratelimit.ByIP, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			controllers.ForgotPassword(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.Handle("/password/reset", rateLimitedHandler(passwordLimit, ratelimit.ByIP, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			controllers.ResetPassword(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.Handle("/password/change", controllers.ValidateJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			controllers.ChangePassword(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	http.HandleFunc("/unlock-account", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			controllers.UnlockAccount(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	http.HandleFunc("/unlock-account.html", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/unlock-account.html")
+	})
+	http.HandleFunc("/reset-password.html", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/reset-password.html")
+	})
+	http.HandleFunc("/oidc-callback.html", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "static/oidc-callback.html")
+	})
+
+	http.Handle("/logout", controllers.ValidateJWT(controllers.TrackActivity(controllers.ActivityLogout)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			http.SetCookie(w, &http.Cookie{
 				Name:     "userToken",
@@ -464,7 +1285,7 @@ func main() {
 		} else {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
-	})))
+	}))))
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
@@ -472,35 +1293,78 @@ func main() {
 		controllers.VerifyEmail(w, r)
 	})
 
-	http.HandleFunc("/get", rateLimitedHandler(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/get", rateLimitedHandler(apiLimit, byUser, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			handleGetRequest(w, r)
 		} else {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-			logger.Warn("Invalid request method for /get endpoint")
+			logging.FromContext(r.Context()).Warn("Invalid request method for /get endpoint")
 		}
 	}))
 
-	http.HandleFunc("/movies", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			controllers.GetMovies(w, r)
-		} else if r.Method == http.MethodPost {
+	writeMovies := controllers.ValidateJWT(controllers.RequirePermission(controllers.PermMoviesWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
 			controllers.CreateMovie(w, r)
-		} else if r.Method == http.MethodPut {
+		case http.MethodPut:
 			controllers.UpdateMovie(w, r)
-		} else if r.Method == http.MethodDelete {
+		case http.MethodDelete:
 			controllers.DeleteMovie(w, r)
+		}
+	})))
+	http.HandleFunc("/movies", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			controllers.GetMovies(w, r)
+		} else if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete {
+			writeMovies.ServeHTTP(w, r)
 		} else {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		}
 
 	}))
 
-	http.HandleFunc("/ws", handleConnections)
-	go handleMessages()
+	http.Handle("/ws", controllers.ValidateJWT(controllers.RequirePermission(controllers.PermChatsUse)(http.HandlerFunc(handleConnections))))
+
+	checker := health.NewChecker(2 * time.Second)
+	checker.Register("mongo", mongoDB.Ping)
+	// Dialling SMTP on every probe would be noticed by the mail provider,
+	// and email is not needed to serve most requests.
+	checker.RegisterOptional("mailer", health.Cached(controllers.CheckMailer, time.Minute))
+	http.HandleFunc("/healthz", checker.Live)
+	http.HandleFunc("/readyz", checker.Ready)
+
+	server := newServer(cfg.Server.Addr, logging.Middleware(tracing.Middleware(metrics.Middleware(http.DefaultServeMux))))
+	server.RegisterOnShutdown(closeChats)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	logging.Logger().Infof("Server listening on %s", cfg.Server.Addr)
 
-	log.Println("WebSocket server started on ws://localhost:8080/ws")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	select {
+	case err := <-serverErr:
 		log.Fatal("Error: ", err)
+	case <-ctx.Done():
+	}
+	stop()
+	stopWorkers()
+
+	logging.Logger().Info("Shutting down, draining in-flight requests")
+	checker.Drain()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logging.Logger().Errorf("Failed to drain requests: %v", err)
+	}
+	running.Wait()
+	bus.Wait()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logging.Logger().Errorf("Failed to flush traces: %v", err)
+	}
+	if err := mongoDB.Close(shutdownCtx); err != nil {
+		logging.Logger().Errorf("Failed to disconnect from MongoDB: %v", err)
 	}
+	logging.Logger().Info("Shutdown complete")
+	logging.Close()
 }
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ChatStats is implemented by the chat hub. Both methods are called on
+// every scrape and must be safe for concurrent use.
+type ChatStats interface {
+	// Connections returns the number of open WebSocket connections per
+	// chat ID.
+	Connections() map[string]int
+	// QueueDepth returns the number of messages waiting to be written to
+	// connections.
+	QueueDepth() int
+}
+
+var (
+	chatConnectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "chat", "connections"),
+		"Open WebSocket connections per chat.",
+		[]string{"chat_id"}, nil,
+	)
+	chatQueueDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "chat", "broadcast_queue_depth"),
+		"Chat messages waiting in per-connection send queues.",
+		nil, nil,
+	)
+)
+
+type chatCollector struct {
+	stats ChatStats
+}
+
+func (c chatCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- chatConnectionsDesc
+	ch <- chatQueueDesc
+}
+
+func (c chatCollector) Collect(ch chan<- prometheus.Metric) {
+	for chatID, conns := range c.stats.Connections() {
+		ch <- prometheus.MustNewConstMetric(chatConnectionsDesc, prometheus.GaugeValue, float64(conns), chatID)
+	}
+	ch <- prometheus.MustNewConstMetric(chatQueueDesc, prometheus.GaugeValue, float64(c.stats.QueueDepth()))
+}
+
+// RegisterChat reads the chat gauges from stats at scrape time, so the hub
+// does not have to keep them up to date itself.
+func RegisterChat(stats ChatStats) error {
+	return Registry.Register(chatCollector{stats: stats})
+}
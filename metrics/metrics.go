@@ -0,0 +1,156 @@
+// Package metrics exposes the application's Prometheus metrics.
+package metrics
+
+import (
+	"crypto/subtle"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "movieverse"
+
+// Registry holds every MovieVerse collector plus the Go runtime and process
+// collectors. A dedicated registry keeps tests free of global state left
+// behind by libraries that register with the default one.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route pattern, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	RateLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ratelimit",
+		Name:      "rejections_total",
+		Help:      "Requests rejected with 429 by rate limit policy.",
+	}, []string{"policy"})
+
+	MongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "mongo",
+		Name:      "command_duration_seconds",
+		Help:      "MongoDB command latency by command name and outcome.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command", "outcome"})
+
+	Checkouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "checkout",
+		Name:      "orders_total",
+		Help:      "Checkout attempts that reached order creation, by outcome.",
+	}, []string{"outcome"})
+
+	CheckoutRevenue = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "checkout",
+		Name:      "revenue_total",
+		Help:      "Sum of the totals of successfully placed orders.",
+	})
+
+	ChatAssignments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "support",
+		Name:      "assignments_total",
+		Help:      "Chat sessions handed to an agent, by how: claim, auto or transfer.",
+	}, []string{"how"})
+
+	ChatWaitTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "support",
+		Name:      "wait_seconds",
+		Help:      "Time chat sessions spent in the queue before an agent was assigned.",
+		Buckets:   []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	})
+
+	ChatHandleTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "support",
+		Name:      "handle_seconds",
+		Help:      "Time from assignment to close of chat sessions.",
+		Buckets:   []float64{60, 180, 300, 600, 900, 1800, 3600, 7200},
+	})
+
+	ChatSlowConsumers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "chat",
+		Name:      "slow_consumers_total",
+		Help:      "Chat messages a connection could not take because its send queue was full, by action: dropped or disconnected.",
+	}, []string{"action"})
+
+	FailedLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "failed_logins_total",
+		Help:      "Rejected login attempts by reason.",
+	}, []string{"reason"})
+)
+
+// Reasons used with FailedLogins.
+const (
+	LoginUnknownUser     = "unknown_user"
+	LoginBadPassword     = "bad_password"
+	LoginBadSecondFactor = "bad_second_factor"
+	LoginLocked          = "locked"
+	LoginThrottled       = "throttled"
+)
+
+// Ways a session reaches an agent, used with ChatAssignments.
+const (
+	AssignClaim    = "claim"
+	AssignAuto     = "auto"
+	AssignTransfer = "transfer"
+)
+
+// What happens to a chat connection whose send queue is full, used with
+// ChatSlowConsumers.
+const (
+	SlowConsumerDropped      = "dropped"
+	SlowConsumerDisconnected = "disconnected"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		RateLimitRejections,
+		MongoDuration,
+		Checkouts,
+		CheckoutRevenue,
+		ChatAssignments,
+		ChatWaitTime,
+		ChatHandleTime,
+		ChatSlowConsumers,
+		FailedLogins,
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format. When
+// token is not empty, scrapes must send it as a bearer token.
+func Handler(token string) http.Handler {
+	metrics := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		if token != "" && subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
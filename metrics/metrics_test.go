@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware_LabelsByRoutePattern(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /movies/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := Middleware(mux)
+
+	before := testutil.ToFloat64(HTTPRequests.WithLabelValues("GET /movies/{id}", "GET", "418"))
+	for _, id := range []string{"1", "2", "3"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/movies/"+id, nil))
+	}
+	if got := testutil.ToFloat64(HTTPRequests.WithLabelValues("GET /movies/{id}", "GET", "418")) - before; got != 3 {
+		t.Errorf("Expected 3 requests on the pattern, got %v", got)
+	}
+
+	unmatched := testutil.ToFloat64(HTTPRequests.WithLabelValues(unmatchedRoute, "GET", "404"))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/wp-admin.php", nil))
+	if got := testutil.ToFloat64(HTTPRequests.WithLabelValues(unmatchedRoute, "GET", "404")) - unmatched; got != 1 {
+		t.Errorf("Expected unknown paths to be labelled %q, got %v requests", unmatchedRoute, got)
+	}
+}
+
+type fakeChat struct{}
+
+func (fakeChat) Connections() map[string]int { return map[string]int{"42": 2} }
+func (fakeChat) QueueDepth() int             { return 5 }
+
+func TestHandler_ExposesChatGaugesAndRequiresToken(t *testing.T) {
+	if err := RegisterChat(fakeChat{}); err != nil {
+		t.Fatalf("Failed to register chat collector: %v", err)
+	}
+	handler := Handler("secret")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a token, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`movieverse_chat_connections{chat_id="42"} 2`,
+		`movieverse_chat_broadcast_queue_depth 5`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected scrape to contain %q", want)
+		}
+	}
+}
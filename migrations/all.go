@@ -0,0 +1,321 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+// All is the application's schema history. Append new migrations with the
+// next version; never edit or renumber one that has shipped.
+var All = []Migration{
+	{
+		Version:     1,
+		Description: "unique users.email and user lookup indexes",
+		Up:          upUserIndexes,
+		Down:        dropIndexes("users", "email_1", "identities.provider_1_identities.subject_1", "deletion_scheduled_for_1"),
+	},
+	{
+		Version:     2,
+		Description: "chat session and message lookup indexes",
+		Up:          upChatIndexes,
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			if err := dropIndexes("chat_sessions", "id_1", "client_id_1_status_1")(ctx, db); err != nil {
+				return err
+			}
+			return dropIndexes("chat_messages", "chat_session_id_1_timestamp_1")(ctx, db)
+		},
+	},
+	{
+		Version:     3,
+		Description: "audit log indexes and rate limit TTL",
+		Up:          upAuditAndRateLimitIndexes,
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			if err := dropIndexes("audit_log", "seq_1", "actor_1_seq_-1", "target_type_1_target_id_1_seq_-1")(ctx, db); err != nil {
+				return err
+			}
+			return dropIndexes("rate_limits", "expire_at_1")(ctx, db)
+		},
+	},
+	{
+		Version:     4,
+		Description: "backfill roles for accounts that only carry the admin flag",
+		Up:          upBackfillRoles,
+		// The legacy admin flag is left in place and role checks accept
+		// either form, so there is nothing to undo.
+		Down: func(context.Context, *mongo.Database) error { return nil },
+	},
+	{
+		Version:     5,
+		Description: "key chat sessions by _id and allow one active session per client",
+		Up:          upChatSessionIdentity,
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			if err := dropIndexes("chat_sessions", "client_id_1")(ctx, db); err != nil {
+				return err
+			}
+			_, err := db.Collection("chat_sessions").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}})
+			return err
+		},
+	},
+	{
+		Version:     6,
+		Description: "support queue: one open chat session per client and queue indexes",
+		Up:          upSupportQueue,
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			if err := dropIndexes("chat_sessions", "client_id_1", "status_1_created_at_1", "agent_id_1_status_1")(ctx, db); err != nil {
+				return err
+			}
+			_, err := db.Collection("chat_sessions").Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "client_id", Value: 1}},
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"status": "active"}),
+			})
+			return err
+		},
+	},
+	{
+		Version:     7,
+		Description: "chat event TTL for the cross-instance chat bus",
+		Up:          upChatEvents,
+		Down:        dropIndexes("chat_events", "expire_at_1"),
+	},
+	{
+		Version:     8,
+		Description: "chat messages stored once per client message ID",
+		Up:          upChatClientMessageIDs,
+		Down:        dropIndexes("chat_messages", "chat_session_id_1_sender_id_1_client_msg_id_1"),
+	},
+	{
+		Version:     9,
+		Description: "activity log indexes and per-entry expiry",
+		Up:          upActivityLogs,
+		Down:        dropIndexes("activity_logs", "user_id_1_timestamp_-1", "action_1_timestamp_-1", "expire_at_1"),
+	},
+}
+
+// Server error codes for dropping something that is already gone.
+const (
+	namespaceNotFound = 26
+	indexNotFound     = 27
+)
+
+func dropIndexes(collection string, names ...string) func(context.Context, *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		for _, name := range names {
+			_, err := db.Collection(collection).Indexes().DropOne(ctx, name)
+			var cmdErr mongo.CommandError
+			if errors.As(err, &cmdErr) && (cmdErr.Code == indexNotFound || cmdErr.Code == namespaceNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("dropping %s.%s: %w", collection, name, err)
+			}
+		}
+		return nil
+	}
+}
+
+func upUserIndexes(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection("users")
+	// The unique index cannot be built over existing duplicates; list
+	// them so they can be merged by hand rather than picking a winner.
+	cursor, err := users.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$email", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$limit", Value: 20}},
+	})
+	if err != nil {
+		return err
+	}
+	var duplicates []struct {
+		Email string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		emails := make([]string, len(duplicates))
+		for i, d := range duplicates {
+			emails[i] = fmt.Sprintf("%s (%d accounts)", d.Email, d.Count)
+		}
+		return fmt.Errorf("users share an email address, resolve these first: %s", strings.Join(emails, ", "))
+	}
+
+	_, err = users.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// One MovieVerse account per external login.
+			Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "deletion_scheduled_for", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
+	return err
+}
+
+func upChatIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("chat_sessions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "client_id", Value: 1}, {Key: "status", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("chat_messages").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "chat_session_id", Value: 1}, {Key: "timestamp", Value: 1}},
+	})
+	return err
+}
+
+// upAuditAndRateLimitIndexes takes over the indexes the server used to
+// create at startup. They keep the driver's default names so databases that
+// already have them are left unchanged.
+func upAuditAndRateLimitIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("audit_log").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "seq", Value: -1}}},
+		{Keys: bson.D{{Key: "target_type", Value: 1}, {Key: "target_id", Value: 1}, {Key: "seq", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+	// Counters carry their own expiry time.
+	_, err = db.Collection("rate_limits").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expire_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func upBackfillRoles(ctx context.Context, db *mongo.Database) error {
+	users := db.Collection("users")
+	withoutRoles := bson.A{bson.M{"roles": nil}, bson.M{"roles": bson.A{}}}
+	if _, err := users.UpdateMany(ctx,
+		bson.M{"$or": withoutRoles, "admin": true},
+		bson.M{"$set": bson.M{"roles": bson.A{"super_admin"}}},
+	); err != nil {
+		return err
+	}
+	_, err := users.UpdateMany(ctx,
+		bson.M{"$or": withoutRoles},
+		bson.M{"$set": bson.M{"roles": bson.A{"customer"}}},
+	)
+	return err
+}
+
+// upChatSessionIdentity retires sessions written before chat sessions had
+// real IDs. Those all carry ID 0 and the same placeholder client, so they
+// cannot be attributed to anyone, so they are closed; nothing is deleted.
+func upChatSessionIdentity(ctx context.Context, db *mongo.Database) error {
+	sessions := db.Collection("chat_sessions")
+	if _, err := sessions.UpdateMany(ctx,
+		bson.M{"client_id": bson.M{"$not": bson.M{"$type": "objectId"}}, "status": bson.M{"$ne": "closed"}},
+		bson.M{"$set": bson.M{"status": "closed", "closed_at": time.Now()}},
+	); err != nil {
+		return err
+	}
+	if err := dropIndexes("chat_sessions", "id_1")(ctx, db); err != nil {
+		return err
+	}
+	_, err := sessions.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "client_id", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"status": "active"}),
+	})
+	return err
+}
+
+// upSupportQueue widens the one-session-per-client rule from active
+// sessions to open ones, which now includes sessions waiting for an agent.
+// Partial indexes cannot filter on "status is waiting or active", so open
+// sessions store closed_at as null and the index matches on that.
+func upSupportQueue(ctx context.Context, db *mongo.Database) error {
+	sessions := db.Collection("chat_sessions")
+	if _, err := sessions.UpdateMany(ctx,
+		bson.M{"closed_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"closed_at": nil}},
+	); err != nil {
+		return err
+	}
+	if err := dropIndexes("chat_sessions", "client_id_1")(ctx, db); err != nil {
+		return err
+	}
+	_, err := sessions.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "client_id", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"closed_at": bson.M{"$type": "null"}}),
+		},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "agent_id", Value: 1}, {Key: "status", Value: 1}}},
+	})
+	return err
+}
+
+// upChatEvents expires the events the Mongo chat bus publishes. Instances
+// receive the whole document through the change stream, so nothing reads
+// the collection itself and events need not be kept for long.
+func upChatEvents(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("chat_events").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expire_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// upChatClientMessageIDs makes resending a chat message safe: the client's
+// own message ID is unique per sender within a session. Messages without
+// one, including every message from before they existed, are not covered.
+func upChatClientMessageIDs(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("chat_messages").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "chat_session_id", Value: 1}, {Key: "sender_id", Value: 1}, {Key: "client_msg_id", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"client_msg_id": bson.M{"$type": "string"}}),
+	})
+	return err
+}
+
+// defaultActivityRetention is the expiry given to activity entries written
+// before they carried their own.
+const defaultActivityRetention = 90 * 24 * time.Hour
+
+// upActivityLogs takes over the activity feed indexes the server used to
+// create at startup. Retention used to be a TTL on timestamp, rewritten in
+// place whenever the setting changed; entries now carry their own expiry,
+// like rate limit counters, so changing the retention needs no index change.
+func upActivityLogs(ctx context.Context, db *mongo.Database) error {
+	activity := db.Collection("activity_logs")
+	if _, err := activity.UpdateMany(ctx,
+		bson.M{"expire_at": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"expire_at": bson.M{"$add": bson.A{"$timestamp", defaultActivityRetention.Milliseconds()}},
+		}}}},
+	); err != nil {
+		return err
+	}
+	if err := dropIndexes("activity_logs", "timestamp_1")(ctx, db); err != nil {
+		return err
+	}
+	_, err := activity.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "expire_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
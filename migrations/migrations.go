@@ -0,0 +1,238 @@
+// Package migrations applies versioned changes to the database: indexes,
+// TTLs and data backfills. Applied versions are recorded in the migrations
+// collection so every change runs once per database.
+package migrations
+
+import (
+	"MovieVerse/logging"
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"sort"
+	"time"
+)
+
+// Migration is one step of the schema. Up and Down must be safe to run
+// again after a partial failure, since a failed step is not recorded.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Down        func(ctx context.Context, db *mongo.Database) error
+}
+
+// State is a migration as reported by Status.
+type State struct {
+	Version     int
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+	// Unknown marks a version recorded in the database that this binary
+	// does not know about, e.g. one applied by a newer release.
+	Unknown bool
+}
+
+type record struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+// ErrLocked is returned when another process is running migrations.
+var ErrLocked = errors.New("migrations are locked by another process")
+
+// lockTTL bounds how long a crashed runner can hold the lock.
+const lockTTL = 15 * time.Minute
+
+type Runner struct {
+	db         *mongo.Database
+	migrations []Migration
+}
+
+// New returns a runner for the given migrations, which must have unique,
+// positive versions; they are applied in version order.
+func New(db *mongo.Database, migrations []Migration) (*Runner, error) {
+	if err := validate(migrations); err != nil {
+		return nil, err
+	}
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Runner{db: db, migrations: sorted}, nil
+}
+
+func validate(migrations []Migration) error {
+	seen := make(map[int]bool)
+	for _, m := range migrations {
+		switch {
+		case m.Version <= 0:
+			return fmt.Errorf("migration %q has invalid version %d", m.Description, m.Version)
+		case seen[m.Version]:
+			return fmt.Errorf("duplicate migration version %d", m.Version)
+		case m.Up == nil || m.Down == nil:
+			return fmt.Errorf("migration %d must define Up and Down", m.Version)
+		}
+		seen[m.Version] = true
+	}
+	return nil
+}
+
+func (r *Runner) collection() *mongo.Collection {
+	return r.db.Collection("migrations")
+}
+
+func (r *Runner) applied(ctx context.Context) (map[int]record, error) {
+	cursor, err := r.collection().Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]record, len(records))
+	for _, rec := range records {
+		applied[rec.Version] = rec
+	}
+	return applied, nil
+}
+
+// pending returns the migrations not yet applied, in order.
+func pending(migrations []Migration, applied map[int]record) []Migration {
+	var out []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// rollback returns up to steps applied migrations to revert, newest first.
+func rollback(migrations []Migration, applied map[int]record, steps int) []Migration {
+	var out []Migration
+	for i := len(migrations) - 1; i >= 0 && len(out) < steps; i-- {
+		if _, ok := applied[migrations[i].Version]; ok {
+			out = append(out, migrations[i])
+		}
+	}
+	return out
+}
+
+// lock takes the runner lock so instances starting together do not apply
+// the same migration twice. The lock expires after lockTTL in case its
+// holder dies.
+func (r *Runner) lock(ctx context.Context) (func(), error) {
+	locks := r.db.Collection("migration_lock")
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s/%d/%d", host, os.Getpid(), time.Now().UnixNano())
+	now := time.Now()
+	_, err := locks.UpdateOne(ctx,
+		bson.M{"_id": "migrations", "expires_at": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": owner, "locked_at": now, "expires_at": now.Add(lockTTL)}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, err
+	}
+	return func() {
+		if _, err := locks.DeleteOne(context.WithoutCancel(ctx), bson.M{"_id": "migrations", "owner": owner}); err != nil {
+			logging.Subsystem("migrations").Errorf("Failed to release migration lock: %v", err)
+		}
+	}, nil
+}
+
+// Up applies every pending migration in order and returns the versions it
+// applied. It stops at the first failure.
+func (r *Runner) Up(ctx context.Context) ([]int, error) {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := r.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var done []int
+	for _, m := range pending(r.migrations, applied) {
+		logger := logging.Subsystem("migrations").WithField("version", m.Version)
+		logger.Infof("Applying migration: %s", m.Description)
+		if err := m.Up(ctx, r.db); err != nil {
+			return done, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		rec := record{Version: m.Version, Description: m.Description, AppliedAt: time.Now()}
+		if _, err := r.collection().InsertOne(ctx, rec); err != nil {
+			return done, fmt.Errorf("migration %d applied but not recorded: %w", m.Version, err)
+		}
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns
+// the versions it reverted.
+func (r *Runner) Down(ctx context.Context, steps int) ([]int, error) {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := r.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var done []int
+	for _, m := range rollback(r.migrations, applied, steps) {
+		logger := logging.Subsystem("migrations").WithField("version", m.Version)
+		logger.Infof("Reverting migration: %s", m.Description)
+		if err := m.Down(ctx, r.db); err != nil {
+			return done, fmt.Errorf("reverting migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		if _, err := r.collection().DeleteOne(ctx, bson.M{"_id": m.Version}); err != nil {
+			return done, fmt.Errorf("migration %d reverted but still recorded: %w", m.Version, err)
+		}
+		done = append(done, m.Version)
+	}
+	return done, nil
+}
+
+// Status lists every known migration and whether it has been applied,
+// followed by any applied versions this binary does not know.
+func (r *Runner) Status(ctx context.Context) ([]State, error) {
+	applied, err := r.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]State, 0, len(r.migrations))
+	known := make(map[int]bool, len(r.migrations))
+	for _, m := range r.migrations {
+		known[m.Version] = true
+		rec, ok := applied[m.Version]
+		states = append(states, State{Version: m.Version, Description: m.Description, Applied: ok, AppliedAt: rec.AppliedAt})
+	}
+	var unknown []State
+	for version, rec := range applied {
+		if !known[version] {
+			unknown = append(unknown, State{Version: version, Description: rec.Description, Applied: true, AppliedAt: rec.AppliedAt, Unknown: true})
+		}
+	}
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i].Version < unknown[j].Version })
+	return append(states, unknown...), nil
+}
+
+// Pending reports how many known migrations have not been applied.
+func (r *Runner) Pending(ctx context.Context) (int, error) {
+	applied, err := r.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(pending(r.migrations, applied)), nil
+}
@@ -0,0 +1,195 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func noop(context.Context, *mongo.Database) error { return nil }
+
+func versions(migrations []Migration) []int {
+	var out []int
+	for _, m := range migrations {
+		out = append(out, m.Version)
+	}
+	return out
+}
+
+func TestAll_IsValid(t *testing.T) {
+	if err := validate(All); err != nil {
+		t.Fatalf("Invalid migrations: %v", err)
+	}
+	for i := 1; i < len(All); i++ {
+		if All[i].Version <= All[i-1].Version {
+			t.Errorf("Migration %d is listed after %d", All[i].Version, All[i-1].Version)
+		}
+	}
+}
+
+func TestNew_RejectsBadMigrations(t *testing.T) {
+	cases := map[string][]Migration{
+		"zero version": {{Version: 0, Up: noop, Down: noop}},
+		"duplicate":    {{Version: 1, Up: noop, Down: noop}, {Version: 1, Up: noop, Down: noop}},
+		"missing down": {{Version: 1, Up: noop}},
+	}
+	for name, list := range cases {
+		if _, err := New(nil, list); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPlan_PendingAndRollback(t *testing.T) {
+	runner, err := New(nil, []Migration{
+		{Version: 3, Up: noop, Down: noop},
+		{Version: 1, Up: noop, Down: noop},
+		{Version: 2, Up: noop, Down: noop},
+		{Version: 4, Up: noop, Down: noop},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := map[int]record{1: {Version: 1}, 3: {Version: 3}}
+
+	if got := versions(pending(runner.migrations, applied)); !reflect.DeepEqual(got, []int{2, 4}) {
+		t.Errorf("Expected pending [2 4], got %v", got)
+	}
+	if got := versions(rollback(runner.migrations, applied, 1)); !reflect.DeepEqual(got, []int{3}) {
+		t.Errorf("Expected to roll back [3], got %v", got)
+	}
+	if got := versions(rollback(runner.migrations, applied, 5)); !reflect.DeepEqual(got, []int{3, 1}) {
+		t.Errorf("Expected to roll back [3 1], got %v", got)
+	}
+}
+
+// liveDatabase returns a scratch database on the server named by
+// MOVIEVERSE_TEST_MONGO_URI, dropped when the test ends.
+func liveDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MOVIEVERSE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MOVIEVERSE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("movieverse_migrations_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return db
+}
+
+func TestRunner_LiveUpStatusDown(t *testing.T) {
+	db := liveDatabase(t)
+	ctx := context.Background()
+	if _, err := db.Collection("users").InsertMany(ctx, []interface{}{
+		bson.M{"email": "admin@example.com", "admin": true},
+		bson.M{"email": "fan@example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	loggedAt := time.Now().Truncate(time.Millisecond)
+	if _, err := db.Collection("activity_logs").InsertOne(ctx, bson.M{"action": "login", "timestamp": loggedAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	runner, err := New(db, All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := runner.Up(ctx)
+	if err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if len(applied) != len(All) {
+		t.Errorf("Expected %d migrations applied, got %v", len(All), applied)
+	}
+	if again, err := runner.Up(ctx); err != nil || len(again) != 0 {
+		t.Errorf("Expected a second Up to do nothing, got %v, %v", again, err)
+	}
+
+	_, err = db.Collection("users").InsertOne(ctx, bson.M{"email": "fan@example.com"})
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("Expected users.email to be unique, got %v", err)
+	}
+	var admin struct {
+		Roles []string `bson:"roles"`
+	}
+	db.Collection("users").FindOne(ctx, bson.M{"email": "admin@example.com"}).Decode(&admin)
+	if !reflect.DeepEqual(admin.Roles, []string{"super_admin"}) {
+		t.Errorf("Expected the legacy admin to be backfilled as super_admin, got %v", admin.Roles)
+	}
+	var entry struct {
+		ExpireAt time.Time `bson:"expire_at"`
+	}
+	db.Collection("activity_logs").FindOne(ctx, bson.M{"action": "login"}).Decode(&entry)
+	if !entry.ExpireAt.Equal(loggedAt.Add(defaultActivityRetention)) {
+		t.Errorf("Expected the old activity entry to expire %v after it was logged, got %v", defaultActivityRetention, entry.ExpireAt)
+	}
+
+	reverted, err := runner.Down(ctx, len(All))
+	if err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	if len(reverted) != len(All) {
+		t.Errorf("Expected every migration reverted, got %v", reverted)
+	}
+	states, err := runner.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range states {
+		if state.Applied {
+			t.Errorf("Migration %d still applied after Down", state.Version)
+		}
+	}
+}
+
+func TestUp_ReportsDuplicateEmails(t *testing.T) {
+	db := liveDatabase(t)
+	ctx := context.Background()
+	db.Collection("users").InsertMany(ctx, []interface{}{
+		bson.M{"email": "twin@example.com"},
+		bson.M{"email": "twin@example.com"},
+	})
+
+	runner, _ := New(db, All)
+	applied, err := runner.Up(ctx)
+	if err == nil || len(applied) != 0 {
+		t.Fatalf("Expected the first migration to fail, got %v, %v", applied, err)
+	}
+	if pending, _ := runner.Pending(ctx); pending != len(All) {
+		t.Errorf("Expected the failed migration to stay pending, got %d pending", pending)
+	}
+}
+
+func TestLock_ExcludesConcurrentRunners(t *testing.T) {
+	db := liveDatabase(t)
+	ctx := context.Background()
+	runner, _ := New(db, nil)
+
+	unlock, err := runner.lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.lock(ctx); err != ErrLocked {
+		t.Errorf("Expected ErrLocked while held, got %v", err)
+	}
+	unlock()
+	again, err := runner.lock(ctx)
+	if err != nil {
+		t.Fatalf("Expected the lock to be free after unlock, got %v", err)
+	}
+	again()
+}
@@ -1,20 +1,52 @@
 package models
 
-import "time"
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
 
+// A session waits in the support queue until an agent is assigned, and is
+// active until it is closed.
+const (
+	ChatStatusWaiting = "waiting"
+	ChatStatusActive  = "active"
+	ChatStatusClosed  = "closed"
+)
+
+// ChatSession is a support conversation. A user has at most one open
+// (waiting or active) session at a time.
 type ChatSession struct {
-	ID        uint      `gorm:"primaryKey"`
-	ClientID  uint      `gorm:"not null"`
-	Status    string    `gorm:"not null"`
-	CreatedAt time.Time `gorm:"not null"`
-	ClosedAt  *time.Time
-	Messages  []ChatMessage `gorm:"foreignKey:ChatSessionID"`
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	ClientID   primitive.ObjectID `bson:"client_id"`
+	AgentID    primitive.ObjectID `bson:"agent_id,omitempty"`
+	Status     string             `bson:"status"`
+	CreatedAt  time.Time          `bson:"created_at"`
+	AssignedAt *time.Time         `bson:"assigned_at,omitempty"`
+	// ClosedAt is stored as null while the session is open; the index
+	// that allows one open session per client keys on that.
+	ClosedAt  *time.Time     `bson:"closed_at"`
+	Transfers []ChatTransfer `bson:"transfers,omitempty"`
+}
+
+// ChatTransfer records an agent handing a session to another agent.
+type ChatTransfer struct {
+	From primitive.ObjectID `bson:"from"`
+	To   primitive.ObjectID `bson:"to"`
+	At   time.Time          `bson:"at"`
 }
 
 type ChatMessage struct {
-	ID            uint      `gorm:"primaryKey"`
-	ChatSessionID uint      `gorm:"not null"`
-	Sender        string    `gorm:"not null"`
-	Content       string    `gorm:"not null"`
-	Timestamp     time.Time `gorm:"not null"`
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	ChatSessionID primitive.ObjectID `bson:"chat_session_id"`
+	// Sender is the sender's display name. SenderID and SenderRole
+	// ("client" or "agent") are missing on messages from before senders
+	// were taken from the signed-in user.
+	Sender     string             `bson:"sender"`
+	SenderID   primitive.ObjectID `bson:"sender_id,omitempty"`
+	SenderRole string             `bson:"sender_role,omitempty"`
+	// ClientMsgID is the sender's own ID for the message, unique per
+	// sender and session so a resent message is only stored once.
+	ClientMsgID string    `bson:"client_msg_id,omitempty"`
+	Content     string    `bson:"content"`
+	Timestamp   time.Time `bson:"timestamp"`
 }
@@ -1,13 +1,56 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
 
 type User struct {
 	ID                primitive.ObjectID `bson:"_id,omitempty"`
 	Email             string             `bson:"email"`
 	Username          string             `bson:"username"`
 	Password          string             `bson:"password" `
-	Admin             bool               `bson:"admin" `
-	VerificationToken string             `bson:"verification_token"`
-	EmailVerified     bool               `bson:"email_verified" gorm:"default:false"`
+	Admin             bool               `bson:"admin" json:"-"`
+	Roles             []string           `bson:"roles,omitempty" json:"-"`
+	VerificationToken string             `bson:"verification_token" json:"-"`
+	EmailVerified     bool               `bson:"email_verified" json:"-" gorm:"default:false"`
+	TokenVersion      int                `bson:"token_version" json:"-"`
+	ResetTokenHash    string             `bson:"reset_token_hash,omitempty" json:"-"`
+	ResetTokenExpires time.Time          `bson:"reset_token_expires,omitempty" json:"-"`
+	FailedLogins      int                `bson:"failed_logins" json:"-"`
+	LastFailedLogin   time.Time          `bson:"last_failed_login,omitempty" json:"-"`
+	LockedUntil       time.Time          `bson:"locked_until,omitempty" json:"-"`
+	UnlockTokenHash   string             `bson:"unlock_token_hash,omitempty" json:"-"`
+	UnlockExpires     time.Time          `bson:"unlock_token_expires,omitempty" json:"-"`
+	TOTPSecret        string             `bson:"totp_secret,omitempty" json:"-"`
+	TOTPEnabled       bool               `bson:"totp_enabled" json:"-"`
+	TOTPLastStep      int64              `bson:"totp_last_step,omitempty" json:"-"`
+	RecoveryCodes     []string           `bson:"recovery_codes,omitempty" json:"-"`
+	Identities        []ExternalIdentity `bson:"identities,omitempty" json:"-"`
+	PendingEmail      string             `bson:"pending_email,omitempty" json:"-"`
+	EmailChangeHash   string             `bson:"email_change_hash,omitempty" json:"-"`
+	EmailChangeExpiry time.Time          `bson:"email_change_expiry,omitempty" json:"-"`
+	AvatarURL         string             `bson:"avatar_url,omitempty" json:"-"`
+	DeletionRequested time.Time          `bson:"deletion_requested_at,omitempty" json:"-"`
+	DeletionScheduled time.Time          `bson:"deletion_scheduled_for,omitempty" json:"-"`
+}
+
+// UserProfile is the public view of a User; it never carries password
+// hashes, tokens or two-factor secrets.
+type UserProfile struct {
+	ID                primitive.ObjectID `json:"id"`
+	Email             string             `json:"email"`
+	Username          string             `json:"username"`
+	EmailVerified     bool               `json:"email_verified"`
+	PendingEmail      string             `json:"pending_email,omitempty"`
+	AvatarURL         string             `json:"avatar_url,omitempty"`
+	Roles             []string           `json:"roles"`
+	TwoFactorEnabled  bool               `json:"two_factor_enabled"`
+	DeletionScheduled *time.Time         `json:"deletion_scheduled_for,omitempty"`
+	CreatedAt         time.Time          `json:"created_at"`
+}
+
+type ExternalIdentity struct {
+	Provider string `bson:"provider"`
+	Subject  string `bson:"subject"`
 }
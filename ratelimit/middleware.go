@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"MovieVerse/logging"
+	"MovieVerse/metrics"
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// KeyFunc identifies the client a request counts against. An empty string
+// means the function does not apply to the request.
+type KeyFunc func(r *http.Request) string
+
+// ByIP keys requests by the remote address.
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// APIKeyAuthenticator resolves an API key to the client it was issued to;
+// ok is false for unknown or revoked keys.
+type APIKeyAuthenticator func(ctx context.Context, key string) (clientID string, ok bool)
+
+// ByAPIKey keys requests by the client that owns the API key sent in header.
+// The key is authenticated first, so making one up does not buy a fresh
+// budget: requests with a missing or unknown key are left to the next key
+// function. Keys are counted per client, so all of a client's keys share
+// one budget.
+func ByAPIKey(header string, authenticate APIKeyAuthenticator) KeyFunc {
+	return func(r *http.Request) string {
+		key := r.Header.Get(header)
+		if key == "" {
+			return ""
+		}
+		if clientID, ok := authenticate(r.Context(), key); ok {
+			return "apikey:" + clientID
+		}
+		return ""
+	}
+}
+
+// FirstOf uses the first key function that returns a key, falling back to
+// the client IP.
+func FirstOf(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) string {
+		for _, key := range keys {
+			if k := key(r); k != "" {
+				return k
+			}
+		}
+		return ByIP(r)
+	}
+}
+
+// Middleware rejects requests over the policy's budget with a JSON 429 and
+// reports the budget in RateLimit-* headers on every response.
+// If the limiter fails the request is let through; an unavailable store
+// should not take the site down with it.
+func Middleware(limiter Limiter, policy Policy, key KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result, err := limiter.Allow(r.Context(), policy, key(r))
+			if err != nil {
+				logging.SubsystemFromContext(r.Context(), "ratelimit").Errorf("Rate limiter unavailable for %s: %v", policy.Name, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+			if !result.Allowed {
+				metrics.RateLimitRejections.WithLabelValues(policy.Name).Inc()
+				retryAfter := seconds(result.RetryAfter)
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error":       "rate_limited",
+					"message":     "Too many requests. Please try again later.",
+					"retry_after": retryAfter,
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// seconds rounds up so clients never retry before the budget has refilled.
+func seconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// MongoStore keeps counters in a MongoDB collection so every instance
+// pointed at the same database shares them. Each counter is a document
+// updated with $inc; a TTL index on expire_at, created by migration 3,
+// cleans up old windows.
+type MongoStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoStore(collection *mongo.Collection) *MongoStore {
+	return &MongoStore{collection: collection}
+}
+
+func (m *MongoStore) Add(ctx context.Context, key string, delta int64, expireAt time.Time) (int64, error) {
+	count, err := m.add(ctx, key, delta, expireAt)
+	if mongo.IsDuplicateKeyError(err) {
+		// Two instances upserted the same new counter at once; the
+		// loser retries once against the document the winner created.
+		count, err = m.add(ctx, key, delta, expireAt)
+	}
+	return count, err
+}
+
+func (m *MongoStore) add(ctx context.Context, key string, delta int64, expireAt time.Time) (int64, error) {
+	var counter struct {
+		Count int64 `bson:"count"`
+	}
+	err := m.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": key},
+		bson.M{"$inc": bson.M{"count": delta}, "$setOnInsert": bson.M{"expire_at": expireAt}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	return counter.Count, err
+}
+
+func (m *MongoStore) Get(ctx context.Context, key string) (int64, error) {
+	var counter struct {
+		Count int64 `bson:"count"`
+	}
+	err := m.collection.FindOne(ctx, bson.M{"_id": key}).Decode(&counter)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return counter.Count, err
+}
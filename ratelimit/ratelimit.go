@@ -0,0 +1,104 @@
+// Package ratelimit throttles requests per client and per route.
+package ratelimit
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"math"
+	"sync"
+	"time"
+)
+
+// Policy allows Limit requests per Window for each key. Policies are told
+// apart by Name, so two routes sharing a policy share the budget.
+type Policy struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+}
+
+// Result describes the state of a key's budget after a request.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether a request identified by key fits in the policy's
+// budget. Implementations must be safe for concurrent use.
+type Limiter interface {
+	Allow(ctx context.Context, policy Policy, key string) (Result, error)
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// TokenBucket keeps one token bucket per policy and key in memory, so each
+// process has its own budget. Buckets that have not been used for IdleTTL
+// are evicted; an evicted bucket would have refilled completely by then
+// anyway.
+type TokenBucket struct {
+	IdleTTL time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewTokenBucket(idleTTL time.Duration) *TokenBucket {
+	return &TokenBucket{
+		IdleTTL: idleTTL,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (tb *TokenBucket) Allow(ctx context.Context, policy Policy, key string) (Result, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := tb.now()
+	if now.Sub(tb.lastSweep) >= tb.IdleTTL {
+		tb.evictIdle(now)
+		tb.lastSweep = now
+	}
+
+	id := policy.Name + "|" + key
+	b, ok := tb.buckets[id]
+	if !ok {
+		every := policy.Window / time.Duration(policy.Limit)
+		b = &bucket{limiter: rate.NewLimiter(rate.Every(every), policy.Limit)}
+		tb.buckets[id] = b
+	}
+	b.lastSeen = now
+
+	result := Result{Limit: policy.Limit, Allowed: b.limiter.AllowN(now, 1)}
+	tokens := b.limiter.TokensAt(now)
+	result.Remaining = int(math.Max(0, math.Floor(tokens)))
+	perToken := time.Duration(float64(time.Second) / float64(b.limiter.Limit()))
+	result.Reset = time.Duration((float64(policy.Limit) - tokens) * float64(perToken))
+	if !result.Allowed {
+		result.RetryAfter = time.Duration((1 - tokens) * float64(perToken))
+	}
+	return result, nil
+}
+
+// Len returns the number of live buckets.
+func (tb *TokenBucket) Len() int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return len(tb.buckets)
+}
+
+func (tb *TokenBucket) evictIdle(now time.Time) {
+	for id, b := range tb.buckets {
+		if now.Sub(b.lastSeen) >= tb.IdleTTL {
+			delete(tb.buckets, id)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newTestBucket(idle time.Duration) (*TokenBucket, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tb := NewTokenBucket(idle)
+	tb.now = clock.now
+	return tb, clock
+}
+
+func allow(t *testing.T, limiter Limiter, policy Policy, key string) Result {
+	t.Helper()
+	result, err := limiter.Allow(context.Background(), policy, key)
+	if err != nil {
+		t.Fatalf("Allow failed: %v", err)
+	}
+	return result
+}
+
+func TestTokenBucket_KeysAreIndependent(t *testing.T) {
+	tb, clock := newTestBucket(time.Hour)
+	policy := Policy{Name: "login", Limit: 3, Window: time.Minute}
+
+	for i := 0; i < 3; i++ {
+		if r := allow(t, tb, policy, "ip:1.1.1.1"); !r.Allowed || r.Remaining != 2-i {
+			t.Fatalf("Request %d: unexpected result %+v", i+1, r)
+		}
+	}
+	denied := allow(t, tb, policy, "ip:1.1.1.1")
+	if denied.Allowed || denied.Remaining != 0 {
+		t.Fatalf("Expected the fourth request to be denied, got %+v", denied)
+	}
+	if denied.RetryAfter <= 0 || denied.RetryAfter > 20*time.Second {
+		t.Errorf("Expected a retry within one token interval, got %v", denied.RetryAfter)
+	}
+	if r := allow(t, tb, policy, "ip:2.2.2.2"); !r.Allowed {
+		t.Error("Another client should have its own budget")
+	}
+	if r := allow(t, tb, Policy{Name: "signup", Limit: 3, Window: time.Minute}, "ip:1.1.1.1"); !r.Allowed {
+		t.Error("Another route should have its own budget")
+	}
+
+	clock.t = clock.t.Add(20 * time.Second)
+	if r := allow(t, tb, policy, "ip:1.1.1.1"); !r.Allowed {
+		t.Error("Expected a token to have refilled")
+	}
+}
+
+func TestTokenBucket_EvictsIdleBuckets(t *testing.T) {
+	tb, clock := newTestBucket(time.Minute)
+	policy := Policy{Name: "api", Limit: 10, Window: time.Minute}
+	allow(t, tb, policy, "a")
+	allow(t, tb, policy, "b")
+	if tb.Len() != 2 {
+		t.Fatalf("Expected 2 buckets, got %d", tb.Len())
+	}
+	clock.t = clock.t.Add(2 * time.Minute)
+	allow(t, tb, policy, "c")
+	if tb.Len() != 1 {
+		t.Errorf("Expected idle buckets to be evicted, %d left", tb.Len())
+	}
+}
+
+type testUser struct{}
+
+func TestMiddleware_HeadersAndJSON429(t *testing.T) {
+	tb, _ := newTestBucket(time.Hour)
+	policy := Policy{Name: "checkout", Limit: 1, Window: time.Minute}
+	// Stands in for a key taken from an authenticated session.
+	byUser := func(r *http.Request) string {
+		if user, ok := r.Context().Value(testUser{}).(string); ok {
+			return "user:" + user
+		}
+		return ""
+	}
+	handler := Middleware(tb, policy, FirstOf(byUser))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/checkout", nil)
+		r.RemoteAddr = "10.0.0.1:5000"
+		if user != "" {
+			r = r.WithContext(context.WithValue(r.Context(), testUser{}, user))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	ok := request("")
+	if ok.Code != http.StatusOK || ok.Header().Get("RateLimit-Limit") != "1" || ok.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("Unexpected first response: %d %v", ok.Code, ok.Header())
+	}
+
+	limited := request("")
+	if limited.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", limited.Code)
+	}
+	if limited.Header().Get("Retry-After") != "60" || limited.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected 429 headers: %v", limited.Header())
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(limited.Body).Decode(&body); err != nil {
+		t.Fatalf("429 body is not JSON: %v", err)
+	}
+	if body["error"] != "rate_limited" || body["retry_after"] != float64(60) {
+		t.Errorf("Unexpected 429 body: %v", body)
+	}
+
+	if rec := request("alice"); rec.Code != http.StatusOK {
+		t.Errorf("A signed-in user should be limited separately from the IP, got %d", rec.Code)
+	}
+}
+
+func TestByAPIKey_OnlyTrustsAuthenticatedKeys(t *testing.T) {
+	issued := map[string]string{"key-1": "acme", "key-2": "acme"}
+	key := FirstOf(ByAPIKey("X-API-Key", func(_ context.Context, apiKey string) (string, bool) {
+		clientID, ok := issued[apiKey]
+		return clientID, ok
+	}))
+
+	request := func(apiKey string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/get", nil)
+		r.RemoteAddr = "10.0.0.1:5000"
+		if apiKey != "" {
+			r.Header.Set("X-API-Key", apiKey)
+		}
+		return r
+	}
+	if got := key(request("key-1")); got != "apikey:acme" {
+		t.Errorf("Expected an issued key to count against its client, got %q", got)
+	}
+	if got := key(request("key-2")); got != "apikey:acme" {
+		t.Errorf("Expected a client's keys to share a budget, got %q", got)
+	}
+	if got := key(request("made-up")); got != "ip:10.0.0.1" {
+		t.Errorf("Expected an unknown key to fall back to the IP, got %q", got)
+	}
+	if got := key(request("")); got != "ip:10.0.0.1" {
+		t.Errorf("Expected a request without a key to fall back to the IP, got %q", got)
+	}
+}
@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CounterStore holds the per-window request counters of a SlidingWindow.
+// Add must be atomic so instances sharing the store share the budget.
+type CounterStore interface {
+	// Add increments the counter by delta and returns the new value. A new
+	// counter may be discarded after expireAt.
+	Add(ctx context.Context, key string, delta int64, expireAt time.Time) (int64, error)
+	Get(ctx context.Context, key string) (int64, error)
+}
+
+// SlidingWindow approximates a sliding window by weighting the previous
+// fixed window's count by how much of it still overlaps the sliding one.
+// Only two counters per key are kept, which makes it cheap to back with a
+// shared store.
+type SlidingWindow struct {
+	store CounterStore
+	now   func() time.Time
+}
+
+func NewSlidingWindow(store CounterStore) *SlidingWindow {
+	return &SlidingWindow{store: store, now: time.Now}
+}
+
+func (sw *SlidingWindow) Allow(ctx context.Context, policy Policy, key string) (Result, error) {
+	now := sw.now()
+	window := int64(policy.Window)
+	index := now.UnixNano() / window
+	windowStart := time.Unix(0, index*window)
+	windowEnd := windowStart.Add(policy.Window)
+	prefix := policy.Name + "|" + key + "|"
+	currentKey := prefix + strconv.FormatInt(index, 10)
+
+	current, err := sw.store.Add(ctx, currentKey, 1, windowEnd.Add(policy.Window))
+	if err != nil {
+		return Result{}, err
+	}
+	previous, err := sw.store.Get(ctx, prefix+strconv.FormatInt(index-1, 10))
+	if err != nil {
+		return Result{}, err
+	}
+
+	elapsed := float64(now.Sub(windowStart)) / float64(policy.Window)
+	limit := float64(policy.Limit)
+	estimate := float64(previous)*(1-elapsed) + float64(current)
+	result := Result{
+		Allowed: estimate <= limit,
+		Limit:   policy.Limit,
+		Reset:   windowEnd.Sub(now),
+	}
+	if result.Allowed {
+		result.Remaining = int(math.Max(0, math.Floor(limit-estimate)))
+		return result, nil
+	}
+
+	// Rejected requests are not counted, otherwise a client retrying in a
+	// loop would never get back under the limit.
+	if _, err := sw.store.Add(ctx, currentKey, -1, windowEnd.Add(policy.Window)); err != nil {
+		return Result{}, err
+	}
+	current--
+	if free := limit - 1 - float64(current); free >= 0 && previous > 0 {
+		// Wait until enough of the previous window has slid out.
+		needed := 1 - free/float64(previous)
+		result.RetryAfter = time.Duration((needed - elapsed) * float64(policy.Window))
+	}
+	if result.RetryAfter <= 0 {
+		result.RetryAfter = windowEnd.Sub(now)
+	}
+	return result, nil
+}
+
+// MemoryStore is a CounterStore for a single process and for tests.
+type MemoryStore struct {
+	mu        sync.Mutex
+	counters  map[string]memoryCounter
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memoryCounter struct {
+	value    int64
+	expireAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{counters: make(map[string]memoryCounter), now: time.Now}
+}
+
+func (m *MemoryStore) Add(ctx context.Context, key string, delta int64, expireAt time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if now.Sub(m.lastSweep) >= time.Minute {
+		for k, c := range m.counters {
+			if !c.expireAt.After(now) {
+				delete(m.counters, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	c, ok := m.counters[key]
+	if !ok || !c.expireAt.After(now) {
+		c = memoryCounter{expireAt: expireAt}
+	}
+	c.value += delta
+	m.counters[key] = c
+	return c.value, nil
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counters[key]
+	if !ok || !c.expireAt.After(m.now()) {
+		return 0, nil
+	}
+	return c.value, nil
+}
@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"MovieVerse/migrations"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newInstances returns n limiters sharing one store, standing in for n
+// MovieVerse replicas pointed at the same database.
+func newInstances(store CounterStore, clock *fakeClock, n int) []*SlidingWindow {
+	instances := make([]*SlidingWindow, n)
+	for i := range instances {
+		instances[i] = NewSlidingWindow(store)
+		instances[i].now = clock.now
+	}
+	return instances
+}
+
+func TestSlidingWindow_InstancesShareBudget(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	store := NewMemoryStore()
+	store.now = clock.now
+	instances := newInstances(store, clock, 3)
+	policy := Policy{Name: "login", Limit: 5, Window: time.Minute}
+
+	for i := 0; i < 5; i++ {
+		if r := allow(t, instances[i%3], policy, "ip:1.1.1.1"); !r.Allowed {
+			t.Fatalf("Request %d should be allowed: %+v", i+1, r)
+		}
+	}
+	for _, instance := range instances {
+		r := allow(t, instance, policy, "ip:1.1.1.1")
+		if r.Allowed {
+			t.Fatal("Every instance should see the shared budget as spent")
+		}
+		if r.RetryAfter <= 0 || r.RetryAfter > time.Minute {
+			t.Errorf("Unexpected Retry-After %v", r.RetryAfter)
+		}
+	}
+
+	// Halfway through the next window half of the previous one still counts.
+	clock.t = clock.t.Add(90 * time.Second)
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if allow(t, instances[i%3], policy, "ip:1.1.1.1").Allowed {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("Expected 2 requests to fit next to 2.5 carried over, got %d", allowed)
+	}
+
+	clock.t = clock.t.Add(2 * time.Minute)
+	if r := allow(t, instances[0], policy, "ip:1.1.1.1"); !r.Allowed || r.Remaining != 4 {
+		t.Errorf("Expected a fresh budget after two quiet windows, got %+v", r)
+	}
+}
+
+func TestSlidingWindow_ConcurrentInstances(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	store := NewMemoryStore()
+	store.now = clock.now
+	testConcurrentInstances(t, store, clock)
+}
+
+// TestSlidingWindow_MongoStore runs the shared-budget check against a real
+// database when MOVIEVERSE_TEST_MONGO_URI is set.
+func TestSlidingWindow_MongoStore(t *testing.T) {
+	uri := os.Getenv("MOVIEVERSE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MOVIEVERSE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Disconnect(ctx)
+	db := client.Database(fmt.Sprintf("movieverse_ratelimit_%d", time.Now().UnixNano()))
+	defer db.Drop(ctx)
+
+	// The TTL index on the counters belongs to the migrations.
+	runner, err := migrations.New(db, migrations.All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.Up(ctx); err != nil {
+		t.Fatalf("Failed to apply migrations: %v", err)
+	}
+	store := NewMongoStore(db.Collection("rate_limits"))
+	clock := &fakeClock{t: time.Now()}
+	testConcurrentInstances(t, store, clock)
+}
+
+func testConcurrentInstances(t *testing.T, store CounterStore, clock *fakeClock) {
+	instances := newInstances(store, clock, 4)
+	policy := Policy{Name: "checkout", Limit: 20, Window: time.Hour}
+
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(instance *SlidingWindow) {
+			defer wg.Done()
+			r, err := instance.Allow(context.Background(), policy, "user:42")
+			if err != nil {
+				t.Errorf("Allow failed: %v", err)
+				return
+			}
+			if r.Allowed {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}(instances[i%len(instances)])
+	}
+	wg.Wait()
+	if allowed != int64(policy.Limit) {
+		t.Errorf("Expected exactly %d requests across all instances, got %d", policy.Limit, allowed)
+	}
+}
@@ -0,0 +1,300 @@
+// Package support runs the support desk. New chat sessions wait in a queue
+// until an agent claims one or the desk assigns it to an available agent.
+// All state lives in MongoDB, so every instance sees the same queue.
+package support
+
+import (
+	"MovieVerse/metrics"
+	"MovieVerse/models"
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Strategy decides how waiting sessions are handed to agents.
+type Strategy string
+
+const (
+	// Manual leaves every session in the queue until an agent claims it.
+	Manual Strategy = "manual"
+	// RoundRobin gives each session to the available agent whose last
+	// assignment is oldest.
+	RoundRobin Strategy = "round_robin"
+	// LeastBusy gives each session to the available agent with the fewest
+	// active sessions, falling back to round robin between equals.
+	LeastBusy Strategy = "least_busy"
+)
+
+func ParseStrategy(s string) (Strategy, error) {
+	switch strategy := Strategy(s); strategy {
+	case Manual, RoundRobin, LeastBusy:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown assignment strategy %q, expected manual, round_robin or least_busy", s)
+}
+
+var (
+	ErrNotFound   = errors.New("chat session not found")
+	ErrNotWaiting = errors.New("chat session is not waiting for an agent")
+	ErrNotActive  = errors.New("chat session is not assigned to an agent")
+	ErrSameAgent  = errors.New("chat session is already assigned to that agent")
+	ErrChanged    = errors.New("chat session changed concurrently, try again")
+)
+
+// Agent is an agent's standing with the desk. Only available agents are
+// assigned sessions automatically.
+type Agent struct {
+	ID             primitive.ObjectID `bson:"_id" json:"id"`
+	Available      bool               `bson:"available" json:"available"`
+	LastAssignedAt time.Time          `bson:"last_assigned_at,omitempty" json:"last_assigned_at,omitempty"`
+	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+type Desk struct {
+	sessions *mongo.Collection
+	agents   *mongo.Collection
+	strategy Strategy
+	// maxChats caps the active sessions auto-assigned to one agent; zero
+	// means no cap. Claims and transfers are not capped.
+	maxChats int
+}
+
+func NewDesk(db *mongo.Database, strategy Strategy, maxChatsPerAgent int) *Desk {
+	return &Desk{
+		sessions: db.Collection("chat_sessions"),
+		agents:   db.Collection("support_agents"),
+		strategy: strategy,
+		maxChats: maxChatsPerAgent,
+	}
+}
+
+// SetAvailable puts an agent on or off duty. Going off duty does not take
+// the agent's active sessions away.
+func (d *Desk) SetAvailable(ctx context.Context, agentID primitive.ObjectID, available bool) (Agent, error) {
+	var agent Agent
+	err := d.agents.FindOneAndUpdate(ctx,
+		bson.M{"_id": agentID},
+		bson.M{"$set": bson.M{"available": available, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&agent)
+	return agent, err
+}
+
+// Open returns the waiting and active sessions, oldest first.
+func (d *Desk) Open(ctx context.Context) ([]models.ChatSession, error) {
+	cursor, err := d.sessions.Find(ctx,
+		bson.M{"status": bson.M{"$in": bson.A{models.ChatStatusWaiting, models.ChatStatusActive}}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	sessions := []models.ChatSession{}
+	err = cursor.All(ctx, &sessions)
+	return sessions, err
+}
+
+// Claim assigns a waiting session to agentID.
+func (d *Desk) Claim(ctx context.Context, sessionID, agentID primitive.ObjectID) (models.ChatSession, error) {
+	session, err := d.assign(ctx, sessionID, agentID)
+	if err == nil {
+		metrics.ChatAssignments.WithLabelValues(metrics.AssignClaim).Inc()
+	}
+	return session, err
+}
+
+func (d *Desk) assign(ctx context.Context, sessionID, agentID primitive.ObjectID) (models.ChatSession, error) {
+	now := time.Now()
+	var session models.ChatSession
+	err := d.sessions.FindOneAndUpdate(ctx,
+		bson.M{"_id": sessionID, "status": models.ChatStatusWaiting},
+		bson.M{"$set": bson.M{"status": models.ChatStatusActive, "agent_id": agentID, "assigned_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return session, d.missingOr(ctx, sessionID, ErrNotWaiting)
+	} else if err != nil {
+		return session, err
+	}
+	metrics.ChatWaitTime.Observe(now.Sub(session.CreatedAt).Seconds())
+	_, err = d.agents.UpdateOne(ctx,
+		bson.M{"_id": agentID},
+		bson.M{"$set": bson.M{"last_assigned_at": now}, "$setOnInsert": bson.M{"available": false, "updated_at": now}},
+		options.Update().SetUpsert(true))
+	return session, err
+}
+
+// missingOr tells a session that does not exist apart from one that is in
+// the wrong state for the operation.
+func (d *Desk) missingOr(ctx context.Context, sessionID primitive.ObjectID, stateErr error) error {
+	n, err := d.sessions.CountDocuments(ctx, bson.M{"_id": sessionID})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return stateErr
+}
+
+// nextAgent picks the agent the next waiting session should go to.
+func (d *Desk) nextAgent(ctx context.Context) (primitive.ObjectID, bool, error) {
+	if d.strategy == Manual {
+		return primitive.NilObjectID, false, nil
+	}
+	cursor, err := d.agents.Find(ctx, bson.M{"available": true})
+	if err != nil {
+		return primitive.NilObjectID, false, err
+	}
+	var agents []Agent
+	if err := cursor.All(ctx, &agents); err != nil || len(agents) == 0 {
+		return primitive.NilObjectID, false, err
+	}
+	load, err := d.load(ctx)
+	if err != nil {
+		return primitive.NilObjectID, false, err
+	}
+	id, ok := pick(d.strategy, agents, load, d.maxChats)
+	return id, ok, nil
+}
+
+// load counts active sessions per agent.
+func (d *Desk) load(ctx context.Context) (map[primitive.ObjectID]int, error) {
+	cursor, err := d.sessions.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": models.ChatStatusActive}}},
+		{{Key: "$group", Value: bson.M{"_id": "$agent_id", "active": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Agent  primitive.ObjectID `bson:"_id"`
+		Active int                `bson:"active"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	load := make(map[primitive.ObjectID]int, len(rows))
+	for _, row := range rows {
+		load[row.Agent] = row.Active
+	}
+	return load, nil
+}
+
+// pick chooses among the available agents, skipping those at maxChats.
+func pick(strategy Strategy, agents []Agent, load map[primitive.ObjectID]int, maxChats int) (primitive.ObjectID, bool) {
+	var best *Agent
+	for i := range agents {
+		agent := &agents[i]
+		if maxChats > 0 && load[agent.ID] >= maxChats {
+			continue
+		}
+		if best == nil || ahead(strategy, agent, best, load) {
+			best = agent
+		}
+	}
+	if best == nil {
+		return primitive.NilObjectID, false
+	}
+	return best.ID, true
+}
+
+// ahead reports whether a should be assigned before b.
+func ahead(strategy Strategy, a, b *Agent, load map[primitive.ObjectID]int) bool {
+	if strategy == LeastBusy && load[a.ID] != load[b.ID] {
+		return load[a.ID] < load[b.ID]
+	}
+	if !a.LastAssignedAt.Equal(b.LastAssignedAt) {
+		return a.LastAssignedAt.Before(b.LastAssignedAt)
+	}
+	return a.ID.Hex() < b.ID.Hex()
+}
+
+// AutoAssign hands a waiting session to an agent according to the
+// strategy. It reports false when no agent is available or the session was
+// claimed in the meantime.
+func (d *Desk) AutoAssign(ctx context.Context, sessionID primitive.ObjectID) (models.ChatSession, bool, error) {
+	agentID, ok, err := d.nextAgent(ctx)
+	if err != nil || !ok {
+		return models.ChatSession{}, false, err
+	}
+	session, err := d.assign(ctx, sessionID, agentID)
+	if errors.Is(err, ErrNotWaiting) {
+		return session, false, nil
+	} else if err != nil {
+		return session, false, err
+	}
+	metrics.ChatAssignments.WithLabelValues(metrics.AssignAuto).Inc()
+	return session, true, nil
+}
+
+// AssignWaiting works through the queue oldest first until it is empty or
+// no agent can take more, and returns the sessions it assigned.
+func (d *Desk) AssignWaiting(ctx context.Context) ([]models.ChatSession, error) {
+	if d.strategy == Manual {
+		return nil, nil
+	}
+	cursor, err := d.sessions.Find(ctx,
+		bson.M{"status": models.ChatStatusWaiting},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var waiting []models.ChatSession
+	if err := cursor.All(ctx, &waiting); err != nil {
+		return nil, err
+	}
+	var assigned []models.ChatSession
+	for _, w := range waiting {
+		agentID, ok, err := d.nextAgent(ctx)
+		if err != nil || !ok {
+			return assigned, err
+		}
+		session, err := d.assign(ctx, w.ID, agentID)
+		if errors.Is(err, ErrNotWaiting) || errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return assigned, err
+		}
+		metrics.ChatAssignments.WithLabelValues(metrics.AssignAuto).Inc()
+		assigned = append(assigned, session)
+	}
+	return assigned, nil
+}
+
+// Transfer hands an active session to another agent and returns the
+// session before and after.
+func (d *Desk) Transfer(ctx context.Context, sessionID, to primitive.ObjectID) (models.ChatSession, models.ChatSession, error) {
+	var before models.ChatSession
+	err := d.sessions.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return before, before, ErrNotFound
+	} else if err != nil {
+		return before, before, err
+	}
+	if before.Status != models.ChatStatusActive {
+		return before, before, ErrNotActive
+	}
+	if before.AgentID == to {
+		return before, before, ErrSameAgent
+	}
+
+	transfer := models.ChatTransfer{From: before.AgentID, To: to, At: time.Now()}
+	var after models.ChatSession
+	err = d.sessions.FindOneAndUpdate(ctx,
+		bson.M{"_id": sessionID, "status": models.ChatStatusActive, "agent_id": before.AgentID},
+		bson.M{"$set": bson.M{"agent_id": to}, "$push": bson.M{"transfers": transfer}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&after)
+	if err == mongo.ErrNoDocuments {
+		return before, before, ErrChanged
+	} else if err != nil {
+		return before, before, err
+	}
+	metrics.ChatAssignments.WithLabelValues(metrics.AssignTransfer).Inc()
+	return before, after, nil
+}
@@ -0,0 +1,147 @@
+package support
+
+import (
+	"MovieVerse/models"
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseStrategy(t *testing.T) {
+	for _, s := range []string{"manual", "round_robin", "least_busy"} {
+		if _, err := ParseStrategy(s); err != nil {
+			t.Errorf("Expected %q to parse, got %v", s, err)
+		}
+	}
+	if _, err := ParseStrategy("random"); err == nil {
+		t.Error("Expected an unknown strategy to be rejected")
+	}
+}
+
+func TestPick(t *testing.T) {
+	now := time.Now()
+	a := Agent{ID: primitive.NewObjectID(), LastAssignedAt: now.Add(-time.Minute)}
+	b := Agent{ID: primitive.NewObjectID(), LastAssignedAt: now.Add(-time.Hour)}
+	c := Agent{ID: primitive.NewObjectID()}
+	agents := []Agent{a, b, c}
+
+	cases := []struct {
+		name     string
+		strategy Strategy
+		load     map[primitive.ObjectID]int
+		maxChats int
+		want     primitive.ObjectID
+		ok       bool
+	}{
+		{"round robin takes the agent never assigned", RoundRobin, nil, 0, c.ID, true},
+		{"round robin ignores load", RoundRobin, map[primitive.ObjectID]int{c.ID: 3}, 0, c.ID, true},
+		{"round robin skips agents at capacity", RoundRobin, map[primitive.ObjectID]int{c.ID: 2}, 2, b.ID, true},
+		{"least busy takes the idlest agent", LeastBusy, map[primitive.ObjectID]int{b.ID: 1, c.ID: 2}, 0, a.ID, true},
+		{"least busy breaks ties by last assignment", LeastBusy, map[primitive.ObjectID]int{a.ID: 1, b.ID: 1, c.ID: 2}, 0, b.ID, true},
+		{"everyone at capacity", LeastBusy, map[primitive.ObjectID]int{a.ID: 1, b.ID: 1, c.ID: 1}, 1, primitive.NilObjectID, false},
+	}
+	for _, tc := range cases {
+		got, ok := pick(tc.strategy, agents, tc.load, tc.maxChats)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%s: expected %v/%v, got %v/%v", tc.name, tc.want.Hex(), tc.ok, got.Hex(), ok)
+		}
+	}
+}
+
+// liveDesk returns a desk on a scratch database on the server named by
+// MOVIEVERSE_TEST_MONGO_URI, dropped when the test ends.
+func liveDesk(t *testing.T, strategy Strategy, maxChats int) (*Desk, *mongo.Database) {
+	t.Helper()
+	uri := os.Getenv("MOVIEVERSE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MOVIEVERSE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("movieverse_support_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return NewDesk(db, strategy, maxChats), db
+}
+
+func queue(t *testing.T, db *mongo.Database, age time.Duration) primitive.ObjectID {
+	t.Helper()
+	session := models.ChatSession{
+		ID:        primitive.NewObjectID(),
+		ClientID:  primitive.NewObjectID(),
+		Status:    models.ChatStatusWaiting,
+		CreatedAt: time.Now().Add(-age),
+	}
+	if _, err := db.Collection("chat_sessions").InsertOne(context.Background(), session); err != nil {
+		t.Fatal(err)
+	}
+	return session.ID
+}
+
+func TestDesk_LiveQueue(t *testing.T) {
+	desk, db := liveDesk(t, LeastBusy, 1)
+	ctx := context.Background()
+	first := queue(t, db, 2*time.Minute)
+	second := queue(t, db, time.Minute)
+
+	if _, ok, err := desk.AutoAssign(ctx, first); ok || err != nil {
+		t.Fatalf("Expected no assignment without available agents, got %v, %v", ok, err)
+	}
+
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	if _, err := desk.SetAvailable(ctx, alice, true); err != nil {
+		t.Fatal(err)
+	}
+	assigned, err := desk.AssignWaiting(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assigned) != 1 || assigned[0].ID != first || assigned[0].AgentID != alice {
+		t.Fatalf("Expected the oldest session to go to the only agent, got %+v", assigned)
+	}
+
+	// Alice is at capacity, so the second session waits for Bob.
+	if _, ok, _ := desk.AutoAssign(ctx, second); ok {
+		t.Fatal("Expected the capacity limit to hold the second session back")
+	}
+	session, err := desk.Claim(ctx, second, bob)
+	if err != nil || session.AgentID != bob || session.Status != models.ChatStatusActive {
+		t.Fatalf("Expected Bob to claim the session, got %+v, %v", session, err)
+	}
+	if _, err := desk.Claim(ctx, second, alice); !errors.Is(err, ErrNotWaiting) {
+		t.Errorf("Expected a second claim to fail with ErrNotWaiting, got %v", err)
+	}
+	if _, err := desk.Claim(ctx, primitive.NewObjectID(), alice); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an unknown session to fail with ErrNotFound, got %v", err)
+	}
+
+	before, after, err := desk.Transfer(ctx, second, alice)
+	if err != nil || before.AgentID != bob || after.AgentID != alice || len(after.Transfers) != 1 {
+		t.Fatalf("Unexpected transfer result %+v, %+v, %v", before, after, err)
+	}
+	if _, _, err := desk.Transfer(ctx, second, alice); !errors.Is(err, ErrSameAgent) {
+		t.Errorf("Expected ErrSameAgent, got %v", err)
+	}
+
+	stats, err := desk.Stats(ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Waiting != 0 || stats.Active != 2 || stats.Assigned != 2 || stats.AvailableAgents != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.AvgWaitSeconds < 60 || stats.MaxWaitSeconds < 120 {
+		t.Errorf("Expected wait times to reflect the queue, got %+v", stats)
+	}
+}
@@ -0,0 +1,160 @@
+package support
+
+import (
+	"MovieVerse/models"
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
+	"time"
+)
+
+// Stats describes the queue as it is now, plus wait and handle times of the
+// sessions assigned or closed since Since.
+type Stats struct {
+	Since              time.Time    `json:"since"`
+	Waiting            int          `json:"waiting"`
+	LongestWaitSeconds float64      `json:"longest_wait_seconds"`
+	Active             int          `json:"active"`
+	AvailableAgents    int          `json:"available_agents"`
+	Assigned           int          `json:"assigned"`
+	AvgWaitSeconds     float64      `json:"avg_wait_seconds"`
+	MaxWaitSeconds     float64      `json:"max_wait_seconds"`
+	Closed             int          `json:"closed"`
+	AvgHandleSeconds   float64      `json:"avg_handle_seconds"`
+	Agents             []AgentStats `json:"agents"`
+}
+
+type AgentStats struct {
+	AgentID          primitive.ObjectID `json:"agent_id"`
+	Available        bool               `json:"available"`
+	Active           int                `json:"active"`
+	Closed           int                `json:"closed"`
+	AvgHandleSeconds float64            `json:"avg_handle_seconds"`
+}
+
+// durationMillis is the aggregation expression for the time between two
+// date fields; subtracting dates yields milliseconds.
+func durationMillis(from, to string) bson.A {
+	return bson.A{"$" + to, "$" + from}
+}
+
+func (d *Desk) Stats(ctx context.Context, since time.Time) (Stats, error) {
+	now := time.Now()
+	stats := Stats{Since: since, Agents: []AgentStats{}}
+
+	waiting, err := d.sessions.CountDocuments(ctx, bson.M{"status": models.ChatStatusWaiting})
+	if err != nil {
+		return stats, err
+	}
+	stats.Waiting = int(waiting)
+	if waiting > 0 {
+		var oldest models.ChatSession
+		err := d.sessions.FindOne(ctx, bson.M{"status": models.ChatStatusWaiting},
+			options.FindOne().SetSort(bson.D{{Key: "created_at", Value: 1}})).Decode(&oldest)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return stats, err
+		}
+		if err == nil {
+			stats.LongestWaitSeconds = now.Sub(oldest.CreatedAt).Seconds()
+		}
+	}
+
+	agents := make(map[primitive.ObjectID]*AgentStats)
+	agent := func(id primitive.ObjectID) *AgentStats {
+		if agents[id] == nil {
+			agents[id] = &AgentStats{AgentID: id}
+		}
+		return agents[id]
+	}
+
+	cursor, err := d.agents.Find(ctx, bson.M{})
+	if err != nil {
+		return stats, err
+	}
+	var standing []Agent
+	if err := cursor.All(ctx, &standing); err != nil {
+		return stats, err
+	}
+	for _, a := range standing {
+		agent(a.ID).Available = a.Available
+		if a.Available {
+			stats.AvailableAgents++
+		}
+	}
+
+	load, err := d.load(ctx)
+	if err != nil {
+		return stats, err
+	}
+	for id, active := range load {
+		agent(id).Active = active
+		stats.Active += active
+	}
+
+	var waits []struct {
+		Count int     `bson:"count"`
+		Avg   float64 `bson:"avg"`
+		Max   float64 `bson:"max"`
+	}
+	cursor, err = d.sessions.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"assigned_at": bson.M{"$gte": since}}}},
+		{{Key: "$project", Value: bson.M{"wait": bson.M{"$subtract": durationMillis("created_at", "assigned_at")}}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "count": bson.M{"$sum": 1}, "avg": bson.M{"$avg": "$wait"}, "max": bson.M{"$max": "$wait"}}}},
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := cursor.All(ctx, &waits); err != nil {
+		return stats, err
+	}
+	if len(waits) == 1 {
+		stats.Assigned = waits[0].Count
+		stats.AvgWaitSeconds = waits[0].Avg / 1000
+		stats.MaxWaitSeconds = waits[0].Max / 1000
+	}
+
+	// Handle time goes to the agent who closed the session out, including
+	// time spent with agents it was transferred from.
+	var handled []struct {
+		Agent primitive.ObjectID `bson:"_id"`
+		Count int                `bson:"count"`
+		Avg   float64            `bson:"avg"`
+	}
+	cursor, err = d.sessions.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"status":      models.ChatStatusClosed,
+			"closed_at":   bson.M{"$gte": since},
+			"assigned_at": bson.M{"$type": "date"},
+		}}},
+		{{Key: "$project", Value: bson.M{"agent_id": 1, "handle": bson.M{"$subtract": durationMillis("assigned_at", "closed_at")}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$agent_id", "count": bson.M{"$sum": 1}, "avg": bson.M{"$avg": "$handle"}}}},
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := cursor.All(ctx, &handled); err != nil {
+		return stats, err
+	}
+	var totalHandle float64
+	for _, h := range handled {
+		a := agent(h.Agent)
+		a.Closed = h.Count
+		a.AvgHandleSeconds = h.Avg / 1000
+		stats.Closed += h.Count
+		totalHandle += h.Avg * float64(h.Count)
+	}
+	if stats.Closed > 0 {
+		stats.AvgHandleSeconds = totalHandle / float64(stats.Closed) / 1000
+	}
+
+	for _, a := range agents {
+		stats.Agents = append(stats.Agents, *a)
+	}
+	sort.Slice(stats.Agents, func(i, j int) bool {
+		return stats.Agents[i].AgentID.Hex() < stats.Agents[j].AgentID.Hex()
+	})
+	return stats, nil
+}
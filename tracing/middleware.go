@@ -0,0 +1,47 @@
+package tracing
+
+import (
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strings"
+)
+
+// Middleware starts a server span for every request, continuing the trace
+// from the incoming traceparent header if there is one. Like the metrics
+// middleware it must sit directly outside the ServeMux, or at least outside
+// handlers that pass the request through unchanged: once the mux has picked
+// a handler the span is renamed after the matched pattern.
+func Middleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(nameByRoute(next), "http.request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}),
+	)
+}
+
+func nameByRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if r.Pattern == "" {
+			return
+		}
+		route := r.Pattern
+		if i := strings.IndexByte(route, ' '); i >= 0 {
+			route = route[i+1:]
+		}
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(attribute.String("http.route", route))
+	})
+}
+
+// MongoMonitor returns a command monitor that records a client span for
+// every command. Commands are only linked to the request's trace when the
+// driver is given the request's context.
+func MongoMonitor() *event.CommandMonitor {
+	return otelmongo.NewMonitor()
+}
@@ -0,0 +1,49 @@
+package tracing
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func useRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestMiddleware_NamesSpanAfterRouteAndContinuesTrace(t *testing.T) {
+	recorder := useRecorder(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/movies/{id}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "lookup")
+		span.End()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/movies/42", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	Middleware(mux).ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected a handler span and a server span, got %d spans", len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if server.Name() != "GET /movies/{id}" {
+		t.Errorf("Expected the server span to be named after the route, got %q", server.Name())
+	}
+	if got := server.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the incoming trace to be continued, got trace %s", got)
+	}
+	if child.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("Expected the handler span to be a child of the server span")
+	}
+}
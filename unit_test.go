@@ -1,11 +1,18 @@
 package main
 
 import (
+	"MovieVerse/config"
+	"MovieVerse/controllers"
+	"MovieVerse/models"
 	"bytes"
 	"encoding/json"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandlePostRequest(t *testing.T) {
@@ -80,3 +87,82 @@ func TestHandlePostRequest_EmptyMessage(t *testing.T) {
 		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, rr.Code)
 	}
 }
+
+func TestCloseChats_SendsCloseFrame(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		hub.Attach("7", ws)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	for deadline := time.Now().Add(time.Second); ; {
+		if hub.Connections()["7"] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Connection was never registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	closeChats()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected a going-away close frame, got %v", err)
+	}
+	if left := len(hub.Connections()); left != 0 {
+		t.Errorf("Expected every chat to be dropped, %d left", left)
+	}
+}
+
+func TestCanAccessChat(t *testing.T) {
+	owner := primitive.NewObjectID()
+	session := models.ChatSession{ID: primitive.NewObjectID(), ClientID: owner, Status: models.ChatStatusActive}
+
+	cases := []struct {
+		name   string
+		claims controllers.Claims
+		want   bool
+	}{
+		{"owner", controllers.Claims{UserID: owner, Roles: []string{controllers.RoleCustomer}}, true},
+		{"other customer", controllers.Claims{UserID: primitive.NewObjectID(), Roles: []string{controllers.RoleCustomer}}, false},
+		{"support agent", controllers.Claims{UserID: primitive.NewObjectID(), Roles: []string{controllers.RoleSupportAgent}}, true},
+	}
+	for _, c := range cases {
+		if got := canAccessChat(&c.claims, session, controllers.PermChatsModerate); got != c.want {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestRunCommand_RejectsBeforeConnecting(t *testing.T) {
+	valid := config.Default()
+	badURI := config.Default()
+	badURI.Mongo.URI = "localhost:27017"
+
+	cases := []struct {
+		name string
+		cfg  config.Config
+		args []string
+		want int
+	}{
+		{"unknown command", valid, []string{"migrat", "up"}, 2},
+		{"migrate with a bad database URI", badURI, []string{"migrate", "status"}, 1},
+		{"verify-audit without an audit key", valid, []string{"verify-audit"}, 1},
+	}
+	for _, c := range cases {
+		if got := runCommand(c.cfg, c.args); got != c.want {
+			t.Errorf("%s: expected exit status %d, got %d", c.name, c.want, got)
+		}
+	}
+}